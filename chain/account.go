@@ -1,26 +1,228 @@
 package chain
 
 import (
+	"blockchain/hash"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"github.com/btcsuite/btcd/btcec/v2"
+	"strings"
 	"time"
 )
 
+// Accounts are created by a transaction of type TransactionTypeCreateAccount of an existing account, the creator, which
+// pays at least the minimum fee. The payload is the compressed public key of the new account followed by the optional
+// alias. The account ID is the hash of the compressed public key. Every account can be referenced by the name
+// "<hex account ID>.web3", and by "<alias>.web3" if it registered an alias.
+const (
+	AccountNameSuffix   = ".web3"
+	AccountAliasMin     = 3   // Minimum length of an alias
+	AccountAliasMax     = 32  // Maximum length of an alias
+	AccountCreateFeeMin = 100 // Minimum fee of an account creation, so that the registry cannot be filled for free
+)
+
+// Account encoding in the store. The ID is not encoded, it is derived from the public key.
+//
+// Offset  Length  Content
+// 0       1       Format version = 0
+// 1       33      Public key, compressed
+// 34      8       Height of the block that created the account
+// 42      8       Timestamp of the block, unix time in milliseconds
+// 50      1       Length of the alias
+// 51      ?       Alias
+const (
+	accountFormatOffset      = 0
+	accountPublicKeyOffset   = 1
+	accountHeightOffset      = accountPublicKeyOffset + publicKeySize
+	accountTimestampOffset   = accountHeightOffset + 8
+	accountAliasLengthOffset = accountTimestampOffset + 8
+	accountAliasOffset       = accountAliasLengthOffset + 1
+
+	accountFormat = 0
+)
+
+var ErrorAccountExists = errors.New("ACCOUNT ALREADY EXISTS")
+var ErrorAccountAlias = errors.New("INVALID ACCOUNT ALIAS")
+var ErrorAccountAliasTaken = errors.New("ACCOUNT ALIAS ALREADY REGISTERED")
+var ErrorAccountMalformed = errors.New("MALFORMED ACCOUNT")
+var ErrorAccountFee = errors.New("ACCOUNT CREATION FEE BELOW MINIMUM")
+
 type Account struct {
-	ID        []byte
-	CreatedAt time.Time
+	ID        []byte // Hash of the public key
 	PublicKey *btcec.PublicKey
+	Alias     string    // Registered alias without the suffix, empty if none
+	Height    uint64    // Height of the block that created the account
+	CreatedAt time.Time // Timestamp of the block that created the account
+}
+
+// AccountID returns the account ID of the public key.
+func AccountID(publicKey *btcec.PublicKey) []byte {
+	return hash.HashData(publicKey.SerializeCompressed())
+}
+
+// CreateAccount creates the transaction that creates the account of the public key, paid by the account of the private
+// key and signed for the chain ID. The alias is optional.
+func CreateAccount(privateKey *btcec.PrivateKey, chainID uint32, nonce uint64, publicKey *btcec.PublicKey, alias string, fee uint64) (transaction *Transaction, err error) {
+	if alias != "" && !ValidAlias(alias) {
+		return nil, ErrorAccountAlias
+	}
+	transaction = &Transaction{
+		Type:      TransactionTypeCreateAccount,
+		Timestamp: uint64(time.Now().UnixMilli()),
+		Nonce:     nonce,
+		Fee:       fee,
+		Payload:   append(publicKey.SerializeCompressed(), alias...),
+	}
+	if err = transaction.Sign(privateKey, chainID); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// ValidAlias checks that the alias has 3 to 32 characters, only lower case letters, digits and hyphens, and does not
+// start or end with a hyphen.
+func ValidAlias(alias string) bool {
+	if len(alias) < AccountAliasMin || len(alias) > AccountAliasMax || alias[0] == '-' || alias[len(alias)-1] == '-' {
+		return false
+	}
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Name returns the name of the account, which is the alias if registered and otherwise the hex account ID.
+func (account *Account) Name() string {
+	if account.Alias != "" {
+		return account.Alias + AccountNameSuffix
+	}
+	return hex.EncodeToString(account.ID) + AccountNameSuffix
+}
+
+// accountFromTransaction returns the account created by the transaction.
+func accountFromTransaction(transaction *Transaction, block *Block) (account *Account, err error) {
+	if len(transaction.Payload) < publicKeySize {
+		return nil, ErrorAccountMalformed
+	}
+	publicKey, err := btcec.ParsePubKey(transaction.Payload[:publicKeySize])
+	if err != nil {
+		return nil, ErrorAccountMalformed
+	}
+	alias := string(transaction.Payload[publicKeySize:])
+	if alias != "" && !ValidAlias(alias) {
+		return nil, ErrorAccountAlias
+	}
+	return &Account{
+		ID:        AccountID(publicKey),
+		PublicKey: publicKey,
+		Alias:     alias,
+		Height:    block.Height,
+		CreatedAt: time.UnixMilli(int64(block.Timestamp)),
+	}, nil
 }
 
-func CreateAccount(privateKey *btcec.PrivateKey, specialID []byte) (account *Account) {
-	_, AccountPublicKey := btcec.PrivKeyFromBytes(privateKey.Serialize())
-	accountId := AccountPublicKey.SerializeCompressed()
-	if len(specialID) > 0 {
-		copy(accountId, specialID)
+func (account *Account) encode() (data []byte) {
+	data = make([]byte, accountAliasOffset, accountAliasOffset+len(account.Alias))
+	data[accountFormatOffset] = accountFormat
+	copy(data[accountPublicKeyOffset:accountHeightOffset], account.PublicKey.SerializeCompressed())
+	binary.BigEndian.PutUint64(data[accountHeightOffset:accountTimestampOffset], account.Height)
+	binary.BigEndian.PutUint64(data[accountTimestampOffset:accountAliasLengthOffset], uint64(account.CreatedAt.UnixMilli()))
+	data[accountAliasLengthOffset] = byte(len(account.Alias))
+	return append(data, account.Alias...)
+}
+
+func decodeAccount(data []byte) (account *Account, err error) {
+	if len(data) < accountAliasOffset || data[accountFormatOffset] != accountFormat || len(data) != accountAliasOffset+int(data[accountAliasLengthOffset]) {
+		return nil, ErrorAccountMalformed
 	}
 	account = &Account{
-		ID:        accountId,
-		PublicKey: AccountPublicKey,
-		CreatedAt: time.Now(),
+		Height:    binary.BigEndian.Uint64(data[accountHeightOffset:accountTimestampOffset]),
+		CreatedAt: time.UnixMilli(int64(binary.BigEndian.Uint64(data[accountTimestampOffset:accountAliasLengthOffset]))),
+		Alias:     string(data[accountAliasOffset:]),
+	}
+	if account.PublicKey, err = btcec.ParsePubKey(data[accountPublicKeyOffset:accountHeightOffset]); err != nil {
+		return nil, ErrorAccountMalformed
+	}
+	account.ID = AccountID(account.PublicKey)
+	return account, nil
+}
+
+// Accounts are stored under the prefix followed by the account ID, aliases under the prefix followed by the alias. The
+// alias record is the account ID.
+const (
+	keyAccountPrefix = "account/"
+	keyAliasPrefix   = "alias/"
+)
+
+func keyAccount(id []byte) []byte {
+	return append([]byte(keyAccountPrefix), id...)
+}
+
+func keyAlias(alias string) []byte {
+	return []byte(keyAliasPrefix + alias)
+}
+
+// GetAccount returns the account with the ID.
+func (blockchain *Blockchain) GetAccount(id []byte) (account *Account, found bool) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.getAccount(id)
+}
+
+// GetAccountByPublicKey returns the account of the public key.
+func (blockchain *Blockchain) GetAccountByPublicKey(publicKey *btcec.PublicKey) (account *Account, found bool) {
+	return blockchain.GetAccount(AccountID(publicKey))
+}
+
+// GetAccountByName resolves the name "<alias>.web3" or "<hex account ID>.web3".
+func (blockchain *Blockchain) GetAccountByName(name string) (account *Account, found bool) {
+	if !strings.HasSuffix(name, AccountNameSuffix) {
+		return nil, false
+	}
+	name = strings.TrimSuffix(name, AccountNameSuffix)
+	if id, err := hex.DecodeString(name); err == nil && len(id) == hashSize {
+		return blockchain.GetAccount(id)
+	}
+
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	if !ValidAlias(name) {
+		return nil, false
+	}
+	id, found := blockchain.database.Get(keyAlias(name))
+	if !found {
+		return nil, false
+	}
+	return blockchain.getAccount(id)
+}
+
+// getAccount reads the account. The blockchain must be locked.
+func (blockchain *Blockchain) getAccount(id []byte) (account *Account, found bool) {
+	data, found := blockchain.database.Get(keyAccount(id))
+	if !found {
+		return nil, false
+	}
+	if account, err := decodeAccount(data); err == nil {
+		return account, true
+	}
+	return nil, false
+}
+
+// aliasTaken reports whether the alias is registered. The blockchain must be locked.
+func (blockchain *Blockchain) aliasTaken(alias string) bool {
+	_, found := blockchain.database.Get(keyAlias(alias))
+	return found
+}
+
+// storeAccount stores the account and its alias. The blockchain must be locked.
+func (blockchain *Blockchain) storeAccount(account *Account) (err error) {
+	if err = blockchain.database.Set(keyAccount(account.ID), account.encode()); err != nil {
+		return err
+	}
+	if account.Alias != "" {
+		return blockchain.database.Set(keyAlias(account.Alias), account.ID)
 	}
-	return account
+	return nil
 }
@@ -0,0 +1,125 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidAlias(t *testing.T) {
+	for _, test := range []struct {
+		alias string
+		valid bool
+	}{
+		{"abc", true},
+		{"a-1", true},
+		{"0123456789abcdefghijklmnopqrstuv", true},
+		{"ab", false},
+		{"0123456789abcdefghijklmnopqrstuvw", false},
+		{"-ab", false},
+		{"ab-", false},
+		{"aBc", false},
+		{"a.b", false},
+		{"a b", false},
+	} {
+		if ValidAlias(test.alias) != test.valid {
+			t.Errorf("alias %q valid %t", test.alias, !test.valid)
+		}
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	validator, creator, poor, created := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	taken := testGenesisAccount(poor, AccountCreateFeeMin-1)
+	taken.Alias = "taken"
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(validator, 0), testGenesisAccount(creator, 1000), taken)
+
+	if _, err := CreateAccount(creator, testChainID, 0, created.PubKey(), "-invalid", AccountCreateFeeMin); err != ErrorAccountAlias {
+		t.Fatalf("error %v", err)
+	}
+
+	malformed := &Transaction{Type: TransactionTypeCreateAccount, Timestamp: uint64(time.Now().UnixMilli()), Fee: AccountCreateFeeMin, Payload: []byte("alias")}
+	if err := malformed.Sign(creator, testChainID); err != nil {
+		t.Fatal(err)
+	}
+	invalidAlias := &Transaction{Type: TransactionTypeCreateAccount, Timestamp: uint64(time.Now().UnixMilli()), Fee: AccountCreateFeeMin,
+		Payload: append(created.PubKey().SerializeCompressed(), "-invalid"...)}
+	if err := invalidAlias.Sign(creator, testChainID); err != nil {
+		t.Fatal(err)
+	}
+
+	newCreation := func(nonce uint64, alias string, fee uint64) *Transaction {
+		t.Helper()
+		transaction, err := CreateAccount(creator, testChainID, nonce, created.PubKey(), alias, fee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transaction
+	}
+	ownAccount, err := CreateAccount(creator, testChainID, 0, creator.PubKey(), "", AccountCreateFeeMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutBalance, err := CreateAccount(poor, testChainID, 0, created.PubKey(), "", AccountCreateFeeMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownCreator, err := CreateAccount(newTestKey(t), testChainID, 0, created.PubKey(), "", AccountCreateFeeMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every failed creation rejects the block, the state is unchanged
+	for _, test := range []struct {
+		name         string
+		transactions []*Transaction
+		expected     error
+	}{
+		{"fee below minimum", []*Transaction{newCreation(0, "", AccountCreateFeeMin-1)}, ErrorAccountFee},
+		{"insufficient balance", []*Transaction{withoutBalance}, ErrorInsufficientBalance},
+		{"unknown creator", []*Transaction{unknownCreator}, ErrorAccountNotFound},
+		{"nonce", []*Transaction{newCreation(1, "", AccountCreateFeeMin)}, ErrorTransactionNonce},
+		{"existing account", []*Transaction{ownAccount}, ErrorAccountExists},
+		{"malformed payload", []*Transaction{malformed}, ErrorAccountMalformed},
+		{"invalid alias", []*Transaction{invalidAlias}, ErrorAccountAlias},
+		{"alias taken", []*Transaction{newCreation(0, "taken", AccountCreateFeeMin)}, ErrorAccountAliasTaken},
+		{"created twice", []*Transaction{newCreation(0, "", AccountCreateFeeMin), newCreation(1, "", AccountCreateFeeMin)}, ErrorAccountExists},
+	} {
+		err := blockchain.AppendBlock(newTestBlock(t, validator, genesisBlock, 10, test.transactions...))
+		if !errors.Is(err, test.expected) {
+			t.Fatalf("%s: error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+	expectState(t, blockchain, creator, 1000, 0)
+
+	// the creator pays the fee to the producer, the new account starts empty
+	block := newTestBlock(t, validator, genesisBlock, 10, newCreation(0, "carol", 2*AccountCreateFeeMin))
+	if err = blockchain.AppendBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, blockchain, creator, 1000-2*AccountCreateFeeMin, 1)
+	expectState(t, blockchain, validator, 2*AccountCreateFeeMin, 0)
+	expectState(t, blockchain, created, 0, 0)
+	for _, name := range []string{"carol.web3", (&Account{ID: AccountID(created.PubKey())}).Name()} {
+		account, found := blockchain.GetAccountByName(name)
+		if !found || !account.PublicKey.IsEqual(created.PubKey()) || account.Alias != "carol" || account.Height != 1 ||
+			account.CreatedAt.UnixMilli() != 10 {
+			t.Fatalf("name %s: account %+v found %t", name, account, found)
+		}
+	}
+	if account, found := blockchain.GetAccountByPublicKey(created.PubKey()); !found || account.Name() != "carol.web3" {
+		t.Fatal("account not found by public key")
+	}
+
+	// a reset removes the account and its alias
+	addTestBlocks(t, blockchain, newTestBlock(t, validator, block, 20))
+	if err = blockchain.Reset(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := blockchain.GetAccountByName("carol.web3"); found {
+		t.Fatal("account kept")
+	}
+	if _, found := blockchain.GetAccountState(AccountID(created.PubKey())); found {
+		t.Fatal("state kept")
+	}
+	expectState(t, blockchain, creator, 1000, 0)
+}
@@ -0,0 +1,191 @@
+package chain
+
+import (
+	"blockchain/hash"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"time"
+)
+
+// Block encoding. All integers are big endian. The fields up to the signature are the header, its hash is the block hash.
+//
+// Offset  Length  Content
+// 0       1       Format version = 1
+// 1       32      Hash of the previous block, zero for the first block
+// 33      8       Height
+// 41      8       Timestamp, unix time in milliseconds
+// 49      33      Producer public key, compressed, zero for the genesis block
+// 82      32      Merkle root of the transactions
+// 114     65      Signature of the producer over the block hash
+// 179     4       Count of transactions
+// 183     ?       Transactions, each prefixed by its length (4 bytes)
+const (
+	blockFormatOffset       = 0
+	blockPreviousHashOffset = 1
+	blockHeightOffset       = blockPreviousHashOffset + hashSize
+	blockTimestampOffset    = blockHeightOffset + 8
+	blockProducerOffset     = blockTimestampOffset + 8
+	blockMerkleRootOffset   = blockProducerOffset + publicKeySize
+	blockSignatureOffset    = blockMerkleRootOffset + hashSize
+	blockTxCountOffset      = blockSignatureOffset + signatureSize
+	blockTransactionsOffset = blockTxCountOffset + 4
+
+	blockFormat   = 1 // Format 0 committed to the hash over all transaction hashes instead of the Merkle root
+	hashSize      = 32
+	publicKeySize = 33
+	signatureSize = 65
+
+	BlockSizeMax = 1 << 20 // Maximum size of an encoded block in bytes
+)
+
+var ErrorBlockMalformed = errors.New("MALFORMED BLOCK")
+var ErrorBlockSignature = errors.New("INVALID BLOCK SIGNATURE")
+
+// Block is a single block of the blockchain.
+type Block struct {
+	PreviousHash []byte           // Hash of the previous block, zero for the first block
+	Height       uint64           // Height of the block, the first block has height 0
+	Timestamp    uint64           // Unix time in milliseconds
+	Producer     *btcec.PublicKey // Node that created the block, nil for the genesis block
+	Transactions []Transaction
+	MerkleRoot   []byte // Commitment to the transactions
+	Signature    []byte // Signature of the producer over the block hash
+}
+
+// NewBlock creates an unsigned block on top of the previous one. The previous hash is zero for the first block.
+func NewBlock(previousHash []byte, height uint64, producer *btcec.PublicKey, transactions []Transaction) (block *Block) {
+	block = &Block{
+		PreviousHash: previousHash,
+		Height:       height,
+		Timestamp:    uint64(time.Now().UnixMilli()),
+		Producer:     producer,
+		Transactions: transactions,
+	}
+	if len(block.PreviousHash) == 0 {
+		block.PreviousHash = make([]byte, hashSize)
+	}
+	block.MerkleRoot = block.TransactionsRoot()
+	return block
+}
+
+// TransactionsRoot calculates the commitment to the transactions, the Merkle root over the transaction hashes in order.
+func (block *Block) TransactionsRoot() []byte {
+	return hash.MerkleRoot(block.transactionHashes())
+}
+
+// TransactionProof returns the proof that the transaction at the index is included in the block.
+func (block *Block) TransactionProof(index int) (proof *hash.MerkleProof, err error) {
+	return hash.MerkleProve(block.transactionHashes(), index)
+}
+
+func (block *Block) transactionHashes() (hashes [][]byte) {
+	hashes = make([][]byte, len(block.Transactions))
+	for n := range block.Transactions {
+		hashes[n] = block.Transactions[n].Hash()
+	}
+	return hashes
+}
+
+// encodeHeader encodes the fields covered by the block hash.
+func (block *Block) encodeHeader() (data []byte) {
+	data = make([]byte, blockSignatureOffset)
+	data[blockFormatOffset] = blockFormat
+	copy(data[blockPreviousHashOffset:blockHeightOffset], block.PreviousHash)
+	binary.BigEndian.PutUint64(data[blockHeightOffset:blockTimestampOffset], block.Height)
+	binary.BigEndian.PutUint64(data[blockTimestampOffset:blockProducerOffset], block.Timestamp)
+	if block.Producer != nil {
+		copy(data[blockProducerOffset:blockMerkleRootOffset], block.Producer.SerializeCompressed())
+	}
+	copy(data[blockMerkleRootOffset:blockSignatureOffset], block.MerkleRoot)
+	return data
+}
+
+// Hash returns the block hash. It covers all header fields except the signature; the transactions are covered via the
+// Merkle root.
+func (block *Block) Hash() []byte {
+	return hash.HashData(block.encodeHeader())
+}
+
+// Sign sets the producer and signs the block.
+func (block *Block) Sign(privateKey *btcec.PrivateKey) (err error) {
+	block.Producer = privateKey.PubKey()
+	block.Signature, err = ecdsa.SignCompact(privateKey, block.Hash(), true)
+	return err
+}
+
+// VerifySignature checks that the signature was created by the producer.
+func (block *Block) VerifySignature() error {
+	if block.Producer == nil || len(block.Signature) != signatureSize {
+		return ErrorBlockSignature
+	}
+	signer, _, err := ecdsa.RecoverCompact(block.Signature, block.Hash())
+	if err != nil || !signer.IsEqual(block.Producer) {
+		return ErrorBlockSignature
+	}
+	return nil
+}
+
+// Encode returns the binary encoding of the block.
+func (block *Block) Encode() (data []byte) {
+	data = block.encodeHeader()
+	signature := make([]byte, signatureSize)
+	copy(signature, block.Signature)
+	data = append(data, signature...)
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(block.Transactions)))
+	data = append(data, length[:]...)
+	for n := range block.Transactions {
+		encoded := block.Transactions[n].Encode()
+		binary.BigEndian.PutUint32(length[:], uint32(len(encoded)))
+		data = append(append(data, length[:]...), encoded...)
+	}
+	return data
+}
+
+// DecodeBlock decodes a block. The signature is not verified.
+func DecodeBlock(data []byte) (block *Block, err error) {
+	if len(data) < blockTransactionsOffset || data[blockFormatOffset] != blockFormat {
+		return nil, ErrorBlockMalformed
+	}
+
+	block = &Block{
+		PreviousHash: append([]byte{}, data[blockPreviousHashOffset:blockHeightOffset]...),
+		Height:       binary.BigEndian.Uint64(data[blockHeightOffset:blockTimestampOffset]),
+		Timestamp:    binary.BigEndian.Uint64(data[blockTimestampOffset:blockProducerOffset]),
+		MerkleRoot:   append([]byte{}, data[blockMerkleRootOffset:blockSignatureOffset]...),
+		Signature:    append([]byte{}, data[blockSignatureOffset:blockTxCountOffset]...),
+	}
+	if producer := data[blockProducerOffset:blockMerkleRootOffset]; !bytes.Equal(producer, make([]byte, publicKeySize)) {
+		if block.Producer, err = btcec.ParsePubKey(producer); err != nil {
+			return nil, ErrorBlockMalformed
+		}
+	}
+
+	count := binary.BigEndian.Uint32(data[blockTxCountOffset:blockTransactionsOffset])
+	offset := blockTransactionsOffset
+	for n := uint32(0); n < count; n++ {
+		if offset+4 > len(data) {
+			return nil, ErrorBlockMalformed
+		}
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+		if length > len(data)-offset {
+			return nil, ErrorBlockMalformed
+		}
+		transaction, err := DecodeTransaction(data[offset : offset+length])
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, *transaction)
+		offset += length
+	}
+	if offset != len(data) {
+		return nil, ErrorBlockMalformed
+	}
+
+	return block, nil
+}
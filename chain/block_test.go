@@ -0,0 +1,81 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBlockRoundtrip(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	first := NewBlock(nil, 0, nil, nil)
+	second := newTestBlock(t, validator, first, first.Timestamp+1000,
+		newTestTransfer(t, sender, recipient, 0, 10), newTestTransfer(t, sender, recipient, 1, 20))
+
+	for _, block := range []*Block{first, second} {
+		data := block.Encode()
+		decoded, err := DecodeBlock(data)
+		if err != nil {
+			t.Fatalf("block %d: %v", block.Height, err)
+		}
+		if !bytes.Equal(decoded.Encode(), data) || !bytes.Equal(decoded.Hash(), block.Hash()) ||
+			!bytes.Equal(decoded.MerkleRoot, decoded.TransactionsRoot()) || len(decoded.Transactions) != len(block.Transactions) {
+			t.Fatalf("block %d: decoded block differs", block.Height)
+		}
+		if (decoded.Producer == nil) != (block.Producer == nil) {
+			t.Fatalf("block %d: producer %v", block.Height, decoded.Producer)
+		}
+	}
+
+	// the signature survives the encoding, a changed header invalidates it
+	decoded, _ := DecodeBlock(second.Encode())
+	if err := decoded.VerifySignature(); err != nil {
+		t.Fatal(err)
+	}
+	decoded.Timestamp++
+	if err := decoded.VerifySignature(); err != ErrorBlockSignature {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestDecodeBlockMalformed(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	block := newTestBlock(t, validator, NewBlock(nil, 0, nil, nil), 1000, newTestTransfer(t, sender, recipient, 0, 10))
+	data := block.Encode()
+
+	// a format other than the current one
+	format := append([]byte{}, data...)
+	format[blockFormatOffset] = 0
+	// the producer is not a valid public key
+	producer := append([]byte{}, data...)
+	producer[blockProducerOffset] = 0xFF
+	// more transactions than encoded
+	count := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(count[blockTxCountOffset:], 2)
+	// the transaction length points beyond the data
+	length := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(length[blockTransactionsOffset:], uint32(len(data)))
+	// the transaction itself is malformed
+	transaction := append([]byte{}, data[:blockTransactionsOffset]...)
+	transaction = append(transaction, 0, 0, 0, 1, 0xFF)
+
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"empty", nil, ErrorBlockMalformed},
+		{"truncated header", data[:blockTransactionsOffset-1], ErrorBlockMalformed},
+		{"truncated transaction", data[:len(data)-1], ErrorBlockMalformed},
+		{"trailing bytes", append(append([]byte{}, data...), 0), ErrorBlockMalformed},
+		{"format", format, ErrorBlockMalformed},
+		{"producer", producer, ErrorBlockMalformed},
+		{"transaction count", count, ErrorBlockMalformed},
+		{"transaction length", length, ErrorBlockMalformed},
+		{"transaction", transaction, ErrorTransactionMalformed},
+	} {
+		if _, err := DecodeBlock(test.data); err != test.expected {
+			t.Errorf("%s: error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+}
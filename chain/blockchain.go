@@ -2,20 +2,33 @@ package chain
 
 import (
 	"blockchain/store"
+	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"log"
 	"sync"
 )
 
-// StatusX provides information about the blockchain status. Some errors code indicate a corruption.
+// StatusX provides information about the blockchain status. Some errors code indicate a corruption. The codes from
+// StatusBlockHeight on tell which check of the block validation failed, see BlockError.
 const (
-	StatusOK            = 0 // No problems in the blockchain detected.
-	StatusBlockNotFound = 1 // Missing block in the blockchain.
-	StatusCorruptBlock  = 2 // Error block encoding
+	StatusOK               = 0  // No problems in the blockchain detected.
+	StatusBlockNotFound    = 1  // Missing block in the blockchain.
+	StatusCorruptBlock     = 2  // Error block encoding
+	StatusBlockHeight      = 3  // Height does not follow the parent
+	StatusBlockLinkage     = 4  // Previous hash is not the parent hash
+	StatusBlockTimestamp   = 5  // Timestamp not after the parent, or too far in the future
+	StatusBlockProducer    = 6  // Producer is not the leader of the slot
+	StatusBlockSignature   = 7  // Invalid producer signature
+	StatusBlockMerkleRoot  = 8  // Merkle root does not match the transactions
+	StatusBlockTransaction = 9  // Invalid transaction signature or state change
+	StatusBlockSize        = 10 // Too many transactions or too large
 )
 
+var ErrorBlockHeight = errors.New("BLOCK HEIGHT MISMATCH")
+var ErrorBlockPrevious = errors.New("BLOCK DOES NOT REFERENCE THE PREVIOUS BLOCK")
+var ErrorBlockchainCorrupt = errors.New("BLOCKCHAIN CORRUPT")
+
 const (
 	HeightOffset = 0
 	HeightSize   = 8
@@ -32,24 +45,36 @@ const (
 // Blockchain stores the blockchain's header in memory. Any changes must be synced to disk!
 type Blockchain struct {
 	// header
-	height  uint64 // [0:8] Height is exchanged as uint32 in the protocol, but stored as uint64.
+	height  uint64 // [0:8] Count of blocks, which is the height of the next block. Exchanged as uint32 in the protocol, but stored as uint64.
 	version uint64 // [8:16] Version is always uint64.
 	format  uint16 // [16:18] Format is only locally used.
 
-	accounts map[string]*Account
+	Mempool  *Mempool  // Pending transactions, included ones are removed when a block is appended
+	Schedule *Schedule // Leaders of the block slots, blocks of other producers are rejected
 	// internals
-	path       string      // Path of the blockchain on disk. Depends on key-value store whether a filename or folder.
-	database   store.Store // The database storing the blockchain.
-	sync.Mutex             // synchronized access to the header
+	genesisHash  []byte      // Hash of the genesis block created from the genesis specification
+	chainID      uint32      // Chain ID of the genesis specification
+	path         string      // Path of the blockchain on disk. Depends on key-value store whether a filename or folder.
+	database     store.Store // The database storing the blockchain.
+	sync.Mutex               // synchronized access to the header
+	reorganizing bool        // the callback is deferred until the reorganization completed
 
-	// callback
+	// callback, invoked while the blockchain is locked. It must not call methods of the blockchain.
 	BlockchainUpdate func(blockchain *Blockchain, oldHeight, oldVersion, newHeight, newVersion uint64)
 }
 
-// BootStrap initializes the blockchain. It creates the blockchain database file if it does not exist already.
-func BootStrap() (blockchain *Blockchain, err error) {
+// BootStrap initializes the blockchain. It creates the blockchain database file if it does not exist already. An empty
+// blockchain starts with the genesis block and the initial accounts of the genesis specification.
+func BootStrap(genesis *Genesis) (blockchain *Blockchain, err error) {
 	var dbPath = "/tmp/blockchain/db"
-	blockchain = &Blockchain{path: dbPath}
+	genesisBlock, err := genesis.Block()
+	if err != nil {
+		return nil, err
+	}
+	blockchain = &Blockchain{path: dbPath, genesisHash: genesisBlock.Hash(), chainID: genesis.ChainID, Schedule: &Schedule{SlotDuration: SlotDurationDefault}}
+	blockchain.Mempool = NewMempool(genesis.ChainID)
+	blockchain.Mempool.Validate = blockchain.validateTransaction
+	blockchain.Mempool.NextNonce = blockchain.nextNonce
 
 	// open existing blockchain file or create new one
 	if blockchain.database, err = store.NewPogrebStore(dbPath); err != nil {
@@ -67,14 +92,35 @@ func BootStrap() (blockchain *Blockchain, err error) {
 			return blockchain, err
 		}
 	}
+	if _, err = blockchain.undoPartialBlock(); err != nil {
+		return blockchain, err
+	}
+	if blockchain.height == 0 {
+		if err = blockchain.applyGenesis(genesis, genesisBlock); err != nil {
+			return blockchain, err
+		}
+	}
 
-	log.Printf("Blockchain -> bootstraped height=%d, version=%d", blockchain.height, blockchain.version)
+	log.Printf("Blockchain -> bootstraped chain ID=%d, genesis=%X, height=%d, version=%d", blockchain.chainID, blockchain.genesisHash, blockchain.height, blockchain.version)
 	return blockchain, nil
 }
 
+// ChainID returns the chain ID of the network. It is mixed into the transaction signature hashes and exchanged in the
+// Announcement, so that nodes and transactions of different networks are refused.
+func (blockchain *Blockchain) ChainID() uint32 {
+	return blockchain.chainID
+}
+
 // the key names in the key-value database are constant and must not collide with block numbers (i.e. they must be >64 bit)
 const keyHeader = "header"
 
+// Blocks are stored under their height as 8 bytes big endian. The hash index maps the 32 bytes block hash to the height.
+func keyBlock(height uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], height)
+	return key[:]
+}
+
 // headerRead reads the header from the blockchain and decodes it.
 func (blockchain *Blockchain) headerRead() (found bool, err error) {
 	buffer, found := blockchain.database.Get([]byte(keyHeader))
@@ -108,15 +154,124 @@ func (blockchain *Blockchain) headerWrite(height, version uint64) (err error) {
 	err = blockchain.database.Set([]byte(keyHeader), buffer[:])
 
 	// call the callback, if any
-	if blockchain.BlockchainUpdate != nil {
+	if blockchain.BlockchainUpdate != nil && !blockchain.reorganizing {
 		blockchain.BlockchainUpdate(blockchain, oldHeight, oldVersion, blockchain.height, blockchain.version)
 	}
 
 	return err
 }
 
-func (blockchain *Blockchain) AddAccount(account *Account) {
-	if prevAccount := blockchain.accounts[fmt.Sprintf("%x.web3", account.ID)]; prevAccount != nil {
+// Height returns the count of blocks, which is the height of the next block.
+func (blockchain *Blockchain) Height() uint64 {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.height
+}
+
+// Version returns the version of the blockchain.
+func (blockchain *Blockchain) Version() uint64 {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.version
+}
+
+// AppendBlock stores the block on top of the blockchain. The block must pass the validation pipeline on top of the
+// current top block and all transactions must be valid, otherwise a *BlockError is returned. The state changes are
+// applied atomically: the undo record is stored first and the header last, a block whose append was interrupted in
+// between is reverted at the next start. The transactions of the block are removed from the mempool.
+func (blockchain *Blockchain) AppendBlock(block *Block) (err error) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.appendBlock(block)
+}
+
+// appendBlock validates and appends the block. The blockchain must be locked.
+func (blockchain *Blockchain) appendBlock(block *Block) (err error) {
+	var previous *Block
+	if blockchain.height > 0 {
+		var status int
+		if previous, status = blockchain.getBlock(blockchain.height - 1); status != StatusOK {
+			return ErrorBlockchainCorrupt
+		}
+	}
+	if err = blockchain.validateBlock(block, previous); err != nil {
+		return err
+	}
+
+	transition, err := blockchain.applyBlock(block)
+	if err != nil {
+		return blockError(StatusBlockTransaction, block, err)
+	}
+
+	// the undo record is written first: if the append is interrupted before the header is written, it marks the
+	// partially applied block, which is reverted by undoPartialBlock
+	if err = blockchain.database.Set(keyUndo(block.Height), transition.encodeUndo()); err != nil {
+		return err
+	}
+	blockHash := block.Hash()
+	if err = blockchain.storeBlock(block, blockHash, transition); err != nil {
+		blockchain.undoPartialBlock()
+		return err
+	}
+	blockchain.database.Delete(keySide(blockHash))
+
+	if err = blockchain.headerWrite(blockchain.height+1, blockchain.version); err != nil {
+		return err
+	}
+	blockchain.Mempool.removeBlock(block)
+	return nil
+}
+
+// storeBlock stores the block, its hash index and the state changes. The blockchain must be locked.
+func (blockchain *Blockchain) storeBlock(block *Block, blockHash []byte, transition *stateTransition) (err error) {
+	if err = blockchain.database.Set(keyBlock(block.Height), block.Encode()); err != nil {
+		return err
+	}
+	if err = blockchain.database.Set(blockHash, keyBlock(block.Height)); err != nil {
+		return err
+	}
+	return transition.commit()
+}
 
+// GetBlock returns the block at the height.
+func (blockchain *Blockchain) GetBlock(height uint64) (block *Block, status int) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.getBlock(height)
+}
+
+// getBlock reads the block. The blockchain must be locked.
+func (blockchain *Blockchain) getBlock(height uint64) (block *Block, status int) {
+	if height >= blockchain.height {
+		return nil, StatusBlockNotFound
+	}
+	data, found := blockchain.database.Get(keyBlock(height))
+	if !found {
+		return nil, StatusBlockNotFound
+	}
+	block, err := DecodeBlock(data)
+	if err != nil || block.Height != height {
+		return nil, StatusCorruptBlock
+	}
+	return block, StatusOK
+}
+
+// GetBlockByHash returns the block with the hash.
+func (blockchain *Blockchain) GetBlockByHash(blockHash []byte) (block *Block, status int) {
+	if len(blockHash) != hashSize {
+		return nil, StatusBlockNotFound
+	}
+
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	key, found := blockchain.database.Get(blockHash)
+	if !found || len(key) != 8 {
+		return nil, StatusBlockNotFound
+	}
+	if block, status = blockchain.getBlock(binary.BigEndian.Uint64(key)); status == StatusOK && !bytes.Equal(block.Hash(), blockHash) {
+		// the index points to a block that was replaced
+		return nil, StatusBlockNotFound
 	}
+	return block, status
 }
@@ -0,0 +1,220 @@
+package chain
+
+import (
+	"blockchain/store"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// testChainID is the chain ID of the test blockchains.
+const testChainID = 1
+
+// newTestKey returns a new private key.
+func newTestKey(t *testing.T) *btcec.PrivateKey {
+	t.Helper()
+	privateKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+// testGenesisAccount returns a genesis account of the key with the balance.
+func testGenesisAccount(privateKey *btcec.PrivateKey, balance uint64) GenesisAccount {
+	return GenesisAccount{PublicKey: hex.EncodeToString(privateKey.PubKey().SerializeCompressed()), Balance: balance}
+}
+
+// newTestBlockchain creates a blockchain in a temporary directory with the genesis block. The validator is the only
+// leader, the slots are 1 ms long.
+func newTestBlockchain(t *testing.T, validator *btcec.PrivateKey, accounts ...GenesisAccount) (blockchain *Blockchain, genesisBlock *Block) {
+	t.Helper()
+	database, err := store.NewPogrebStore(t.TempDir() + "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		ChainID:    testChainID,
+		Timestamp:  1,
+		Validators: []string{hex.EncodeToString(validator.PubKey().SerializeCompressed())},
+		Accounts:   accounts,
+	}
+	if genesisBlock, err = genesis.Block(); err != nil {
+		t.Fatal(err)
+	}
+	blockchain = &Blockchain{
+		database:    database,
+		genesisHash: genesisBlock.Hash(),
+		chainID:     genesis.ChainID,
+		Mempool:     NewMempool(genesis.ChainID),
+		Schedule:    &Schedule{SlotDuration: time.Millisecond, Validators: []*btcec.PublicKey{validator.PubKey()}},
+	}
+	blockchain.Mempool.Validate = blockchain.validateTransaction
+	blockchain.Mempool.NextNonce = blockchain.nextNonce
+
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	if err = blockchain.headerWrite(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = blockchain.applyGenesis(genesis, genesisBlock); err != nil {
+		t.Fatal(err)
+	}
+	return blockchain, genesisBlock
+}
+
+// newTestBlock creates a block on top of the parent signed by the validator.
+func newTestBlock(t *testing.T, validator *btcec.PrivateKey, parent *Block, timestamp uint64, transactions ...*Transaction) *Block {
+	t.Helper()
+	var list []Transaction
+	for _, transaction := range transactions {
+		list = append(list, *transaction)
+	}
+	block := NewBlock(parent.Hash(), parent.Height+1, validator.PubKey(), list)
+	block.Timestamp = timestamp
+	if err := block.Sign(validator); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// newTestTransfer returns a transfer of the amount between the accounts of the keys.
+func newTestTransfer(t *testing.T, sender, recipient *btcec.PrivateKey, nonce, amount uint64) *Transaction {
+	t.Helper()
+	transfer, err := NewTransfer(sender, testChainID, nonce, AccountID(recipient.PubKey()), amount, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transfer
+}
+
+// expectState fails if the state of the account differs.
+func expectState(t *testing.T, blockchain *Blockchain, privateKey *btcec.PrivateKey, balance, nonce uint64) {
+	t.Helper()
+	state, found := blockchain.GetAccountState(AccountID(privateKey.PubKey()))
+	if !found || state.Balance != balance || state.Nonce != nonce {
+		t.Fatalf("state %+v found %t, expected balance %d nonce %d", state, found, balance, nonce)
+	}
+}
+
+var errorTestCrash = errors.New("CRASH")
+
+// crashStore simulates a crash after the count of writes, all following writes and deletes are lost.
+type crashStore struct {
+	store.Store
+	writes int
+}
+
+func (database *crashStore) Set(key []byte, data []byte) error {
+	if database.writes == 0 {
+		return errorTestCrash
+	}
+	database.writes--
+	return database.Store.Set(key, data)
+}
+
+func (database *crashStore) Delete(key []byte) {
+	if database.writes > 0 {
+		database.Store.Delete(key)
+	}
+}
+
+func TestAppendBlock(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+
+	transfer, err := NewTransfer(sender, testChainID, 0, AccountID(recipient.PubKey()), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newTestBlock(t, validator, genesisBlock, 10, transfer)
+	if err = blockchain.AppendBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if blockchain.Height() != 2 {
+		t.Fatalf("height %d", blockchain.Height())
+	}
+	expectState(t, blockchain, sender, 990, 1)
+	expectState(t, blockchain, recipient, 10, 0)
+	if stored, status := blockchain.GetBlockByHash(block.Hash()); status != StatusOK || stored.Height != 1 {
+		t.Fatalf("status %d", status)
+	}
+
+	// the same block again and a block with a reused nonce
+	var blockErr *BlockError
+	if err = blockchain.AppendBlock(block); !errors.As(err, &blockErr) || blockErr.Status != StatusBlockHeight {
+		t.Fatalf("error %v", err)
+	}
+	if err = blockchain.AppendBlock(newTestBlock(t, validator, block, 20, transfer)); !errors.Is(err, ErrorTransactionNonce) {
+		t.Fatalf("error %v", err)
+	}
+	expectState(t, blockchain, sender, 990, 1)
+}
+
+func TestAppendBlockCrash(t *testing.T) {
+	// crash after each write of the append, until the append completes
+	for writes := 0; ; writes++ {
+		validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+		blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+		database := blockchain.database
+
+		transfer, err := NewTransfer(sender, testChainID, 0, AccountID(recipient.PubKey()), 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		createAccount, err := CreateAccount(sender, testChainID, 1, newTestKey(t).PubKey(), "carol", AccountCreateFeeMin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := newTestBlock(t, validator, genesisBlock, 10, transfer, createAccount)
+
+		blockchain.database = &crashStore{Store: database, writes: writes}
+		if err = blockchain.AppendBlock(block); err == nil {
+			if writes == 0 {
+				t.Fatal("no writes")
+			}
+			return
+		} else if !errors.Is(err, errorTestCrash) {
+			t.Fatalf("writes %d: error %v", writes, err)
+		}
+
+		// the restarted node reverts the partially applied block
+		restarted := &Blockchain{database: database, genesisHash: blockchain.genesisHash, chainID: testChainID, Mempool: NewMempool(testChainID), Schedule: blockchain.Schedule}
+		if found, err := restarted.headerRead(); !found || err != nil || restarted.height != 1 {
+			t.Fatalf("writes %d: header found %t error %v height %d", writes, found, err, restarted.height)
+		}
+		if _, err := restarted.undoPartialBlock(); err != nil {
+			t.Fatalf("writes %d: error %v", writes, err)
+		}
+		expectState(t, restarted, sender, 1000, 0)
+		expectState(t, restarted, recipient, 0, 0)
+		if _, found := restarted.GetAccountByName("carol.web3"); found {
+			t.Fatalf("writes %d: created account kept", writes)
+		}
+		if _, found := database.Get(keyBlock(1)); found {
+			t.Fatalf("writes %d: block kept", writes)
+		}
+		if _, found := database.Get(block.Hash()); found {
+			t.Fatalf("writes %d: hash index kept", writes)
+		}
+		if found, err := restarted.undoPartialBlock(); found || err != nil {
+			t.Fatalf("writes %d: found %t error %v", writes, found, err)
+		}
+
+		// the block can be appended again
+		if err = restarted.AppendBlock(block); err != nil {
+			t.Fatalf("writes %d: error %v", writes, err)
+		}
+		expectState(t, restarted, sender, 990-AccountCreateFeeMin, 2)
+		expectState(t, restarted, recipient, 10, 0)
+		if _, found := restarted.GetAccountByName("carol.web3"); !found {
+			t.Fatalf("writes %d: account not created", writes)
+		}
+		if height, err := restarted.VerifyIntegrity(); err != nil || height != 2 {
+			t.Fatalf("writes %d: height %d error %v", writes, height, err)
+		}
+	}
+}
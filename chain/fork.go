@@ -0,0 +1,224 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ReorgDepthMax is the maximum count of blocks that are rolled back by a reorganization. Side blocks that fork off
+// deeper are rejected.
+const ReorgDepthMax = 128
+
+var ErrorBlockUnknownParent = errors.New("PARENT BLOCK UNKNOWN")
+var ErrorReorgDepth = errors.New("FORK EXCEEDS MAXIMUM REORGANIZATION DEPTH")
+
+// Blocks that are not part of the main chain are stored under the prefix followed by the block hash.
+const keySidePrefix = "side/"
+
+func keySide(blockHash []byte) []byte {
+	return append([]byte(keySidePrefix), blockHash...)
+}
+
+// getSideBlock reads a block that is not part of the main chain. The blockchain must be locked.
+func (blockchain *Blockchain) getSideBlock(blockHash []byte) (block *Block, found bool) {
+	data, found := blockchain.database.Get(keySide(blockHash))
+	if !found {
+		return nil, false
+	}
+	block, err := DecodeBlock(data)
+	if err != nil {
+		return nil, false
+	}
+	return block, true
+}
+
+// mainBlockHeight returns the height of the block if it is part of the main chain. The blockchain must be locked.
+func (blockchain *Blockchain) mainBlockHeight(blockHash []byte) (height uint64, found bool) {
+	key, found := blockchain.database.Get(blockHash)
+	if !found || len(key) != 8 || binary.BigEndian.Uint64(key) >= blockchain.height {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(key), true
+}
+
+// AddBlock adds a block received from the network. A block on top of the main chain is appended. Other blocks are stored
+// as side blocks if their parent is known; if the branch they complete is longer than the main chain, or has the same
+// length and a lower tip hash, the blockchain is reorganized to it. Blocks that are already known are ignored.
+// Transactions of blocks that are no longer part of the main chain are returned to the mempool.
+func (blockchain *Blockchain) AddBlock(block *Block) (err error) {
+	orphaned, err := blockchain.addBlock(block)
+
+	// the mempool validates the transactions against the blockchain, which must be unlocked
+	for _, transaction := range orphaned {
+		blockchain.Mempool.Add(transaction)
+	}
+	return err
+}
+
+func (blockchain *Blockchain) addBlock(block *Block) (orphaned []*Transaction, err error) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	blockHash := block.Hash()
+	if _, found := blockchain.mainBlockHeight(blockHash); found {
+		return nil, nil
+	}
+	if _, found := blockchain.getSideBlock(blockHash); found {
+		return nil, nil
+	}
+
+	var tip *Block
+	if blockchain.height > 0 {
+		var status int
+		if tip, status = blockchain.getBlock(blockchain.height - 1); status != StatusOK {
+			return nil, ErrorBlockchainCorrupt
+		}
+	}
+	if block.Height == blockchain.height && (tip == nil || bytes.Equal(block.PreviousHash, tip.Hash())) {
+		return nil, blockchain.appendBlock(block)
+	}
+
+	// the parent is either part of the main chain or a side block, the first block has none
+	var parent *Block
+	if !bytes.Equal(block.PreviousHash, make([]byte, hashSize)) {
+		if parentHeight, found := blockchain.mainBlockHeight(block.PreviousHash); found {
+			var status int
+			if parent, status = blockchain.getBlock(parentHeight); status != StatusOK {
+				return nil, ErrorBlockchainCorrupt
+			}
+		} else if parent, found = blockchain.getSideBlock(block.PreviousHash); !found {
+			return nil, ErrorBlockUnknownParent
+		}
+	}
+	if block.Height+ReorgDepthMax < blockchain.height {
+		return nil, ErrorReorgDepth
+	}
+	if err = blockchain.validateBlock(block, parent); err != nil {
+		return nil, err
+	}
+	if err = blockchain.database.Set(keySide(blockHash), block.Encode()); err != nil {
+		return nil, err
+	}
+
+	// fork choice: the longest chain wins, at equal length the lower tip hash
+	if block.Height+1 > blockchain.height || block.Height+1 == blockchain.height && bytes.Compare(blockHash, tip.Hash()) < 0 {
+		return blockchain.reorganize(block)
+	}
+	return nil, nil
+}
+
+// reorganize switches the main chain to the branch ending with the side block. The main chain is rolled back to the
+// common ancestor and the branch is appended. If a block of the branch is invalid, it is deleted and the previous main
+// chain is restored. The blockchain must be locked.
+func (blockchain *Blockchain) reorganize(tip *Block) (orphaned []*Transaction, err error) {
+	branch := []*Block{tip}
+	for first := tip; first.Height > 0; first = branch[0] {
+		if _, found := blockchain.mainBlockHeight(first.PreviousHash); found {
+			break
+		}
+		parent, found := blockchain.getSideBlock(first.PreviousHash)
+		if !found {
+			return nil, ErrorBlockUnknownParent
+		}
+		branch = append([]*Block{parent}, branch...)
+	}
+	if branch[0].Height+ReorgDepthMax < blockchain.height {
+		return nil, ErrorReorgDepth
+	}
+
+	// the callback is invoked once for the whole reorganization
+	oldHeight, oldVersion := blockchain.height, blockchain.version
+	blockchain.reorganizing = true
+	defer blockchain.reorganized(oldHeight, oldVersion)
+
+	var rolledBack []*Block // newest first
+	for blockchain.height > branch[0].Height {
+		block, err := blockchain.rollbackBlock()
+		if err != nil {
+			return nil, err
+		}
+		rolledBack = append(rolledBack, block)
+	}
+
+	for n, block := range branch {
+		if err = blockchain.appendBlock(block); err == nil {
+			continue
+		}
+
+		// restore the previous main chain, the invalid block and its descendants are dropped
+		for _, invalid := range branch[n:] {
+			blockchain.database.Delete(keySide(invalid.Hash()))
+		}
+		for m := n - 1; m >= 0; m-- {
+			if _, errRollback := blockchain.rollbackBlock(); errRollback != nil {
+				return nil, errRollback
+			}
+		}
+		for m := len(rolledBack) - 1; m >= 0; m-- {
+			if errRestore := blockchain.appendBlock(rolledBack[m]); errRestore != nil {
+				return nil, errRestore
+			}
+		}
+		return nil, err
+	}
+
+	if len(rolledBack) > 0 {
+		if err = blockchain.increaseVersion(VersionChangeReorg, oldHeight, branch[0].Height); err != nil {
+			return nil, err
+		}
+	}
+	return orphanedTransactions(rolledBack, branch), nil
+}
+
+// reorganized ends a reorganization and invokes the callback if the header changed.
+func (blockchain *Blockchain) reorganized(oldHeight, oldVersion uint64) {
+	blockchain.reorganizing = false
+	if blockchain.BlockchainUpdate != nil && (blockchain.height != oldHeight || blockchain.version != oldVersion) {
+		blockchain.BlockchainUpdate(blockchain, oldHeight, oldVersion, blockchain.height, blockchain.version)
+	}
+}
+
+// orphanedTransactions returns the transactions of the rolled back blocks (newest first) that are not part of the new
+// branch. They are returned in chain order, so that the nonces of a sender are contiguous when added to the mempool.
+func orphanedTransactions(rolledBack, branch []*Block) (orphaned []*Transaction) {
+	included := make(map[string]bool)
+	for _, block := range branch {
+		for n := range block.Transactions {
+			included[string(block.Transactions[n].Hash())] = true
+		}
+	}
+	for m := len(rolledBack) - 1; m >= 0; m-- {
+		for n := range rolledBack[m].Transactions {
+			if transaction := &rolledBack[m].Transactions[n]; !included[string(transaction.Hash())] {
+				orphaned = append(orphaned, transaction)
+			}
+		}
+	}
+	return orphaned
+}
+
+// rollbackBlock removes the top block from the main chain, restores the state before it and keeps it as side block.
+// The header is written first, so that an interrupted rollback is completed by undoPartialBlock. The blockchain must be
+// locked.
+func (blockchain *Blockchain) rollbackBlock() (block *Block, err error) {
+	if blockchain.height == 0 {
+		return nil, ErrorBlockHeight
+	}
+	height := blockchain.height - 1
+	block, status := blockchain.getBlock(height)
+	if status != StatusOK {
+		return nil, ErrorBlockchainCorrupt
+	}
+	if blockchain.getUndo(height) == nil {
+		return nil, ErrorBlockchainCorrupt
+	}
+
+	if err = blockchain.database.Set(keySide(block.Hash()), block.Encode()); err != nil {
+		return nil, err
+	}
+	if err = blockchain.headerWrite(height, blockchain.version); err != nil {
+		return nil, err
+	}
+	return block, blockchain.revertBlock(height)
+}
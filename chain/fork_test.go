@@ -0,0 +1,211 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// addTestBlocks adds the blocks, which must succeed.
+func addTestBlocks(t *testing.T, blockchain *Blockchain, blocks ...*Block) {
+	t.Helper()
+	for _, block := range blocks {
+		if err := blockchain.AddBlock(block); err != nil {
+			t.Fatalf("block %d: %v", block.Height, err)
+		}
+	}
+}
+
+// expectMainChain fails if the blocks are not the main chain from height 1 on.
+func expectMainChain(t *testing.T, blockchain *Blockchain, blocks ...*Block) {
+	t.Helper()
+	if height := blockchain.Height(); height != uint64(len(blocks))+1 {
+		t.Fatalf("height %d, expected %d", height, len(blocks)+1)
+	}
+	for _, expected := range blocks {
+		block, status := blockchain.GetBlock(expected.Height)
+		if status != StatusOK || !bytes.Equal(block.Hash(), expected.Hash()) {
+			t.Fatalf("block %d status %d is not the expected one", expected.Height, status)
+		}
+		if block, status = blockchain.GetBlockByHash(expected.Hash()); status != StatusOK || block.Height != expected.Height {
+			t.Fatalf("block %d by hash status %d", expected.Height, status)
+		}
+	}
+}
+
+func TestReorganizeLongerBranch(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+	var updates int
+	blockchain.BlockchainUpdate = func(blockchain *Blockchain, oldHeight, oldVersion, newHeight, newVersion uint64) { updates++ }
+
+	transfer0 := newTestTransfer(t, sender, recipient, 0, 100)
+	transfer1 := newTestTransfer(t, sender, recipient, 1, 50)
+	main1 := newTestBlock(t, validator, genesisBlock, 10, transfer0)
+	main2 := newTestBlock(t, validator, main1, 20, transfer1)
+	main3 := newTestBlock(t, validator, main2, 30)
+	addTestBlocks(t, blockchain, main1, main2, main3)
+	expectState(t, blockchain, sender, 850, 2)
+
+	// the branch spends nonce 0 differently, nonce 1 is left for the orphaned transfer
+	branchTransfer := newTestTransfer(t, sender, recipient, 0, 300)
+	branch1 := newTestBlock(t, validator, genesisBlock, 11, branchTransfer)
+	branch2 := newTestBlock(t, validator, branch1, 21)
+	branch3 := newTestBlock(t, validator, branch2, 31)
+	branch4 := newTestBlock(t, validator, branch3, 41)
+
+	// an unknown parent is rejected, a shorter branch is stored without reorganization
+	if err := blockchain.AddBlock(branch2); !errors.Is(err, ErrorBlockUnknownParent) {
+		t.Fatalf("error %v", err)
+	}
+	updates = 0
+	addTestBlocks(t, blockchain, branch1, branch2)
+	expectMainChain(t, blockchain, main1, main2, main3)
+	if updates != 0 {
+		t.Fatalf("updates %d", updates)
+	}
+
+	// the equal length branch may win by its tip hash, the longer one wins
+	addTestBlocks(t, blockchain, branch3, branch4)
+	expectMainChain(t, blockchain, branch1, branch2, branch3, branch4)
+	expectState(t, blockchain, sender, 700, 1)
+	expectState(t, blockchain, recipient, 300, 0)
+	if blockchain.Version() != 1 {
+		t.Fatalf("version %d", blockchain.Version())
+	}
+	if changes := blockchain.VersionChanges(); len(changes) != 1 || changes[0].Reason != VersionChangeReorg || changes[0].ForkHeight != 1 {
+		t.Fatalf("version changes %+v", changes)
+	}
+	for _, block := range []*Block{main1, main2, main3} {
+		if _, status := blockchain.GetBlockByHash(block.Hash()); status != StatusBlockNotFound {
+			t.Fatalf("rolled back block %d status %d", block.Height, status)
+		}
+	}
+
+	// the orphaned transfer with nonce 1 is valid again, the one with nonce 0 is not
+	if _, found := blockchain.Mempool.Get(transfer1.ID); !found {
+		t.Fatal("orphaned transfer not in the mempool")
+	}
+	if _, found := blockchain.Mempool.Get(transfer0.ID); found {
+		t.Fatal("invalid orphaned transfer in the mempool")
+	}
+
+	// the old branch becomes longer again
+	main4 := newTestBlock(t, validator, main3, 40)
+	main5 := newTestBlock(t, validator, main4, 50)
+	addTestBlocks(t, blockchain, main1, main2, main3, main4, main5)
+	expectMainChain(t, blockchain, main1, main2, main3, main4, main5)
+	expectState(t, blockchain, sender, 850, 2)
+	expectState(t, blockchain, recipient, 150, 0)
+	if blockchain.Version() != 2 {
+		t.Fatalf("version %d", blockchain.Version())
+	}
+	if height, err := blockchain.VerifyIntegrity(); err != nil || height != 6 {
+		t.Fatalf("height %d error %v", height, err)
+	}
+}
+
+func TestReorganizeTieBreak(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	accounts := []GenesisAccount{testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0)}
+	blockchain, genesisBlock := newTestBlockchain(t, validator, accounts...)
+
+	first := newTestBlock(t, validator, genesisBlock, 10, newTestTransfer(t, sender, recipient, 0, 100))
+	second := newTestBlock(t, validator, genesisBlock, 11, newTestTransfer(t, sender, recipient, 0, 200))
+	winner, balance := first, uint64(900)
+	if bytes.Compare(second.Hash(), first.Hash()) < 0 {
+		winner, balance = second, 800
+	}
+
+	// the lower tip hash wins regardless of the order the blocks arrive
+	for _, order := range [][]*Block{{first, second}, {second, first}} {
+		blockchain, genesisBlock = newTestBlockchain(t, validator, accounts...)
+		addTestBlocks(t, blockchain, order...)
+		expectMainChain(t, blockchain, winner)
+		expectState(t, blockchain, sender, balance, 1)
+		if version := blockchain.Version(); order[0] == winner && version != 0 || order[0] != winner && version != 1 {
+			t.Fatalf("version %d", version)
+		}
+	}
+}
+
+func TestReorganizeInvalidBranch(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+
+	main1 := newTestBlock(t, validator, genesisBlock, 10, newTestTransfer(t, sender, recipient, 0, 100))
+	main2 := newTestBlock(t, validator, main1, 20)
+	main3 := newTestBlock(t, validator, main2, 30)
+	addTestBlocks(t, blockchain, main1, main2, main3)
+
+	var updates int
+	blockchain.BlockchainUpdate = func(blockchain *Blockchain, oldHeight, oldVersion, newHeight, newVersion uint64) { updates++ }
+
+	// the overdraft passes the validation of the block, it fails when the branch is applied
+	branch1 := newTestBlock(t, validator, genesisBlock, 11, newTestTransfer(t, sender, recipient, 0, 10))
+	branch2 := newTestBlock(t, validator, branch1, 21, newTestTransfer(t, sender, recipient, 1, 5000))
+	branch3 := newTestBlock(t, validator, branch2, 31)
+	branch4 := newTestBlock(t, validator, branch3, 41)
+	addTestBlocks(t, blockchain, branch1, branch2)
+
+	// the branch is applied at the tie of branch3 or when branch4 makes it longer
+	err := blockchain.AddBlock(branch3)
+	if err == nil {
+		err = blockchain.AddBlock(branch4)
+	} else if errAfter := blockchain.AddBlock(branch4); !errors.Is(errAfter, ErrorBlockUnknownParent) {
+		t.Fatalf("descendant of the invalid block: error %v", errAfter)
+	}
+	var blockErr *BlockError
+	if !errors.Is(err, ErrorInsufficientBalance) || !errors.As(err, &blockErr) || blockErr.Status != StatusBlockTransaction || blockErr.Height != 2 {
+		t.Fatalf("error %v", err)
+	}
+
+	// the previous main chain is restored, the invalid block and its descendants are dropped
+	expectMainChain(t, blockchain, main1, main2, main3)
+	expectState(t, blockchain, sender, 900, 1)
+	expectState(t, blockchain, recipient, 100, 0)
+	if blockchain.Version() != 0 || updates != 0 {
+		t.Fatalf("version %d updates %d", blockchain.Version(), updates)
+	}
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	for _, block := range []*Block{branch2, branch3, branch4} {
+		if _, found := blockchain.getSideBlock(block.Hash()); found {
+			t.Fatalf("invalid side block %d kept", block.Height)
+		}
+	}
+	if _, found := blockchain.getSideBlock(branch1.Hash()); !found {
+		t.Fatal("valid side block dropped")
+	}
+}
+
+func TestReorganizeDepth(t *testing.T) {
+	validator := newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator)
+
+	blocks := []*Block{genesisBlock}
+	for height := uint64(1); height <= ReorgDepthMax+2; height++ {
+		block := newTestBlock(t, validator, blocks[height-1], height*10)
+		addTestBlocks(t, blockchain, block)
+		blocks = append(blocks, block)
+	}
+
+	// a fork below the maximum depth is rejected, one at the maximum depth is stored
+	height := blockchain.Height()
+	deep := newTestBlock(t, validator, blocks[height-ReorgDepthMax-2], (height-ReorgDepthMax-1)*10+1)
+	if err := blockchain.AddBlock(deep); !errors.Is(err, ErrorReorgDepth) {
+		t.Fatalf("error %v", err)
+	}
+	allowed := newTestBlock(t, validator, blocks[height-ReorgDepthMax-1], (height-ReorgDepthMax)*10+1)
+	addTestBlocks(t, blockchain, allowed)
+	expectMainChain(t, blockchain, blocks[1:]...)
+
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	if _, found := blockchain.getSideBlock(deep.Hash()); found {
+		t.Fatal("deep side block stored")
+	}
+	if _, found := blockchain.getSideBlock(allowed.Hash()); !found {
+		t.Fatal("side block not stored")
+	}
+}
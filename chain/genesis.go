@@ -0,0 +1,147 @@
+package chain
+
+import (
+	"blockchain/hash"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"time"
+)
+
+// Genesis specification encoding. All integers are big endian. The hash of the encoding is the Merkle root of the
+// genesis block, which therefore commits to the whole specification.
+//
+// Offset  Length  Content
+// 0       4       Chain ID
+// 4       8       Timestamp, unix time in milliseconds
+// 12      2       Count of validators
+// 14      ?       Validators, compressed public keys (33 each)
+// ?       4       Count of accounts
+// ?       ?       Per account: compressed public key (33), length of the alias (1), alias, balance (8)
+//
+// The genesis block has height 0, a zero previous hash, the timestamp of the specification and no producer and
+// signature. It is never received from the network, every node creates it from the specification.
+
+var ErrorGenesisMalformed = errors.New("MALFORMED GENESIS SPECIFICATION")
+var ErrorGenesisMismatch = errors.New("BLOCK DOES NOT MATCH THE GENESIS BLOCK")
+var ErrorChainID = errors.New("CHAIN ID MUST NOT BE 0")
+
+// GenesisAccount is an account that exists from the start.
+type GenesisAccount struct {
+	PublicKey string `yaml:"PublicKey"` // Hex encoded compressed public key
+	Alias     string `yaml:"Alias"`     // Optional alias
+	Balance   uint64 `yaml:"Balance"`
+}
+
+// Genesis is the specification of the first block and the initial state of the network.
+type Genesis struct {
+	ChainID    uint32           `yaml:"ChainID"`    // Identifies the network
+	Timestamp  uint64           `yaml:"Timestamp"`  // Timestamp of the genesis block, unix time in milliseconds
+	Validators []string         `yaml:"Validators"` // Initial validator set in leader order, hex encoded compressed public keys
+	Accounts   []GenesisAccount `yaml:"Accounts"`   // Initial accounts and balances
+}
+
+// Encode checks the specification and returns its canonical encoding. The chain ID must not be 0, there must be at
+// least one validator, public keys and aliases must be valid and unique, and the balances must not overflow.
+func (genesis *Genesis) Encode() (data []byte, err error) {
+	if genesis.ChainID == 0 {
+		return nil, ErrorChainID
+	}
+	if len(genesis.Validators) == 0 || len(genesis.Validators) > 0xFFFF {
+		return nil, ErrorGenesisMalformed
+	}
+	data = make([]byte, 14)
+	binary.BigEndian.PutUint32(data[0:4], genesis.ChainID)
+	binary.BigEndian.PutUint64(data[4:12], genesis.Timestamp)
+	binary.BigEndian.PutUint16(data[12:14], uint16(len(genesis.Validators)))
+	for _, validator := range genesis.Validators {
+		publicKey, err := parseGenesisKey(validator)
+		if err != nil {
+			return nil, ErrorValidatorKey
+		}
+		data = append(data, publicKey.SerializeCompressed()...)
+	}
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(genesis.Accounts)))
+	data = append(data, count[:]...)
+	accounts := make(map[string]bool)
+	aliases := make(map[string]bool)
+	var total uint64
+	for _, account := range genesis.Accounts {
+		publicKey, err := parseGenesisKey(account.PublicKey)
+		if err != nil || accounts[string(publicKey.SerializeCompressed())] {
+			return nil, ErrorGenesisMalformed
+		}
+		accounts[string(publicKey.SerializeCompressed())] = true
+		if account.Alias != "" && (!ValidAlias(account.Alias) || aliases[account.Alias]) {
+			return nil, ErrorAccountAlias
+		}
+		aliases[account.Alias] = true
+		if total+account.Balance < total {
+			return nil, ErrorBalanceOverflow
+		}
+		total += account.Balance
+
+		var balance [8]byte
+		binary.BigEndian.PutUint64(balance[:], account.Balance)
+		data = append(data, publicKey.SerializeCompressed()...)
+		data = append(append(data, byte(len(account.Alias))), account.Alias...)
+		data = append(data, balance[:]...)
+	}
+	return data, nil
+}
+
+func parseGenesisKey(publicKey string) (*btcec.PublicKey, error) {
+	data, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.ParsePubKey(data)
+}
+
+// Block returns the genesis block.
+func (genesis *Genesis) Block() (block *Block, err error) {
+	data, err := genesis.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return &Block{
+		PreviousHash: make([]byte, hashSize),
+		Height:       0,
+		Timestamp:    genesis.Timestamp,
+		MerkleRoot:   hash.HashData(data),
+	}, nil
+}
+
+// applyGenesis stores the genesis block and the initial accounts. The blockchain must be empty.
+func (blockchain *Blockchain) applyGenesis(genesis *Genesis, block *Block) (err error) {
+	for _, genesisAccount := range genesis.Accounts {
+		publicKey, err := parseGenesisKey(genesisAccount.PublicKey)
+		if err != nil {
+			return ErrorGenesisMalformed
+		}
+		account := &Account{
+			ID:        AccountID(publicKey),
+			PublicKey: publicKey,
+			Alias:     genesisAccount.Alias,
+			Height:    0,
+			CreatedAt: time.UnixMilli(int64(genesis.Timestamp)),
+		}
+		if err = blockchain.storeAccount(account); err != nil {
+			return err
+		}
+		if err = blockchain.setState(account.ID, &AccountState{Balance: genesisAccount.Balance}); err != nil {
+			return err
+		}
+	}
+
+	if err = blockchain.database.Set(keyBlock(0), block.Encode()); err != nil {
+		return err
+	}
+	if err = blockchain.database.Set(block.Hash(), keyBlock(0)); err != nil {
+		return err
+	}
+	return blockchain.headerWrite(1, blockchain.version)
+}
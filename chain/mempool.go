@@ -0,0 +1,250 @@
+package chain
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MempoolCountMax    = 10000            // Maximum count of pending transactions
+	MempoolSenderMax   = 64               // Maximum count of pending transactions per sender
+	MempoolAgeMax      = time.Hour        // Pending transactions older than this are evicted
+	TransactionSizeMax = 1024             // Maximum size of an encoded transaction in bytes, it fits into a network packet
+	mempoolClockSkew   = 10 * time.Second // Tolerance for timestamps in the future
+)
+
+var ErrorTransactionSize = errors.New("TRANSACTION SIZE EXCEEDS MAXIMUM")
+var ErrorTransactionDuplicate = errors.New("DUPLICATE TRANSACTION")
+var ErrorTransactionNonce = errors.New("INVALID TRANSACTION NONCE")
+var ErrorTransactionExpired = errors.New("TRANSACTION EXPIRED")
+var ErrorMempoolFull = errors.New("MEMPOOL FULL")
+
+// mempoolEntry is a pending transaction.
+type mempoolEntry struct {
+	transaction *Transaction
+	sender      string // compressed public key of the sender
+	added       time.Time
+}
+
+// Mempool holds the signed transactions that are not yet included in a block. The transactions of a sender have
+// consecutive nonces. It is safe for concurrent use.
+type Mempool struct {
+	transactions map[string]*mempoolEntry   // by transaction ID
+	senders      map[string][]*mempoolEntry // by sender, ordered by nonce
+	mutex        sync.Mutex
+	chainID      uint32 // Network of the transactions, the signatures are verified for it
+
+	// NextNonce returns the nonce of the next transaction of the sender that can be included in a block. If nil, the
+	// first pending transaction of a sender may have any nonce.
+	NextNonce func(sender *btcec.PublicKey) (nonce uint64, known bool)
+
+	// Validate checks the verified transaction against the state of the blockchain. If nil, only the signature is checked.
+	Validate func(transaction *Transaction) error
+
+	// callback, invoked after a transaction was added while the mempool is not locked
+	TransactionAdded func(transaction *Transaction)
+}
+
+// NewMempool creates an empty mempool for the transactions of the chain ID.
+func NewMempool(chainID uint32) *Mempool {
+	return &Mempool{transactions: make(map[string]*mempoolEntry), senders: make(map[string][]*mempoolEntry), chainID: chainID}
+}
+
+// Add verifies the transaction and adds it. A pending transaction of the sender with the same nonce is replaced if the
+// new one has a higher fee. If the mempool is full, the transaction with the lowest fee is evicted if the new one has a
+// higher fee.
+func (mempool *Mempool) Add(transaction *Transaction) (err error) {
+	if err = mempool.add(transaction); err != nil {
+		return err
+	}
+	if mempool.TransactionAdded != nil {
+		mempool.TransactionAdded(transaction)
+	}
+	return nil
+}
+
+func (mempool *Mempool) add(transaction *Transaction) (err error) {
+	encoded := transaction.Encode()
+	if len(encoded) > TransactionSizeMax {
+		return ErrorTransactionSize
+	}
+	if err = transaction.Verify(mempool.chainID); err != nil {
+		return err
+	}
+	if time.UnixMilli(int64(transaction.Timestamp)).Add(MempoolAgeMax).Before(time.Now()) || time.UnixMilli(int64(transaction.Timestamp)).After(time.Now().Add(mempoolClockSkew)) {
+		return ErrorTransactionExpired
+	}
+	transaction.ID = transaction.Hash()
+
+	// the callbacks are invoked before locking, they may lock the blockchain
+	if mempool.Validate != nil {
+		if err = mempool.Validate(transaction); err != nil {
+			return err
+		}
+	}
+	var nextNonce uint64
+	var nonceKnown bool
+	if mempool.NextNonce != nil {
+		nextNonce, nonceKnown = mempool.NextNonce(transaction.Sender)
+		if transaction.Nonce < nextNonce {
+			return ErrorTransactionNonce
+		}
+	}
+
+	mempool.mutex.Lock()
+	defer mempool.mutex.Unlock()
+
+	if mempool.transactions[string(transaction.ID)] != nil {
+		return ErrorTransactionDuplicate
+	}
+
+	entry := &mempoolEntry{transaction: transaction, sender: string(transaction.Sender.SerializeCompressed()), added: time.Now()}
+	pending := mempool.senders[entry.sender]
+
+	// replacement of a pending transaction
+	for n, existing := range pending {
+		if existing.transaction.Nonce == transaction.Nonce {
+			if transaction.Fee <= existing.transaction.Fee {
+				return ErrorTransactionNonce
+			}
+			delete(mempool.transactions, string(existing.transaction.ID))
+			pending[n] = entry
+			mempool.transactions[string(transaction.ID)] = entry
+			return nil
+		}
+	}
+
+	// the nonce must follow the last pending one, or be the next one of the account
+	if len(pending) > 0 && transaction.Nonce != pending[len(pending)-1].transaction.Nonce+1 ||
+		len(pending) == 0 && nonceKnown && transaction.Nonce != nextNonce {
+		return ErrorTransactionNonce
+	}
+	if len(pending) >= MempoolSenderMax {
+		return ErrorMempoolFull
+	}
+	if len(mempool.transactions) >= MempoolCountMax && !mempool.evict(transaction.Fee) {
+		return ErrorMempoolFull
+	}
+
+	mempool.senders[entry.sender] = append(mempool.senders[entry.sender], entry)
+	mempool.transactions[string(transaction.ID)] = entry
+	return nil
+}
+
+// evict removes the last pending transaction of a sender with the lowest fee, if it is lower than the fee. Only the
+// last transaction of a sender can be removed, otherwise the nonces would have a gap. The mutex must be locked.
+func (mempool *Mempool) evict(fee uint64) bool {
+	var lowest *mempoolEntry
+	for _, pending := range mempool.senders {
+		last := pending[len(pending)-1]
+		if lowest == nil || last.transaction.Fee < lowest.transaction.Fee {
+			lowest = last
+		}
+	}
+	if lowest == nil || lowest.transaction.Fee >= fee {
+		return false
+	}
+	mempool.removeFrom(lowest.sender, len(mempool.senders[lowest.sender])-1)
+	return true
+}
+
+// removeFrom removes the pending transactions of the sender starting at the index. The mutex must be locked.
+func (mempool *Mempool) removeFrom(sender string, index int) {
+	pending := mempool.senders[sender]
+	for _, entry := range pending[index:] {
+		delete(mempool.transactions, string(entry.transaction.ID))
+	}
+	if index == 0 {
+		delete(mempool.senders, sender)
+	} else {
+		mempool.senders[sender] = pending[:index]
+	}
+}
+
+// Get returns the pending transaction with the ID.
+func (mempool *Mempool) Get(id []byte) (transaction *Transaction, found bool) {
+	mempool.mutex.Lock()
+	defer mempool.mutex.Unlock()
+	if entry := mempool.transactions[string(id)]; entry != nil {
+		return entry.transaction, true
+	}
+	return nil, false
+}
+
+// Count returns the count of pending transactions.
+func (mempool *Mempool) Count() int {
+	mempool.mutex.Lock()
+	defer mempool.mutex.Unlock()
+	return len(mempool.transactions)
+}
+
+// Pending returns up to count transactions with the highest fees. The transactions of a sender are returned in nonce
+// order, a transaction is only returned after all previous ones of its sender.
+func (mempool *Mempool) Pending(count int) (transactions []*Transaction) {
+	mempool.mutex.Lock()
+	defer mempool.mutex.Unlock()
+
+	// the heads of all senders compete, the winner's next transaction becomes the new head
+	heads := make(map[string]int)
+	for len(transactions) < count {
+		var best *mempoolEntry
+		for sender, pending := range mempool.senders {
+			if index := heads[sender]; index < len(pending) {
+				if head := pending[index]; best == nil || head.transaction.Fee > best.transaction.Fee ||
+					head.transaction.Fee == best.transaction.Fee && head.added.Before(best.added) {
+					best = head
+				}
+			}
+		}
+		if best == nil {
+			break
+		}
+		heads[best.sender]++
+		transactions = append(transactions, best.transaction)
+	}
+	return transactions
+}
+
+// Expire removes the transactions older than MempoolAgeMax, and the following transactions of their senders.
+func (mempool *Mempool) Expire() {
+	mempool.mutex.Lock()
+	defer mempool.mutex.Unlock()
+
+	for sender, pending := range mempool.senders {
+		for n, entry := range pending {
+			if time.Since(entry.added) > MempoolAgeMax || time.Since(time.UnixMilli(int64(entry.transaction.Timestamp))) > MempoolAgeMax {
+				mempool.removeFrom(sender, n)
+				break
+			}
+		}
+	}
+}
+
+// removeBlock removes the transactions included in the block, and pending transactions whose nonce was used by them.
+func (mempool *Mempool) removeBlock(block *Block) {
+	mempool.mutex.Lock()
+	defer mempool.mutex.Unlock()
+
+	for n := range block.Transactions {
+		transaction := &block.Transactions[n]
+		if transaction.Sender == nil && transaction.Verify(mempool.chainID) != nil {
+			continue
+		}
+		sender := string(transaction.Sender.SerializeCompressed())
+		pending := mempool.senders[sender]
+
+		// pending transactions are ordered by nonce, all up to the included one are obsolete
+		used := sort.Search(len(pending), func(i int) bool { return pending[i].transaction.Nonce > transaction.Nonce })
+		for _, entry := range pending[:used] {
+			delete(mempool.transactions, string(entry.transaction.ID))
+		}
+		if used == len(pending) {
+			delete(mempool.senders, sender)
+		} else if used > 0 {
+			mempool.senders[sender] = pending[used:]
+		}
+	}
+}
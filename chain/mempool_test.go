@@ -0,0 +1,240 @@
+package chain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// newTestFeeTransfer returns a transfer of the sender with the fee to a new account.
+func newTestFeeTransfer(t *testing.T, sender *btcec.PrivateKey, nonce, fee uint64) *Transaction {
+	t.Helper()
+	transfer, err := NewTransfer(sender, testChainID, nonce, AccountID(newTestKey(t).PubKey()), 1, fee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transfer
+}
+
+// newTestTimedTransfer returns a transfer of the sender with the timestamp.
+func newTestTimedTransfer(t *testing.T, sender *btcec.PrivateKey, timestamp time.Time) *Transaction {
+	t.Helper()
+	transfer := &Transaction{Type: TransactionTypeTransfer, Timestamp: uint64(timestamp.UnixMilli())}
+	if err := transfer.Sign(sender, testChainID); err != nil {
+		t.Fatal(err)
+	}
+	return transfer
+}
+
+// expectPending fails if the pending transactions differ.
+func expectPending(t *testing.T, mempool *Mempool, count int, expected ...*Transaction) {
+	t.Helper()
+	pending := mempool.Pending(count)
+	if len(pending) != len(expected) {
+		t.Fatalf("%d pending transactions, expected %d", len(pending), len(expected))
+	}
+	for n := range pending {
+		if pending[n] != expected[n] {
+			t.Fatalf("pending transaction %d: nonce %d fee %d, expected nonce %d fee %d", n, pending[n].Nonce, pending[n].Fee,
+				expected[n].Nonce, expected[n].Fee)
+		}
+	}
+}
+
+func TestMempoolAdd(t *testing.T) {
+	first, second := newTestKey(t), newTestKey(t)
+	mempool := NewMempool(testChainID)
+	// the next nonce of the second sender is known
+	mempool.NextNonce = func(sender *btcec.PublicKey) (uint64, bool) {
+		if sender.IsEqual(second.PubKey()) {
+			return 5, true
+		}
+		return 0, false
+	}
+
+	pending := newTestFeeTransfer(t, first, 7, 10)
+	replaced := newTestFeeTransfer(t, first, 8, 10)
+	replacement := newTestFeeTransfer(t, first, 8, 11)
+	accountNonce := newTestFeeTransfer(t, second, 5, 10)
+	for _, test := range []struct {
+		name        string
+		transaction *Transaction
+		expected    error
+	}{
+		{"any first nonce", pending, nil},
+		{"duplicate", pending, ErrorTransactionDuplicate},
+		{"nonce gap", newTestFeeTransfer(t, first, 9, 10), ErrorTransactionNonce},
+		{"next nonce", replaced, nil},
+		{"replacement with the same fee", newTestFeeTransfer(t, first, 8, 10), ErrorTransactionNonce},
+		{"replacement with a lower fee", newTestFeeTransfer(t, first, 8, 9), ErrorTransactionNonce},
+		{"replacement with a higher fee", replacement, nil},
+		{"below the account nonce", newTestFeeTransfer(t, second, 4, 10), ErrorTransactionNonce},
+		{"after the account nonce", newTestFeeTransfer(t, second, 6, 10), ErrorTransactionNonce},
+		{"account nonce", accountNonce, nil},
+		{"expired", newTestTimedTransfer(t, first, time.Now().Add(-MempoolAgeMax-time.Minute)), ErrorTransactionExpired},
+		{"future", newTestTimedTransfer(t, first, time.Now().Add(time.Minute)), ErrorTransactionExpired},
+		{"unsigned", &Transaction{Type: TransactionTypeTransfer, Timestamp: uint64(time.Now().UnixMilli())}, ErrorTransactionSignature},
+		{"size", &Transaction{Type: TransactionTypeTransfer, Payload: make([]byte, TransactionSizeMax)}, ErrorTransactionSize},
+	} {
+		if err := mempool.Add(test.transaction); err != test.expected {
+			t.Fatalf("%s: error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	if _, found := mempool.Get(replaced.ID); found || mempool.Count() != 3 {
+		t.Fatalf("replaced transaction found %t, count %d", found, mempool.Count())
+	}
+	// with the same fee the earlier transaction is first
+	expectPending(t, mempool, 10, pending, replacement, accountNonce)
+}
+
+func TestMempoolSenderMax(t *testing.T) {
+	sender := newTestKey(t)
+	mempool := NewMempool(testChainID)
+	for nonce := uint64(0); nonce < MempoolSenderMax; nonce++ {
+		if err := mempool.Add(newTestFeeTransfer(t, sender, nonce, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mempool.Add(newTestFeeTransfer(t, sender, MempoolSenderMax, 1)); err != ErrorMempoolFull {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestMempoolPending(t *testing.T) {
+	first, second, third := newTestKey(t), newTestKey(t), newTestKey(t)
+	mempool := NewMempool(testChainID)
+	transactions := []*Transaction{
+		newTestFeeTransfer(t, first, 0, 1),
+		newTestFeeTransfer(t, first, 1, 30),
+		newTestFeeTransfer(t, second, 0, 20),
+		newTestFeeTransfer(t, second, 1, 10),
+		newTestFeeTransfer(t, third, 0, 5),
+	}
+	for _, transaction := range transactions {
+		if err := mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the high fee of the second transaction of the first sender waits for the low fee of its first one
+	for _, test := range []struct {
+		count    int
+		expected []*Transaction
+	}{
+		{0, nil},
+		{1, transactions[2:3]},
+		{3, []*Transaction{transactions[2], transactions[3], transactions[4]}},
+		{10, []*Transaction{transactions[2], transactions[3], transactions[4], transactions[0], transactions[1]}},
+	} {
+		expectPending(t, mempool, test.count, test.expected...)
+	}
+}
+
+func TestMempoolEvict(t *testing.T) {
+	first, second, third := newTestKey(t), newTestKey(t), newTestKey(t)
+	mempool := NewMempool(testChainID)
+	lowest := newTestFeeTransfer(t, first, 0, 1)
+	last := newTestFeeTransfer(t, first, 1, 10)
+	evicted := newTestFeeTransfer(t, second, 0, 2)
+	for _, transaction := range []*Transaction{lowest, last, evicted} {
+		if err := mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the mempool is filled with unsigned transactions of other senders
+	for n := mempool.Count(); n < MempoolCountMax; n++ {
+		id := fmt.Sprintf("%d", n)
+		entry := &mempoolEntry{transaction: &Transaction{ID: []byte(id), Fee: 5}, sender: id, added: time.Now()}
+		mempool.transactions[id] = entry
+		mempool.senders[id] = []*mempoolEntry{entry}
+	}
+
+	added := newTestFeeTransfer(t, third, 0, 3)
+	for _, test := range []struct {
+		name        string
+		transaction *Transaction
+		expected    error
+	}{
+		{"lowest fee", newTestFeeTransfer(t, third, 0, 1), ErrorMempoolFull},
+		{"fee of the lowest last transaction", newTestFeeTransfer(t, third, 0, 2), ErrorMempoolFull},
+		{"higher fee", added, nil},
+		{"fee of the new lowest last transaction", newTestFeeTransfer(t, third, 1, 3), ErrorMempoolFull},
+	} {
+		if err := mempool.Add(test.transaction); err != test.expected {
+			t.Fatalf("%s: error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	// only the last transaction of a sender is evicted, otherwise its nonces would have a gap
+	for _, test := range []struct {
+		transaction *Transaction
+		found       bool
+	}{
+		{lowest, true},
+		{last, true},
+		{evicted, false},
+		{added, true},
+	} {
+		if _, found := mempool.Get(test.transaction.ID); found != test.found {
+			t.Fatalf("nonce %d fee %d found %t", test.transaction.Nonce, test.transaction.Fee, found)
+		}
+	}
+	if mempool.Count() != MempoolCountMax {
+		t.Fatalf("count %d", mempool.Count())
+	}
+}
+
+func TestMempoolExpire(t *testing.T) {
+	first, second := newTestKey(t), newTestKey(t)
+	mempool := NewMempool(testChainID)
+	transactions := []*Transaction{
+		newTestFeeTransfer(t, first, 0, 1),
+		newTestFeeTransfer(t, first, 1, 1),
+		newTestFeeTransfer(t, second, 0, 1),
+		newTestFeeTransfer(t, second, 1, 1),
+		newTestFeeTransfer(t, second, 2, 1),
+	}
+	for _, transaction := range transactions {
+		if err := mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first transaction of the first sender was added long ago, the second one of the second sender is old
+	mempool.transactions[string(transactions[0].ID)].added = time.Now().Add(-MempoolAgeMax - time.Minute)
+	transactions[3].Timestamp = uint64(time.Now().Add(-MempoolAgeMax - time.Minute).UnixMilli())
+
+	// the following transactions of a sender are removed too
+	mempool.Expire()
+	expectPending(t, mempool, 10, transactions[2])
+}
+
+func TestMempoolRemoveBlock(t *testing.T) {
+	validator, first, second := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(first, 1000), testGenesisAccount(second, 1000))
+	transactions := []*Transaction{
+		newTestTransfer(t, first, second, 0, 10),
+		newTestTransfer(t, first, second, 1, 10),
+		newTestTransfer(t, first, second, 2, 10),
+		newTestTransfer(t, second, first, 0, 10),
+	}
+	for _, transaction := range transactions {
+		if err := blockchain.Mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the block includes the first pending transaction and another one with the nonce of the second
+	block := newTestBlock(t, validator, genesisBlock, 10, transactions[0], newTestTransfer(t, first, second, 1, 20))
+	if err := blockchain.AppendBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	expectPending(t, blockchain.Mempool, 10, transactions[2], transactions[3])
+	for _, transaction := range transactions[:2] {
+		if _, found := blockchain.Mempool.Get(transaction.ID); found {
+			t.Fatalf("transaction with nonce %d pending", transaction.Nonce)
+		}
+	}
+}
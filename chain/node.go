@@ -19,6 +19,7 @@ type Node struct {
 	IsIndexer         bool
 	BlockchainHeight  uint64 // Blockchain height
 	BlockchainVersion uint64 // Blockchain version
+	ChainID           uint32 // Network of the node
 }
 
 func (node *Node) FeaturesSupport() (features byte) {
@@ -32,7 +33,7 @@ func (node *Node) FeaturesSupport() (features byte) {
 }
 
 func (node *Node) String() string {
-	return fmt.Sprintf("ID= %X, Port= %d, IsValidator= %t, IsIndexer= %t, BlockchainHeight= %d, BlockchainVersion=%d",
-		node.ID, node.Port, node.IsValidator, node.IsIndexer, node.BlockchainHeight, node.BlockchainVersion,
+	return fmt.Sprintf("ID= %X, Port= %d, IsValidator= %t, IsIndexer= %t, BlockchainHeight= %d, BlockchainVersion=%d, ChainID=%d",
+		node.ID, node.Port, node.IsValidator, node.IsIndexer, node.BlockchainHeight, node.BlockchainVersion, node.ChainID,
 	)
 }
@@ -0,0 +1,122 @@
+package chain
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"time"
+)
+
+const (
+	SlotDurationDefault  = 5 * time.Second // Duration of a block slot if not configured
+	BlockTransactionsMax = 500             // Maximum count of transactions in a block
+)
+
+var ErrorValidatorKey = errors.New("INVALID VALIDATOR PUBLIC KEY")
+var ErrorBlockProducer = errors.New("BLOCK PRODUCER IS NOT THE SCHEDULED LEADER")
+var ErrorBlockSlot = errors.New("BLOCK SLOT IS NOT AFTER THE SLOT OF THE PREVIOUS BLOCK")
+
+// Schedule divides the time into slots and assigns each slot a leader, round robin over the validator set. Slot n
+// starts at unix time n * SlotDuration. Only the leader of a slot may produce a block with a timestamp in it, and at
+// most one block per slot.
+type Schedule struct {
+	Validators   []*btcec.PublicKey // Validator set in leader order
+	SlotDuration time.Duration
+}
+
+// NewSchedule creates the schedule from the hex encoded compressed public keys of the validators.
+func NewSchedule(validators []string, slotDuration time.Duration) (schedule *Schedule, err error) {
+	if slotDuration <= 0 {
+		slotDuration = SlotDurationDefault
+	}
+	schedule = &Schedule{SlotDuration: slotDuration}
+	for _, validator := range validators {
+		data, err := hex.DecodeString(validator)
+		if err != nil {
+			return nil, ErrorValidatorKey
+		}
+		publicKey, err := btcec.ParsePubKey(data)
+		if err != nil {
+			return nil, ErrorValidatorKey
+		}
+		schedule.Validators = append(schedule.Validators, publicKey)
+	}
+	return schedule, nil
+}
+
+// Slot returns the slot of the timestamp in milliseconds.
+func (schedule *Schedule) Slot(timestamp uint64) uint64 {
+	return timestamp / uint64(schedule.SlotDuration/time.Millisecond)
+}
+
+// Leader returns the validator that may produce the block of the slot, nil if the validator set is empty.
+func (schedule *Schedule) Leader(slot uint64) *btcec.PublicKey {
+	if len(schedule.Validators) == 0 {
+		return nil
+	}
+	return schedule.Validators[slot%uint64(len(schedule.Validators))]
+}
+
+// IsValidator reports whether the public key is part of the validator set.
+func (schedule *Schedule) IsValidator(publicKey *btcec.PublicKey) bool {
+	for _, validator := range schedule.Validators {
+		if validator.IsEqual(publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlock checks that the block was produced by the leader of its slot, and that its slot follows the previous
+// block's. The previous block is nil for the first block.
+func (schedule *Schedule) checkBlock(block, previous *Block) error {
+	slot := schedule.Slot(block.Timestamp)
+	if leader := schedule.Leader(slot); leader == nil || block.Producer == nil || !leader.IsEqual(block.Producer) {
+		return ErrorBlockProducer
+	}
+	if previous != nil && slot <= schedule.Slot(previous.Timestamp) {
+		return ErrorBlockSlot
+	}
+	return nil
+}
+
+// ProduceBlock creates the block of the slot of the timestamp in milliseconds on top of the blockchain, signs it and
+// appends it. The block has the timestamp, so that it is in the slot the caller chose. The block contains the pending
+// transactions with the highest fees that are valid in order. It fails if the private key is not the leader of the slot
+// or the slot is not after the slot of the previous block.
+func (blockchain *Blockchain) ProduceBlock(privateKey *btcec.PrivateKey, timestamp uint64) (block *Block, err error) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	var previous *Block
+	previousHash := make([]byte, hashSize)
+	if blockchain.height > 0 {
+		var status int
+		if previous, status = blockchain.getBlock(blockchain.height - 1); status != StatusOK {
+			return nil, ErrorBlockchainCorrupt
+		}
+		previousHash = previous.Hash()
+	}
+	block = NewBlock(previousHash, blockchain.height, privateKey.PubKey(), nil)
+	block.Timestamp = timestamp
+	if err = blockchain.Schedule.checkBlock(block, previous); err != nil {
+		return nil, err
+	}
+
+	// pending transactions that are invalid on top of the previous ones are left out
+	transition := blockchain.newStateTransition(block)
+	for _, transaction := range blockchain.Mempool.Pending(BlockTransactionsMax) {
+		if transition.apply(transaction, true) == nil {
+			block.Transactions = append(block.Transactions, *transaction)
+		}
+	}
+	block.MerkleRoot = block.TransactionsRoot()
+	if err = block.Sign(privateKey); err != nil {
+		return nil, err
+	}
+
+	if err = blockchain.appendBlock(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
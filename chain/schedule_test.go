@@ -0,0 +1,56 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestProduceBlock(t *testing.T) {
+	first, second, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, _ := newTestBlockchain(t, first, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+	blockchain.Schedule = &Schedule{SlotDuration: time.Second, Validators: []*btcec.PublicKey{first.PubKey(), second.PubKey()}}
+	if err := blockchain.Mempool.Add(newTestTransfer(t, sender, recipient, 0, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last millisecond of a recent slot of the first validator
+	slot := blockchain.Schedule.Slot(uint64(time.Now().UnixMilli())) - 2
+	slot -= slot % 2
+	timestamp := (slot+1)*1000 - 1
+
+	if _, err := blockchain.ProduceBlock(second, timestamp); err != ErrorBlockProducer {
+		t.Fatalf("not the leader: error %v", err)
+	}
+	block, err := blockchain.ProduceBlock(first, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Timestamp != timestamp || blockchain.Schedule.Slot(block.Timestamp) != slot || len(block.Transactions) != 1 {
+		t.Fatalf("block timestamp %d with %d transactions", block.Timestamp, len(block.Transactions))
+	}
+	expectState(t, blockchain, sender, 990, 1)
+
+	// at most one block per slot, the next slot has the other leader
+	if _, err = blockchain.ProduceBlock(first, timestamp); err != ErrorBlockSlot {
+		t.Fatalf("same slot: error %v", err)
+	}
+	if block, err = blockchain.ProduceBlock(second, timestamp+1); err != nil {
+		t.Fatal(err)
+	}
+	if blockchain.Schedule.Slot(block.Timestamp) != slot+1 || blockchain.Height() != 3 {
+		t.Fatalf("block slot %d height %d", blockchain.Schedule.Slot(block.Timestamp), blockchain.Height())
+	}
+
+	// a timestamp too far in the future is rejected by the validation
+	future := uint64(time.Now().Add(time.Minute).UnixMilli())
+	if !blockchain.Schedule.Leader(blockchain.Schedule.Slot(future)).IsEqual(first.PubKey()) {
+		future += 1000
+	}
+	var blockErr *BlockError
+	if _, err = blockchain.ProduceBlock(first, future); !errors.As(err, &blockErr) || blockErr.Status != StatusBlockTimestamp {
+		t.Fatalf("future: error %v", err)
+	}
+}
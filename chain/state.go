@@ -0,0 +1,386 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"log"
+	"time"
+)
+
+// The state of an account is its balance and the nonce of its next transaction. It is stored under the prefix followed
+// by the account ID.
+//
+// Offset  Length  Content
+// 0       8       Balance
+// 8       8       Nonce of the next transaction
+const (
+	keyStatePrefix = "state/"
+	stateSize      = 16
+)
+
+// Per block the undo record contains the states before the block was applied, it is stored under the prefix followed by
+// the height as 8 bytes big endian:
+//
+// Offset  Length  Content
+// 0       4       Count of accounts
+// 4       ?       Per account: account ID (32), existed before (1), balance (8), nonce (8)
+const (
+	keyUndoPrefix = "undo/"
+	undoEntrySize = hashSize + 1 + stateSize
+)
+
+// Transfer payload, the fee is paid in addition to the amount.
+//
+// Offset  Length  Content
+// 0       32      Account ID of the recipient
+// 32      8       Amount
+const transferPayloadSize = hashSize + 8
+
+var ErrorTransactionType = errors.New("UNKNOWN TRANSACTION TYPE")
+var ErrorTransferMalformed = errors.New("MALFORMED TRANSFER")
+var ErrorAccountNotFound = errors.New("ACCOUNT NOT FOUND")
+var ErrorInsufficientBalance = errors.New("INSUFFICIENT BALANCE")
+var ErrorBalanceOverflow = errors.New("BALANCE OVERFLOW")
+
+// AccountState is the balance and the nonce of an account.
+type AccountState struct {
+	Balance uint64
+	Nonce   uint64 // Nonce of the next transaction of the account
+}
+
+// TransferPayload is the payload of TransactionTypeTransfer.
+type TransferPayload struct {
+	Recipient []byte // Account ID
+	Amount    uint64
+}
+
+// NewTransfer creates a transfer of the amount to the recipient account, signed for the chain ID.
+func NewTransfer(privateKey *btcec.PrivateKey, chainID uint32, nonce uint64, recipient []byte, amount, fee uint64) (transaction *Transaction, err error) {
+	if len(recipient) != hashSize {
+		return nil, ErrorTransferMalformed
+	}
+	payload := make([]byte, transferPayloadSize)
+	copy(payload[0:hashSize], recipient)
+	binary.BigEndian.PutUint64(payload[hashSize:transferPayloadSize], amount)
+
+	transaction = &Transaction{
+		Type:      TransactionTypeTransfer,
+		Timestamp: uint64(time.Now().UnixMilli()),
+		Nonce:     nonce,
+		Fee:       fee,
+		Payload:   payload,
+	}
+	if err = transaction.Sign(privateKey, chainID); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+func DecodeTransfer(payload []byte) (transfer *TransferPayload, err error) {
+	if len(payload) != transferPayloadSize {
+		return nil, ErrorTransferMalformed
+	}
+	return &TransferPayload{Recipient: payload[0:hashSize], Amount: binary.BigEndian.Uint64(payload[hashSize:transferPayloadSize])}, nil
+}
+
+func keyState(id []byte) []byte {
+	return append([]byte(keyStatePrefix), id...)
+}
+
+// GetAccountState returns the balance and nonce of the account.
+func (blockchain *Blockchain) GetAccountState(id []byte) (state AccountState, found bool) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.getState(id)
+}
+
+// getState reads the state of the account. The blockchain must be locked.
+func (blockchain *Blockchain) getState(id []byte) (state AccountState, found bool) {
+	data, found := blockchain.database.Get(keyState(id))
+	if !found || len(data) != stateSize {
+		return state, false
+	}
+	return AccountState{Balance: binary.BigEndian.Uint64(data[0:8]), Nonce: binary.BigEndian.Uint64(data[8:16])}, true
+}
+
+// setState writes the state of the account. The blockchain must be locked.
+func (blockchain *Blockchain) setState(id []byte, state *AccountState) error {
+	var data [stateSize]byte
+	binary.BigEndian.PutUint64(data[0:8], state.Balance)
+	binary.BigEndian.PutUint64(data[8:16], state.Nonce)
+	return blockchain.database.Set(keyState(id), data[:])
+}
+
+// stateTransition collects the changes of transactions on top of the stored state. Nothing is stored until commit, a
+// failed transaction leaves the stored state untouched. The blockchain must be locked while it is used.
+type stateTransition struct {
+	blockchain *Blockchain
+	block      *Block                   // Block of the transactions, its height and timestamp are used for new accounts
+	accounts   []*Account               // Accounts created
+	aliases    map[string]bool          // Aliases registered
+	states     map[string]*AccountState // Changed states by account ID
+	original   map[string]*AccountState // States before the transition by account ID, nil if the account did not exist
+	fees       uint64                   // Sum of the fees, credited to the producer
+}
+
+func (blockchain *Blockchain) newStateTransition(block *Block) *stateTransition {
+	return &stateTransition{
+		blockchain: blockchain,
+		block:      block,
+		aliases:    make(map[string]bool),
+		states:     make(map[string]*AccountState),
+		original:   make(map[string]*AccountState),
+	}
+}
+
+// state returns the current state of the account, nil if it does not exist.
+func (transition *stateTransition) state(id []byte) *AccountState {
+	if state := transition.states[string(id)]; state != nil {
+		return state
+	}
+	if _, loaded := transition.original[string(id)]; loaded {
+		return nil
+	}
+	state, found := transition.blockchain.getState(id)
+	if !found {
+		transition.original[string(id)] = nil
+		return nil
+	}
+	original := state
+	transition.original[string(id)] = &original
+	transition.states[string(id)] = &state
+	return &state
+}
+
+// apply applies the verified transaction. If checkNonce is false the nonce may be any following one, which is used to
+// validate pending transactions. On error the transition is unchanged.
+func (transition *stateTransition) apply(transaction *Transaction, checkNonce bool) (err error) {
+	senderID := AccountID(transaction.Sender)
+	sender := transition.state(senderID)
+
+	switch transaction.Type {
+	case TransactionTypeCreateAccount:
+		account, err := accountFromTransaction(transaction, transition.block)
+		if err != nil {
+			return err
+		}
+		if sender == nil {
+			return ErrorAccountNotFound
+		}
+		if checkNonce && transaction.Nonce != sender.Nonce || transaction.Nonce < sender.Nonce {
+			return ErrorTransactionNonce
+		}
+		if transaction.Fee < AccountCreateFeeMin {
+			return ErrorAccountFee
+		}
+		if sender.Balance < transaction.Fee {
+			return ErrorInsufficientBalance
+		}
+		if transition.fees+transaction.Fee < transition.fees {
+			return ErrorBalanceOverflow
+		}
+		if transition.state(account.ID) != nil {
+			return ErrorAccountExists
+		}
+		if account.Alias != "" {
+			if transition.aliases[account.Alias] || transition.blockchain.aliasTaken(account.Alias) {
+				return ErrorAccountAliasTaken
+			}
+			transition.aliases[account.Alias] = true
+		}
+		transition.accounts = append(transition.accounts, account)
+		transition.states[string(account.ID)] = &AccountState{}
+		sender.Balance -= transaction.Fee
+		transition.fees += transaction.Fee
+		if checkNonce {
+			sender.Nonce++
+		}
+		return nil
+
+	case TransactionTypeTransfer:
+		transfer, err := DecodeTransfer(transaction.Payload)
+		if err != nil {
+			return err
+		}
+		if sender == nil {
+			return ErrorAccountNotFound
+		}
+		if checkNonce && transaction.Nonce != sender.Nonce || transaction.Nonce < sender.Nonce {
+			return ErrorTransactionNonce
+		}
+		recipient := transition.state(transfer.Recipient)
+		if recipient == nil {
+			return ErrorAccountNotFound
+		}
+		total := transfer.Amount + transaction.Fee
+		if total < transfer.Amount || sender.Balance < total {
+			return ErrorInsufficientBalance
+		}
+		if transition.fees+transaction.Fee < transition.fees {
+			return ErrorBalanceOverflow
+		}
+
+		// the recipient may be the sender
+		sender.Balance -= total
+		if recipient.Balance+transfer.Amount < recipient.Balance {
+			sender.Balance += total
+			return ErrorBalanceOverflow
+		}
+		recipient.Balance += transfer.Amount
+		transition.fees += transaction.Fee
+		if checkNonce {
+			sender.Nonce++
+		}
+		return nil
+	}
+
+	return ErrorTransactionType
+}
+
+// applyBlock applies all transactions of the block and credits the fees to the producer's account, if it exists. It
+// fails if any transaction is invalid. The transactions must be verified.
+func (blockchain *Blockchain) applyBlock(block *Block) (transition *stateTransition, err error) {
+	transition = blockchain.newStateTransition(block)
+	for n := range block.Transactions {
+		if err = transition.apply(&block.Transactions[n], true); err != nil {
+			return nil, err
+		}
+	}
+
+	if block.Producer == nil {
+		return transition, nil // genesis block
+	}
+	if producer := transition.state(AccountID(block.Producer)); producer != nil && transition.fees > 0 {
+		if producer.Balance+transition.fees < producer.Balance {
+			return nil, ErrorBalanceOverflow
+		}
+		producer.Balance += transition.fees
+	}
+	return transition, nil
+}
+
+// commit stores the created accounts and the changed states.
+func (transition *stateTransition) commit() (err error) {
+	for _, account := range transition.accounts {
+		if err = transition.blockchain.storeAccount(account); err != nil {
+			return err
+		}
+	}
+	for id, state := range transition.states {
+		if err = transition.blockchain.setState([]byte(id), state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTransaction checks a verified pending transaction against the stored state. Its nonce may follow other
+// pending transactions of the sender.
+func (blockchain *Blockchain) validateTransaction(transaction *Transaction) error {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return blockchain.newStateTransition(&Block{}).apply(transaction, false)
+}
+
+// nextNonce returns the nonce of the next transaction of the sender. Senders without account must start with 0.
+func (blockchain *Blockchain) nextNonce(sender *btcec.PublicKey) (nonce uint64, known bool) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	state, _ := blockchain.getState(AccountID(sender))
+	return state.Nonce, true
+}
+
+func keyUndo(height uint64) []byte {
+	return append([]byte(keyUndoPrefix), keyBlock(height)...)
+}
+
+// encodeUndo encodes the states before the transition.
+func (transition *stateTransition) encodeUndo() (data []byte) {
+	data = make([]byte, 4, 4+len(transition.original)*undoEntrySize)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(transition.original)))
+	for id, state := range transition.original {
+		var entry [undoEntrySize]byte
+		copy(entry[0:hashSize], id)
+		if state != nil {
+			entry[hashSize] = 1
+			binary.BigEndian.PutUint64(entry[hashSize+1:hashSize+9], state.Balance)
+			binary.BigEndian.PutUint64(entry[hashSize+9:undoEntrySize], state.Nonce)
+		}
+		data = append(data, entry[:]...)
+	}
+	return data
+}
+
+// getUndo reads the undo record of the block at the height, nil if it is missing or malformed. The blockchain must be
+// locked.
+func (blockchain *Blockchain) getUndo(height uint64) (data []byte) {
+	data, found := blockchain.database.Get(keyUndo(height))
+	if !found || len(data) < 4 || len(data) != 4+int(binary.BigEndian.Uint32(data[0:4]))*undoEntrySize {
+		return nil
+	}
+	return data
+}
+
+// undoState restores the states before the block at the height was applied. Accounts that did not exist before are
+// deleted together with their alias. The blockchain must be locked.
+func (blockchain *Blockchain) undoState(height uint64) error {
+	data := blockchain.getUndo(height)
+	if data == nil {
+		return ErrorBlockchainCorrupt
+	}
+	for offset := 4; offset < len(data); offset += undoEntrySize {
+		id := data[offset : offset+hashSize]
+		if data[offset+hashSize] == 1 {
+			state := AccountState{
+				Balance: binary.BigEndian.Uint64(data[offset+hashSize+1 : offset+hashSize+9]),
+				Nonce:   binary.BigEndian.Uint64(data[offset+hashSize+9 : offset+undoEntrySize]),
+			}
+			if err := blockchain.setState(id, &state); err != nil {
+				return err
+			}
+			continue
+		}
+		if account, found := blockchain.getAccount(id); found && account.Alias != "" {
+			blockchain.database.Delete(keyAlias(account.Alias))
+		}
+		blockchain.database.Delete(keyAccount(id))
+		blockchain.database.Delete(keyState(id))
+	}
+	return nil
+}
+
+// revertBlock restores the states before the block at the height and deletes the block and its hash index. The block
+// may be undecodable, the hash index is then left. The undo record is deleted last, so that an interrupted revert is
+// repeated by undoPartialBlock. The blockchain must be locked.
+func (blockchain *Blockchain) revertBlock(height uint64) error {
+	if err := blockchain.undoState(height); err != nil {
+		return err
+	}
+	// the hash index is deleted only if it points to the block
+	if data, found := blockchain.database.Get(keyBlock(height)); found {
+		if block, err := DecodeBlock(data); err == nil {
+			if key, found := blockchain.database.Get(block.Hash()); found && bytes.Equal(key, keyBlock(height)) {
+				blockchain.database.Delete(block.Hash())
+			}
+		}
+	}
+	blockchain.database.Delete(keyBlock(height))
+	blockchain.database.Delete(keyUndo(height))
+	return nil
+}
+
+// undoPartialBlock reverts the block at the height whose append or rollback was interrupted, for example by a crash.
+// Its undo record exists only then, as it is stored before and deleted after the header is written. The blockchain
+// must be locked.
+func (blockchain *Blockchain) undoPartialBlock() (found bool, err error) {
+	if _, found = blockchain.database.Get(keyUndo(blockchain.height)); !found {
+		return false, nil
+	}
+	if err = blockchain.revertBlock(blockchain.height); err != nil {
+		return true, err
+	}
+	log.Printf("Blockchain -> reverted the partially applied block at height %d", blockchain.height)
+	return true, nil
+}
@@ -2,48 +2,175 @@ package chain
 
 import (
 	"blockchain/hash"
-	"bytes"
-	"encoding/gob"
-	"log"
+	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
 )
 
 const (
 	TransactionStatusUnknown uint8 = 0
 )
 
+// Transaction types
+const (
+	TransactionTypeCreateAccount uint16 = 1 // Creates an account paid by the sender. Payload: public key and optional alias.
+	TransactionTypeTransfer      uint16 = 2 // Transfers value to another account. Payload: TransferPayload.
+)
+
+// Transaction encoding. All integers are big endian. The encoding is canonical: every transaction has exactly one
+// encoding, which is hashed for the transaction ID. The ID, the sender and the status are not encoded, the status is
+// local.
+//
+// Offset  Length  Content
+// 0       1       Format version = 0
+// 1       2       Type
+// 3       8       Timestamp
+// 11      8       Nonce, per sender
+// 19      8       Fee, transactions with a higher fee are preferred
+// 27      2       Length of the payload
+// 29      ?       Payload
+// ?       1       Length of the signature, 0 or 65
+// ?       ?       Signature
+//
+// The signature is a compact recoverable secp256k1 signature over the hash of the chain ID (4 bytes) followed by the
+// unsigned encoding, which is the encoding with signature length 0. It covers all encoded fields except the signature
+// itself, and a transaction signed for another network does not verify. The sender is the public key recovered from
+// the signature.
+const (
+	transactionFormatOffset        = 0
+	transactionTypeOffset          = 1
+	transactionTimestampOffset     = 3
+	transactionNonceOffset         = 11
+	transactionFeeOffset           = 19
+	transactionPayloadLengthOffset = 27
+	transactionPayloadOffset       = 29
+
+	transactionFormat     = 0
+	transactionPayloadMax = 0xFFFF // The length of the payload is encoded in 2 bytes
+)
+
+var ErrorTransactionMalformed = errors.New("MALFORMED TRANSACTION")
+var ErrorTransactionFormat = errors.New("UNKNOWN TRANSACTION FORMAT")
+var ErrorTransactionSignature = errors.New("INVALID TRANSACTION SIGNATURE")
+
 type Transaction struct {
-	ID        []byte
+	ID        []byte // Hash of the encoded transaction
 	Type      uint16
-	Status    uint8
+	Status    uint8 // Local processing status, not part of the encoding
 	Signature []byte
 	Timestamp uint64
+	Nonce     uint64           // Sequence number of the sender's transactions
+	Fee       uint64           // Priority of the transaction
+	Payload   []byte           // Type specific data
+	Sender    *btcec.PublicKey // Recovered from the signature by Sign and Verify, not part of the encoding
 }
 
+// Hash returns the hash of the canonical encoding.
 func (transaction *Transaction) Hash() []byte {
-	txCopy := *transaction
-	txCopy.ID = []byte{}
-	return hash.HashData(txCopy.Serialize())
+	return hash.HashData(transaction.Encode())
+}
+
+// SignatureHash returns the hash that is signed, the hash of the chain ID and the unsigned encoding.
+func (transaction *Transaction) SignatureHash(chainID uint32) []byte {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], chainID)
+	return hash.HashData(append(data[:], transaction.encode(false)...))
+}
+
+// Sign signs the transaction for the network of the chain ID, and sets the sender and the ID. It fails for chain ID 0,
+// and if the payload is too long to be encoded.
+func (transaction *Transaction) Sign(privateKey *btcec.PrivateKey, chainID uint32) (err error) {
+	if len(transaction.Payload) > transactionPayloadMax {
+		return ErrorTransactionMalformed
+	}
+	if chainID == 0 {
+		return ErrorChainID
+	}
+	if transaction.Signature, err = ecdsa.SignCompact(privateKey, transaction.SignatureHash(chainID), true); err != nil {
+		return err
+	}
+	transaction.Sender = privateKey.PubKey()
+	transaction.ID = transaction.Hash()
+	return nil
 }
 
-func (transaction Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+// Verify checks the signature and sets the sender to the recovered public key. Signatures with a high S value or a
+// recovery code for an uncompressed public key are rejected, otherwise a second valid encoding with a different ID would
+// exist. Signatures for another chain ID recover another sender, chain ID 0 is rejected.
+func (transaction *Transaction) Verify(chainID uint32) error {
+	if chainID == 0 {
+		return ErrorChainID
+	}
+	if len(transaction.Signature) != signatureSize {
+		return ErrorTransactionSignature
+	}
+	var s btcec.ModNScalar
+	if overflow := s.SetByteSlice(transaction.Signature[33:65]); overflow || s.IsOverHalfOrder() {
+		return ErrorTransactionSignature
+	}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(transaction)
-	if err != nil {
-		log.Panic(err)
+	sender, compressed, err := ecdsa.RecoverCompact(transaction.Signature, transaction.SignatureHash(chainID))
+	if err != nil || !compressed {
+		return ErrorTransactionSignature
 	}
+	transaction.Sender = sender
+	return nil
+}
 
-	return encoded.Bytes()
+// Encode returns the canonical binary encoding.
+func (transaction *Transaction) Encode() (data []byte) {
+	return transaction.encode(true)
 }
 
-func Deserialize(data []byte) Transaction {
-	var transaction Transaction
+func (transaction *Transaction) encode(withSignature bool) (data []byte) {
+	data = make([]byte, transactionPayloadOffset, transactionPayloadOffset+len(transaction.Payload)+1+len(transaction.Signature))
+	data[transactionFormatOffset] = transactionFormat
+	binary.BigEndian.PutUint16(data[transactionTypeOffset:transactionTimestampOffset], transaction.Type)
+	binary.BigEndian.PutUint64(data[transactionTimestampOffset:transactionNonceOffset], transaction.Timestamp)
+	binary.BigEndian.PutUint64(data[transactionNonceOffset:transactionFeeOffset], transaction.Nonce)
+	binary.BigEndian.PutUint64(data[transactionFeeOffset:transactionPayloadLengthOffset], transaction.Fee)
+	binary.BigEndian.PutUint16(data[transactionPayloadLengthOffset:transactionPayloadOffset], uint16(len(transaction.Payload)))
+	data = append(data, transaction.Payload...)
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	if err != nil {
-		log.Panic(err)
+	if !withSignature {
+		return append(data, 0)
+	}
+	return append(append(data, byte(len(transaction.Signature))), transaction.Signature...)
+}
+
+// DecodeTransaction decodes the transaction and sets its ID. Only the canonical encoding is accepted. The signature is
+// not verified.
+func DecodeTransaction(data []byte) (transaction *Transaction, err error) {
+	if len(data) < transactionPayloadOffset+1 {
+		return nil, ErrorTransactionMalformed
+	}
+	if data[transactionFormatOffset] != transactionFormat {
+		return nil, ErrorTransactionFormat
+	}
+
+	payloadLength := int(binary.BigEndian.Uint16(data[transactionPayloadLengthOffset:transactionPayloadOffset]))
+	signatureLengthOffset := transactionPayloadOffset + payloadLength
+	if signatureLengthOffset >= len(data) {
+		return nil, ErrorTransactionMalformed
+	}
+	signatureLength := int(data[signatureLengthOffset])
+	if signatureLength != 0 && signatureLength != signatureSize || len(data) != signatureLengthOffset+1+signatureLength {
+		return nil, ErrorTransactionMalformed
+	}
+
+	transaction = &Transaction{
+		Type:      binary.BigEndian.Uint16(data[transactionTypeOffset:transactionTimestampOffset]),
+		Timestamp: binary.BigEndian.Uint64(data[transactionTimestampOffset:transactionNonceOffset]),
+		Nonce:     binary.BigEndian.Uint64(data[transactionNonceOffset:transactionFeeOffset]),
+		Fee:       binary.BigEndian.Uint64(data[transactionFeeOffset:transactionPayloadLengthOffset]),
+	}
+	if payloadLength > 0 {
+		transaction.Payload = append([]byte{}, data[transactionPayloadOffset:signatureLengthOffset]...)
+	}
+	if signatureLength > 0 {
+		transaction.Signature = append([]byte{}, data[signatureLengthOffset+1:]...)
 	}
-	return transaction
+	transaction.ID = hash.HashData(data)
+	return transaction, nil
 }
@@ -0,0 +1,207 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestTransactionSignature(t *testing.T) {
+	privateKey := newTestKey(t)
+	transaction := &Transaction{Type: TransactionTypeTransfer, Timestamp: 7, Nonce: 9, Fee: 1, Payload: []byte("payload")}
+	if err := transaction.Sign(privateKey, testChainID); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeTransaction(transaction.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.ID, transaction.ID) {
+		t.Fatalf("ID %x, expected %x", decoded.ID, transaction.ID)
+	}
+	if err = decoded.Verify(testChainID); err != nil || !decoded.Sender.IsEqual(privateKey.PubKey()) {
+		t.Fatalf("error %v", err)
+	}
+
+	// a changed field recovers another sender
+	decoded.Nonce++
+	if err = decoded.Verify(testChainID); err == nil && decoded.Sender.IsEqual(privateKey.PubKey()) {
+		t.Fatal("changed transaction verified")
+	}
+	decoded.Nonce--
+
+	// the same signature with the recovery code for an uncompressed public key
+	uncompressed := *decoded
+	uncompressed.Signature = append([]byte{}, decoded.Signature...)
+	uncompressed.Signature[0] -= 4
+	if err = uncompressed.Verify(testChainID); err != ErrorTransactionSignature {
+		t.Fatalf("uncompressed recovery code: error %v", err)
+	}
+
+	// the same signature with the high S value
+	highS := *decoded
+	highS.Signature = append([]byte{}, decoded.Signature...)
+	var s btcec.ModNScalar
+	s.SetByteSlice(highS.Signature[33:65])
+	s.Negate()
+	negated := s.Bytes()
+	copy(highS.Signature[33:65], negated[:])
+	highS.Signature[0] ^= 1
+	if err = highS.Verify(testChainID); err != ErrorTransactionSignature {
+		t.Fatalf("high S: error %v", err)
+	}
+
+	unsigned := &Transaction{Type: TransactionTypeTransfer, Timestamp: 7}
+	if err = unsigned.Verify(testChainID); err != ErrorTransactionSignature {
+		t.Fatalf("unsigned: error %v", err)
+	}
+}
+
+func TestTransactionChainID(t *testing.T) {
+	privateKey := newTestKey(t)
+	signed, err := NewTransfer(privateKey, testChainID, 0, AccountID(privateKey.PubKey()), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is signed or verified for chain ID 0
+	if _, err = NewTransfer(privateKey, 0, 0, AccountID(privateKey.PubKey()), 1, 0); err != ErrorChainID {
+		t.Fatalf("sign: error %v", err)
+	}
+	if _, err = CreateAccount(privateKey, 0, 0, newTestKey(t).PubKey(), "", AccountCreateFeeMin); err != ErrorChainID {
+		t.Fatalf("sign: error %v", err)
+	}
+	if err = signed.Verify(0); err != ErrorChainID {
+		t.Fatalf("verify: error %v", err)
+	}
+
+	// the signature recovers another sender on another network
+	if err = signed.Verify(testChainID + 1); err == nil && signed.Sender.IsEqual(privateKey.PubKey()) {
+		t.Fatal("verified on another network")
+	}
+
+	genesis := &Genesis{Validators: []string{hex.EncodeToString(privateKey.PubKey().SerializeCompressed())}}
+	if _, err = genesis.Encode(); err != ErrorChainID {
+		t.Fatalf("genesis: error %v", err)
+	}
+	genesis.ChainID = 2
+	if _, err = genesis.Encode(); err != nil {
+		t.Fatalf("genesis: error %v", err)
+	}
+}
+
+// Golden vectors of the README for chain ID 1, they must never change for a format version.
+const (
+	vectorPrivateKey       = "1E99423A4ED27608A15A2616A2B0E9E52CED330AC530EDCC32C8FFC6A526AEDD"
+	vectorUnsignedEncoding = "000001000001811c8fe00000000000000000000000000000000000000000"
+	vectorUnsignedHash     = "bdd8162b0d3f3354703283da4455550543c3019ce2fd813797c5b3d100efe013"
+	vectorSignatureHash    = "f62e35a431225e27cfe288c7e119dd31b3b34f13cb562552bdf387c58e1681b7"
+	vectorSignedEncoding   = "000102000001811c8fe0000000000000000001000000000000000a0002cafe411f50fd9fd86437b0f23243a71d68a055bca00a4e27926b06a804cd8bfe2ace2af00e5478c004c72aa6a1342e8b6f72ba04c87926c99597c22f6fe795ae9fa1ee06"
+	vectorSignedHash       = "78222105b2ecfa5810044e788437c67cff36745b958b7057f599c64d53bdcff2"
+)
+
+func decodeHex(t *testing.T, text string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTransactionVectors(t *testing.T) {
+	unsigned := &Transaction{Type: TransactionTypeCreateAccount, Timestamp: 1654041600000}
+	if encoding := hex.EncodeToString(unsigned.Encode()); encoding != vectorUnsignedEncoding {
+		t.Fatalf("unsigned encoding %s", encoding)
+	}
+	if transactionHash := hex.EncodeToString(unsigned.Hash()); transactionHash != vectorUnsignedHash {
+		t.Fatalf("unsigned hash %s", transactionHash)
+	}
+
+	privateKey, _ := btcec.PrivKeyFromBytes(decodeHex(t, vectorPrivateKey))
+	signed := &Transaction{Type: 0x0102, Timestamp: 1654041600000, Nonce: 1, Fee: 10, Payload: []byte{0xCA, 0xFE}}
+	if signatureHash := hex.EncodeToString(signed.SignatureHash(testChainID)); signatureHash != vectorSignatureHash {
+		t.Fatalf("signature hash %s", signatureHash)
+	}
+	if err := signed.Sign(privateKey, testChainID); err != nil {
+		t.Fatal(err)
+	}
+	if encoding := hex.EncodeToString(signed.Encode()); encoding != vectorSignedEncoding {
+		t.Fatalf("signed encoding %s", encoding)
+	}
+	if transactionHash := hex.EncodeToString(signed.Hash()); transactionHash != vectorSignedHash || !bytes.Equal(signed.ID, signed.Hash()) {
+		t.Fatalf("signed hash %s", transactionHash)
+	}
+
+	for _, vector := range []struct {
+		encoding, hash string
+		expected       *Transaction
+	}{
+		{vectorUnsignedEncoding, vectorUnsignedHash, unsigned},
+		{vectorSignedEncoding, vectorSignedHash, signed},
+	} {
+		decoded, err := DecodeTransaction(decodeHex(t, vector.encoding))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(decoded.ID) != vector.hash || decoded.Type != vector.expected.Type ||
+			decoded.Timestamp != vector.expected.Timestamp || decoded.Nonce != vector.expected.Nonce ||
+			decoded.Fee != vector.expected.Fee || !bytes.Equal(decoded.Payload, vector.expected.Payload) ||
+			!bytes.Equal(decoded.Signature, vector.expected.Signature) {
+			t.Fatalf("decoded %+v", decoded)
+		}
+		if !bytes.Equal(decoded.Encode(), decodeHex(t, vector.encoding)) {
+			t.Fatal("decoded encoding differs")
+		}
+	}
+
+	decoded, _ := DecodeTransaction(decodeHex(t, vectorSignedEncoding))
+	if err := decoded.Verify(testChainID); err != nil || !decoded.Sender.IsEqual(privateKey.PubKey()) {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestDecodeTransactionMalformed(t *testing.T) {
+	signed := decodeHex(t, vectorSignedEncoding)
+	unsigned := decodeHex(t, vectorUnsignedEncoding)
+
+	// the payload length points beyond the data
+	longPayload := append([]byte{}, unsigned...)
+	longPayload[transactionPayloadLengthOffset+1] = 1
+	// the signature length is neither 0 nor 65
+	shortSignature := append([]byte{}, signed[:len(signed)-1]...)
+	shortSignature[transactionPayloadOffset+2] = signatureSize - 1
+	// an unknown format version
+	format := append([]byte{}, unsigned...)
+	format[transactionFormatOffset] = 1
+	// the payload length wraps around, such a transaction is not signed
+	oversized := &Transaction{Type: TransactionTypeTransfer, Payload: make([]byte, transactionPayloadMax+1)}
+	if err := oversized.Sign(newTestKey(t), testChainID); err != ErrorTransactionMalformed {
+		t.Fatalf("oversized payload: error %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"empty", nil, ErrorTransactionMalformed},
+		{"truncated header", unsigned[:transactionPayloadOffset-1], ErrorTransactionMalformed},
+		{"truncated payload length", unsigned[:transactionPayloadLengthOffset+1], ErrorTransactionMalformed},
+		{"missing signature length", unsigned[:transactionPayloadOffset], ErrorTransactionMalformed},
+		{"payload beyond the data", longPayload, ErrorTransactionMalformed},
+		{"truncated signature", signed[:len(signed)-1], ErrorTransactionMalformed},
+		{"signature length", shortSignature, ErrorTransactionMalformed},
+		{"trailing bytes unsigned", append(append([]byte{}, unsigned...), 0), ErrorTransactionMalformed},
+		{"trailing bytes signed", append(append([]byte{}, signed...), 0), ErrorTransactionMalformed},
+		{"oversized payload", oversized.Encode(), ErrorTransactionMalformed},
+		{"format", format, ErrorTransactionFormat},
+	} {
+		if transaction, err := DecodeTransaction(test.data); err != test.expected || transaction != nil {
+			t.Errorf("%s: error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const blockClockSkew = 10 * time.Second // Tolerance for block timestamps in the future
+
+var ErrorBlockTimestamp = errors.New("BLOCK TIMESTAMP OUT OF BOUNDS")
+var ErrorBlockMerkleRoot = errors.New("BLOCK MERKLE ROOT MISMATCH")
+var ErrorBlockSize = errors.New("BLOCK EXCEEDS SIZE LIMIT")
+
+// BlockError is returned for a block that failed validation. The status tells which check failed, so that the sender
+// of the block can be penalized; the error is the cause.
+type BlockError struct {
+	Status int    // StatusX code of the failed check
+	Height uint64 // Height of the block
+	Err    error
+}
+
+func (err *BlockError) Error() string {
+	return fmt.Sprintf("block %d: %v", err.Height, err.Err)
+}
+
+func (err *BlockError) Unwrap() error {
+	return err.Err
+}
+
+func blockError(status int, block *Block, err error) *BlockError {
+	return &BlockError{Status: status, Height: block.Height, Err: err}
+}
+
+// Validate runs the checks that do not depend on the blockchain: size limits, producer signature, Merkle root and the
+// signatures and sizes of the transactions, which are verified for the chain ID. The returned error is a *BlockError.
+func (block *Block) Validate(chainID uint32) error {
+	if len(block.Transactions) > BlockTransactionsMax {
+		return blockError(StatusBlockSize, block, ErrorBlockSize)
+	}
+	size := blockTransactionsOffset
+	for n := range block.Transactions {
+		length := len(block.Transactions[n].Encode())
+		if length > TransactionSizeMax {
+			return blockError(StatusBlockSize, block, ErrorTransactionSize)
+		}
+		size += 4 + length
+	}
+	if size > BlockSizeMax {
+		return blockError(StatusBlockSize, block, ErrorBlockSize)
+	}
+
+	if err := block.VerifySignature(); err != nil {
+		return blockError(StatusBlockSignature, block, err)
+	}
+	if !bytes.Equal(block.MerkleRoot, block.TransactionsRoot()) {
+		return blockError(StatusBlockMerkleRoot, block, ErrorBlockMerkleRoot)
+	}
+	for n := range block.Transactions {
+		if err := block.Transactions[n].Verify(chainID); err != nil {
+			return blockError(StatusBlockTransaction, block, err)
+		}
+	}
+	return nil
+}
+
+// validateBlock runs the validation pipeline for a block on top of the parent, nil for the genesis block: height
+// continuity, linkage to the parent hash, timestamp bounds relative to the parent and the local clock, the scheduled
+// producer, and the checks of Validate. The state changes of the transactions are validated when the block is applied.
+// The returned error is a *BlockError.
+func (blockchain *Blockchain) validateBlock(block, parent *Block) error {
+	// the genesis block is created from the specification, any other block without parent belongs to another network
+	if parent == nil {
+		if block.Height != 0 {
+			return blockError(StatusBlockHeight, block, ErrorBlockHeight)
+		}
+		if !bytes.Equal(block.Hash(), blockchain.genesisHash) {
+			return blockError(StatusBlockLinkage, block, ErrorGenesisMismatch)
+		}
+		return nil
+	}
+
+	if block.Height != parent.Height+1 {
+		return blockError(StatusBlockHeight, block, ErrorBlockHeight)
+	}
+	if !bytes.Equal(block.PreviousHash, parent.Hash()) {
+		return blockError(StatusBlockLinkage, block, ErrorBlockPrevious)
+	}
+
+	if block.Timestamp <= parent.Timestamp || time.UnixMilli(int64(block.Timestamp)).After(time.Now().Add(blockClockSkew)) {
+		return blockError(StatusBlockTimestamp, block, ErrorBlockTimestamp)
+	}
+	if err := blockchain.Schedule.checkBlock(block, parent); err == ErrorBlockSlot {
+		return blockError(StatusBlockTimestamp, block, err)
+	} else if err != nil {
+		return blockError(StatusBlockProducer, block, err)
+	}
+
+	return block.Validate(blockchain.chainID)
+}
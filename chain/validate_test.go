@@ -0,0 +1,77 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+)
+
+// expectBlockError fails unless the error is a *BlockError with the status and the cause.
+func expectBlockError(t *testing.T, name string, err error, status int, expected error) {
+	t.Helper()
+	var blockErr *BlockError
+	if status == StatusOK && err == nil {
+		return
+	}
+	if !errors.As(err, &blockErr) || blockErr.Status != status || !errors.Is(err, expected) {
+		t.Fatalf("%s: error %v, expected status %d with %v", name, err, status, expected)
+	}
+}
+
+func TestBlockValidate(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	parent := NewBlock(make([]byte, hashSize), 0, nil, nil)
+	transfer := newTestTransfer(t, sender, recipient, 0, 10)
+
+	badSignature := newTestBlock(t, validator, parent, 10, transfer)
+	badSignature.Signature[1] ^= 1
+	changedTransaction := newTestBlock(t, validator, parent, 10, transfer)
+	changedTransaction.Transactions[0].Nonce++
+	unsigned := *transfer
+	unsigned.Signature = nil
+	tooMany := NewBlock(parent.Hash(), 1, validator.PubKey(), make([]Transaction, BlockTransactionsMax+1))
+
+	for _, test := range []struct {
+		name     string
+		block    *Block
+		status   int
+		expected error
+	}{
+		{"valid", newTestBlock(t, validator, parent, 10, transfer), StatusOK, nil},
+		{"transaction count", tooMany, StatusBlockSize, ErrorBlockSize},
+		{"transaction size", newTestBlock(t, validator, parent, 10, &Transaction{Payload: make([]byte, TransactionSizeMax)}),
+			StatusBlockSize, ErrorTransactionSize},
+		{"producer signature", badSignature, StatusBlockSignature, ErrorBlockSignature},
+		{"Merkle root", changedTransaction, StatusBlockMerkleRoot, ErrorBlockMerkleRoot},
+		{"transaction signature", newTestBlock(t, validator, parent, 10, &unsigned), StatusBlockTransaction, ErrorTransactionSignature},
+	} {
+		expectBlockError(t, test.name, test.block.Validate(testChainID), test.status, test.expected)
+	}
+}
+
+func TestAppendBlockStatus(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 100), testGenesisAccount(recipient, 0))
+	other := newTestBlock(t, validator, genesisBlock, 10)
+	other.PreviousHash = make([]byte, hashSize)
+	if err := other.Sign(validator); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		block    *Block
+		status   int
+		expected error
+	}{
+		{"height", newTestBlock(t, validator, other, 10), StatusBlockHeight, ErrorBlockHeight},
+		{"linkage", other, StatusBlockLinkage, ErrorBlockPrevious},
+		{"timestamp", newTestBlock(t, validator, genesisBlock, 1), StatusBlockTimestamp, ErrorBlockTimestamp},
+		{"producer", newTestBlock(t, sender, genesisBlock, 10), StatusBlockProducer, ErrorBlockProducer},
+		{"transaction state", newTestBlock(t, validator, genesisBlock, 10, newTestTransfer(t, sender, recipient, 0, 1000)),
+			StatusBlockTransaction, ErrorInsufficientBalance},
+		{"valid", newTestBlock(t, validator, genesisBlock, 10, newTestTransfer(t, sender, recipient, 0, 10)), StatusOK, nil},
+	} {
+		expectBlockError(t, test.name, blockchain.AppendBlock(test.block), test.status, test.expected)
+	}
+	expectState(t, blockchain, recipient, 10, 0)
+}
@@ -0,0 +1,87 @@
+package chain
+
+import (
+	"bytes"
+	"log"
+)
+
+// VerifyIntegrity walks all blocks of the main chain from the genesis block to the height. The genesis block must match
+// the genesis specification. Each other block must be stored and decodable at its height, reference the hash of the
+// previous block, match its Merkle root, the hash index must point to its height, and its undo record must be
+// decodable. A leftover undo record at the height marks a block whose append or rollback was interrupted, it is
+// reported and the block is reverted. It returns the height of the first bad block together with a *BlockError, or the
+// blockchain height and nil if all blocks are intact.
+func (blockchain *Blockchain) VerifyIntegrity() (height uint64, err error) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	if _, err = blockchain.undoPartialBlock(); err != nil {
+		return blockchain.height, &BlockError{Status: StatusCorruptBlock, Height: blockchain.height, Err: err}
+	}
+
+	previousHash := make([]byte, hashSize)
+	for height = 0; height < blockchain.height; height++ {
+		block, status := blockchain.getBlock(height)
+		if status != StatusOK {
+			return height, &BlockError{Status: status, Height: height, Err: ErrorBlockchainCorrupt}
+		}
+		if height == 0 {
+			if !bytes.Equal(block.Hash(), blockchain.genesisHash) {
+				return height, blockError(StatusBlockLinkage, block, ErrorGenesisMismatch)
+			}
+		} else if !bytes.Equal(block.PreviousHash, previousHash) {
+			return height, blockError(StatusBlockLinkage, block, ErrorBlockPrevious)
+		} else if !bytes.Equal(block.MerkleRoot, block.TransactionsRoot()) {
+			return height, blockError(StatusBlockMerkleRoot, block, ErrorBlockMerkleRoot)
+		}
+		previousHash = block.Hash()
+		if key, found := blockchain.database.Get(previousHash); !found || !bytes.Equal(key, keyBlock(height)) {
+			return height, blockError(StatusCorruptBlock, block, ErrorBlockchainCorrupt)
+		}
+		if height > 0 && blockchain.getUndo(height) == nil {
+			return height, blockError(StatusCorruptBlock, block, ErrorBlockchainCorrupt)
+		}
+	}
+	return height, nil
+}
+
+// Repair truncates the main chain to the height, the blocks from the height on are deleted. It is used to drop the
+// blocks from the first bad one reported by VerifyIntegrity on, which may not be decodable. The states are restored
+// from the undo records, which are checked before any block is deleted. The version is increased. The genesis block
+// cannot be repaired, a blockchain with a different genesis block belongs to another network.
+func (blockchain *Blockchain) Repair(height uint64) (err error) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	if height == 0 {
+		return ErrorGenesisMismatch
+	}
+	if height >= blockchain.height {
+		return ErrorBlockHeight
+	}
+
+	// the callback is invoked once for the whole repair
+	oldHeight, oldVersion := blockchain.height, blockchain.version
+	blockchain.reorganizing = true
+	defer blockchain.reorganized(oldHeight, oldVersion)
+
+	for top := height; top < blockchain.height; top++ {
+		if blockchain.getUndo(top) == nil {
+			return ErrorBlockchainCorrupt
+		}
+	}
+
+	// like a rollback the header is written first, an interrupted revert is completed by undoPartialBlock
+	for blockchain.height > height {
+		top := blockchain.height - 1
+		if err = blockchain.headerWrite(top, blockchain.version); err != nil {
+			return err
+		}
+		if err = blockchain.revertBlock(top); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Blockchain -> repaired, truncated from height %d to %d", oldHeight, height)
+	return blockchain.increaseVersion(VersionChangeRepair, oldHeight, height)
+}
@@ -0,0 +1,194 @@
+package chain
+
+import (
+	"blockchain/store"
+	"errors"
+	"testing"
+)
+
+// headerCrashStore fails writing the header, which simulates a crash right before the header is written.
+type headerCrashStore struct {
+	store.Store
+}
+
+func (database *headerCrashStore) Set(key []byte, data []byte) error {
+	if string(key) == keyHeader {
+		return errorTestCrash
+	}
+	return database.Store.Set(key, data)
+}
+
+// expectIntegrity fails if VerifyIntegrity does not return the height and status, StatusOK for no error.
+func expectIntegrity(t *testing.T, blockchain *Blockchain, expectedHeight uint64, expectedStatus int) {
+	t.Helper()
+	height, err := blockchain.VerifyIntegrity()
+	var blockErr *BlockError
+	switch {
+	case expectedStatus == StatusOK && err != nil:
+		t.Fatalf("error %v", err)
+	case expectedStatus != StatusOK && (!errors.As(err, &blockErr) || blockErr.Status != expectedStatus || blockErr.Height != expectedHeight):
+		t.Fatalf("error %v, expected status %d", err, expectedStatus)
+	case height != expectedHeight:
+		t.Fatalf("height %d, expected %d", height, expectedHeight)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+
+	blocks := []*Block{genesisBlock}
+	for height := uint64(1); height <= 5; height++ {
+		block := newTestBlock(t, validator, blocks[height-1], height*10, newTestTransfer(t, sender, recipient, height-1, 10))
+		if err := blockchain.AppendBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	expectIntegrity(t, blockchain, 6, StatusOK)
+
+	// an undecodable block is repaired by truncating the blockchain
+	data, _ := blockchain.database.Get(keyBlock(4))
+	blockchain.database.Set(keyBlock(4), data[:len(data)-1])
+	expectIntegrity(t, blockchain, 4, StatusCorruptBlock)
+	if err := blockchain.Repair(4); err != nil {
+		t.Fatal(err)
+	}
+	expectIntegrity(t, blockchain, 4, StatusOK)
+	expectState(t, blockchain, sender, 970, 3)
+	if changes := blockchain.VersionChanges(); len(changes) != 1 || changes[0].Reason != VersionChangeRepair || changes[0].OldHeight != 6 || changes[0].NewHeight != 4 {
+		t.Fatalf("version changes %+v", changes)
+	}
+
+	// a block with a wrong Merkle root, a broken linkage and a missing hash index
+	tampered := *blocks[3]
+	tampered.MerkleRoot = make([]byte, hashSize)
+	blockchain.database.Set(keyBlock(3), tampered.Encode())
+	expectIntegrity(t, blockchain, 3, StatusBlockMerkleRoot)
+	blockchain.database.Set(keyBlock(3), blocks[3].Encode())
+
+	unlinked := NewBlock(blocks[1].Hash(), 3, validator.PubKey(), nil)
+	blockchain.database.Set(keyBlock(3), unlinked.Encode())
+	expectIntegrity(t, blockchain, 3, StatusBlockLinkage)
+	blockchain.database.Set(keyBlock(3), blocks[3].Encode())
+
+	blockchain.database.Delete(blocks[2].Hash())
+	expectIntegrity(t, blockchain, 2, StatusCorruptBlock)
+	blockchain.database.Set(blocks[2].Hash(), keyBlock(2))
+	expectIntegrity(t, blockchain, 4, StatusOK)
+
+	// the genesis block must match the specification and cannot be repaired
+	foreign := NewBlock(nil, 0, nil, nil)
+	blockchain.database.Set(keyBlock(0), foreign.Encode())
+	expectIntegrity(t, blockchain, 0, StatusBlockLinkage)
+	if err := blockchain.Repair(0); err != ErrorGenesisMismatch {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestVerifyIntegrityPartialBlock(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+	database := blockchain.database
+
+	block := newTestBlock(t, validator, genesisBlock, 10, newTestTransfer(t, sender, recipient, 0, 10))
+	blockchain.database = &headerCrashStore{Store: database}
+	if err := blockchain.AppendBlock(block); !errors.Is(err, errorTestCrash) {
+		t.Fatalf("error %v", err)
+	}
+
+	// the restarted node finds the partially applied block and reverts it
+	restarted := &Blockchain{database: database, genesisHash: blockchain.genesisHash, chainID: testChainID, Mempool: NewMempool(testChainID), Schedule: blockchain.Schedule}
+	if _, err := restarted.headerRead(); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, restarted, sender, 990, 1)
+	expectIntegrity(t, restarted, 1, StatusOK)
+	expectState(t, restarted, sender, 1000, 0)
+	if _, found := database.Get(keyUndo(1)); found {
+		t.Fatal("undo record kept")
+	}
+	if err := restarted.AppendBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	expectIntegrity(t, restarted, 2, StatusOK)
+
+	// a leftover undo record that cannot be applied
+	database.Set(keyUndo(2), []byte{0, 0, 0, 1})
+	expectIntegrity(t, restarted, 2, StatusCorruptBlock)
+}
+
+func TestRepairCrash(t *testing.T) {
+	// crash after each write of the repair, until the repair completes
+	for writes := 0; ; writes++ {
+		validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+		blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+		database := blockchain.database
+
+		parent := genesisBlock
+		for height := uint64(1); height <= 4; height++ {
+			parent = newTestBlock(t, validator, parent, height*10, newTestTransfer(t, sender, recipient, height-1, 10))
+			addTestBlocks(t, blockchain, parent)
+		}
+
+		blockchain.database = &crashStore{Store: database, writes: writes}
+		if err := blockchain.Repair(2); err == nil {
+			if writes == 0 {
+				t.Fatal("no writes")
+			}
+			return
+		} else if !errors.Is(err, errorTestCrash) {
+			t.Fatalf("writes %d: error %v", writes, err)
+		}
+
+		// the restarted node completes the interrupted revert, the blocks below are intact
+		restarted := &Blockchain{database: database, genesisHash: blockchain.genesisHash, chainID: testChainID, Mempool: NewMempool(testChainID), Schedule: blockchain.Schedule}
+		if _, err := restarted.headerRead(); err != nil {
+			t.Fatalf("writes %d: error %v", writes, err)
+		}
+		height, err := restarted.VerifyIntegrity()
+		if err != nil || height < 2 || height > 5 {
+			t.Fatalf("writes %d: height %d error %v", writes, height, err)
+		}
+		expectState(t, restarted, sender, 1000-10*(height-1), height-1)
+
+		if height > 2 {
+			if err = restarted.Repair(2); err != nil {
+				t.Fatalf("writes %d: error %v", writes, err)
+			}
+		}
+		expectIntegrity(t, restarted, 2, StatusOK)
+		expectState(t, restarted, sender, 990, 1)
+		expectState(t, restarted, recipient, 10, 0)
+	}
+}
+
+func TestRepairCorruptUndo(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+	parent := genesisBlock
+	for height := uint64(1); height <= 4; height++ {
+		parent = newTestBlock(t, validator, parent, height*10, newTestTransfer(t, sender, recipient, height-1, 10))
+		addTestBlocks(t, blockchain, parent)
+	}
+
+	// the corrupt undo record is reported, a repair that needs it removes nothing
+	blockchain.database.Set(keyUndo(3), []byte{0, 0, 0, 1})
+	expectIntegrity(t, blockchain, 3, StatusCorruptBlock)
+	for _, height := range []uint64{2, 3} {
+		if err := blockchain.Repair(height); err != ErrorBlockchainCorrupt {
+			t.Fatalf("height %d: error %v", height, err)
+		}
+		if blockchain.Height() != 5 || blockchain.Version() != 0 {
+			t.Fatalf("height %d version %d", blockchain.Height(), blockchain.Version())
+		}
+		expectState(t, blockchain, sender, 960, 4)
+	}
+
+	// the blocks above it can be removed
+	if err := blockchain.Repair(4); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, blockchain, sender, 970, 3)
+	expectIntegrity(t, blockchain, 3, StatusCorruptBlock)
+}
@@ -0,0 +1,148 @@
+package chain
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// The version counts how often the history below the top block was rewritten: a reorganization that rolls back main
+// chain blocks, a reset to a lower height, or a repair that truncates corrupt blocks. Appending blocks does not change
+// it. Every change is logged under the prefix followed by the new version as 8 bytes big endian:
+//
+// Offset  Length  Content
+// 0       8       Timestamp of the change, unix time in milliseconds
+// 8       1       Reason, see VersionChangeX
+// 9       8       Height before the change
+// 17      8       Height after the change
+// 25      8       Fork height, the first height whose block was replaced or removed
+const (
+	keyVersionPrefix  = "version/"
+	versionChangeSize = 33
+)
+
+// VersionChangeX is the reason why the version was increased.
+const (
+	VersionChangeReorg  = 1 // Blocks were rolled back for a branch that won the fork choice
+	VersionChangeReset  = 2 // The blockchain was reset to a lower height
+	VersionChangeRepair = 3 // Corrupt blocks were truncated by a repair
+)
+
+// VersionChange is an entry of the version change log.
+type VersionChange struct {
+	Version    uint64 // Version after the change
+	Timestamp  uint64 // Unix time in milliseconds
+	Reason     uint8
+	OldHeight  uint64
+	NewHeight  uint64
+	ForkHeight uint64
+}
+
+func keyVersion(version uint64) []byte {
+	return append([]byte(keyVersionPrefix), keyBlock(version)...)
+}
+
+// ReasonText returns a readable reason.
+func (change *VersionChange) ReasonText() string {
+	switch change.Reason {
+	case VersionChangeReorg:
+		return "reorganization"
+	case VersionChangeReset:
+		return "reset"
+	case VersionChangeRepair:
+		return "repair"
+	}
+	return "unknown"
+}
+
+// PreferChain reports whether the chain announced by a peer should be synced: if it is longer, or has the same height
+// but a higher version. A higher version at the same height indicates that the peer rewrote its history and may be on
+// another branch; whether that branch is adopted is decided by the fork choice.
+func (blockchain *Blockchain) PreferChain(height, version uint64) bool {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+	return height > blockchain.height || height == blockchain.height && version > blockchain.version
+}
+
+// increaseVersion logs the change and writes the header with the next version. The blockchain must be locked.
+func (blockchain *Blockchain) increaseVersion(reason uint8, oldHeight, forkHeight uint64) error {
+	change := VersionChange{
+		Version:    blockchain.version + 1,
+		Timestamp:  uint64(time.Now().UnixMilli()),
+		Reason:     reason,
+		OldHeight:  oldHeight,
+		NewHeight:  blockchain.height,
+		ForkHeight: forkHeight,
+	}
+	var data [versionChangeSize]byte
+	binary.BigEndian.PutUint64(data[0:8], change.Timestamp)
+	data[8] = change.Reason
+	binary.BigEndian.PutUint64(data[9:17], change.OldHeight)
+	binary.BigEndian.PutUint64(data[17:25], change.NewHeight)
+	binary.BigEndian.PutUint64(data[25:33], change.ForkHeight)
+	if err := blockchain.database.Set(keyVersion(change.Version), data[:]); err != nil {
+		return err
+	}
+
+	log.Printf("Blockchain -> version %d by %s from fork height %d, height %d -> %d", change.Version, change.ReasonText(), forkHeight, oldHeight, blockchain.height)
+	return blockchain.headerWrite(blockchain.height, change.Version)
+}
+
+// VersionChanges returns the log of all version changes, oldest first.
+func (blockchain *Blockchain) VersionChanges() (changes []VersionChange) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	for version := uint64(1); version <= blockchain.version; version++ {
+		data, found := blockchain.database.Get(keyVersion(version))
+		if !found || len(data) != versionChangeSize {
+			continue
+		}
+		changes = append(changes, VersionChange{
+			Version:    version,
+			Timestamp:  binary.BigEndian.Uint64(data[0:8]),
+			Reason:     data[8],
+			OldHeight:  binary.BigEndian.Uint64(data[9:17]),
+			NewHeight:  binary.BigEndian.Uint64(data[17:25]),
+			ForkHeight: binary.BigEndian.Uint64(data[25:33]),
+		})
+	}
+	return changes
+}
+
+// Reset rolls back the main chain to the height, for example to return to a trusted checkpoint. The genesis block is
+// kept. The removed blocks are kept as side blocks and their transactions return to the mempool. The version is
+// increased.
+func (blockchain *Blockchain) Reset(height uint64) (err error) {
+	orphaned, err := blockchain.reset(height)
+
+	// the mempool validates the transactions against the blockchain, which must be unlocked
+	for _, transaction := range orphaned {
+		blockchain.Mempool.Add(transaction)
+	}
+	return err
+}
+
+func (blockchain *Blockchain) reset(height uint64) (orphaned []*Transaction, err error) {
+	blockchain.Lock()
+	defer blockchain.Unlock()
+
+	if height == 0 || height >= blockchain.height {
+		return nil, ErrorBlockHeight
+	}
+
+	// the callback is invoked once for the whole reset
+	oldHeight, oldVersion := blockchain.height, blockchain.version
+	blockchain.reorganizing = true
+	defer blockchain.reorganized(oldHeight, oldVersion)
+
+	var rolledBack []*Block // newest first
+	for blockchain.height > height {
+		block, err := blockchain.rollbackBlock()
+		if err != nil {
+			return nil, err
+		}
+		rolledBack = append(rolledBack, block)
+	}
+	return orphanedTransactions(rolledBack, nil), blockchain.increaseVersion(VersionChangeReset, oldHeight, height)
+}
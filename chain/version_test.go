@@ -0,0 +1,63 @@
+package chain
+
+import (
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	validator, sender, recipient := newTestKey(t), newTestKey(t), newTestKey(t)
+	blockchain, genesisBlock := newTestBlockchain(t, validator, testGenesisAccount(sender, 1000), testGenesisAccount(recipient, 0))
+
+	blocks := []*Block{genesisBlock}
+	for height := uint64(1); height <= 4; height++ {
+		block := newTestBlock(t, validator, blocks[height-1], height*10, newTestTransfer(t, sender, recipient, height-1, 10))
+		addTestBlocks(t, blockchain, block)
+		blocks = append(blocks, block)
+	}
+	var updates int
+	blockchain.BlockchainUpdate = func(blockchain *Blockchain, oldHeight, oldVersion, newHeight, newVersion uint64) {
+		if oldHeight != 5 || oldVersion != 0 || newHeight != 2 || newVersion != 1 {
+			t.Fatalf("update height %d -> %d, version %d -> %d", oldHeight, newHeight, oldVersion, newVersion)
+		}
+		updates++
+	}
+
+	// the genesis block is kept, the height must be lower
+	for _, height := range []uint64{0, 5, 6} {
+		if err := blockchain.Reset(height); err != ErrorBlockHeight {
+			t.Fatalf("height %d: error %v", height, err)
+		}
+	}
+
+	if err := blockchain.Reset(2); err != nil {
+		t.Fatal(err)
+	}
+	expectMainChain(t, blockchain, blocks[1])
+	expectState(t, blockchain, sender, 990, 1)
+	if blockchain.Version() != 1 || updates != 1 {
+		t.Fatalf("version %d updates %d", blockchain.Version(), updates)
+	}
+	changes := blockchain.VersionChanges()
+	if len(changes) != 1 || changes[0].Version != 1 || changes[0].Reason != VersionChangeReset || changes[0].ReasonText() != "reset" ||
+		changes[0].OldHeight != 5 || changes[0].NewHeight != 2 || changes[0].ForkHeight != 2 || changes[0].Timestamp == 0 {
+		t.Fatalf("version changes %+v", changes)
+	}
+
+	// the removed blocks are side blocks, their transactions are pending again
+	blockchain.Lock()
+	for _, block := range blocks[2:] {
+		if _, found := blockchain.getSideBlock(block.Hash()); !found {
+			blockchain.Unlock()
+			t.Fatalf("block %d is not a side block", block.Height)
+		}
+	}
+	blockchain.Unlock()
+	for _, block := range blocks[2:] {
+		if _, found := blockchain.Mempool.Get(block.Transactions[0].ID); !found {
+			t.Fatalf("transaction of block %d not pending", block.Height)
+		}
+	}
+	if height, err := blockchain.VerifyIntegrity(); err != nil || height != 2 {
+		t.Fatalf("height %d error %v", height, err)
+	}
+}
@@ -12,11 +12,15 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/gnet/v2/pkg/logging"
 )
 
+// sequence is shared by all clients since they use the same sender key. The node drops packets with reused sequences.
+var sequence uint32
+
 func logErr(err error) {
 	logging.Error(err)
 	if err != nil {
@@ -108,8 +112,9 @@ func batchSendAndRecv(c net.Conn, rd *bufio.Reader, packetSize, batch int) {
 			PublicKey:         SenderPublicKey,
 			BlockchainVersion: 1,
 			BlockchainHeight:  233,
+			ChainID:           1,
 		}
-		data, _ := codec.Encode(SenderPrivateKey, ReceiverPublicKey, network.EncodeAnnouncement(&node, 123))
+		data, _ := codec.Encode(SenderPrivateKey, ReceiverPublicKey, network.EncodeAnnouncement(&node, atomic.AddUint32(&sequence, 1)))
 		packetLen = len(data)
 		buf = append(buf, data...)
 	}
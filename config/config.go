@@ -7,20 +7,35 @@ import (
 	"os"
 )
 
-// peerSeed is a single peer entry from the config's seed list
-type peerSeed struct {
+// PeerSeed is a single peer entry from the config's seed list
+type PeerSeed struct {
 	PublicKey string   `yaml:"PublicKey"` // Public key = peer ID. Hex encoded.
 	Address   []string `yaml:"Address"`   // IP:Port
 }
 
 type Config struct {
 	PrivateKey string     `yaml:"PrivateKey"` // The Private Key, hex encoded so it can be copied manually
-	SeedList   []peerSeed `yaml:"SeedList"`   // Initial peer seed list
+	SeedList   []PeerSeed `yaml:"SeedList"`   // Initial peer seed list
+
+	LegacyPacketFormat bool `yaml:"LegacyPacketFormat"` // Accept packets in the legacy unauthenticated format (protocol version 1) during migration
+	MaxClockSkew       int  `yaml:"MaxClockSkew"`       // Tolerated difference in seconds between packet timestamps and the local clock. 0 = default.
+	PingInterval       int  `yaml:"PingInterval"`       // Interval in seconds between pings to connected peers. 0 = default.
+	PeerTimeout        int  `yaml:"PeerTimeout"`        // Peers silent for this many seconds are disconnected. 0 = default.
+
+	Genesis      string `yaml:"Genesis"`      // Genesis specification file. Empty = default genesis of the main network.
+	Validator    bool   `yaml:"Validator"`    // Produce blocks in the own slots. The own public key must be in the validator set.
+	SlotDuration int    `yaml:"SlotDuration"` // Duration of a block slot in seconds. 0 = default.
+
+	RepairBlockchain bool   `yaml:"RepairBlockchain"` // Truncate the blockchain to the last good block if the integrity check fails at startup
+	ResetHeight      uint64 `yaml:"ResetHeight"`      // Roll back the blockchain to this height at startup, for example a trusted checkpoint. 0 = disabled.
 }
 
 //go:embed "config.yaml"
 var ConfigDefault []byte
 
+//go:embed "genesis.yaml"
+var GenesisDefault []byte
+
 // LoadConfig reads the YAML configuration file and unmarshall it into the provided structure.
 // If the config file does not exist or is empty, it will fall back to the default config which is hardcoded.
 func LoadConfig(Filename string, ConfigOut interface{}) (status int, err error) {
@@ -44,3 +59,19 @@ func LoadConfig(Filename string, ConfigOut interface{}) (status int, err error)
 
 	return ExitSuccess, nil
 }
+
+// LoadGenesis reads the YAML genesis specification file and unmarshalls it into the provided structure. If no file is
+// provided, it falls back to the default genesis which is hardcoded. Unlike the config, a missing file is an error.
+func LoadGenesis(Filename string, GenesisOut interface{}) (status int, err error) {
+	genesisData := GenesisDefault
+	if Filename != "" {
+		if genesisData, err = ioutil.ReadFile(Filename); err != nil {
+			return ExitGenesisCorrupt, err
+		}
+	}
+
+	if err = yaml.Unmarshal(genesisData, GenesisOut); err != nil {
+		return ExitGenesisCorrupt, err
+	}
+	return ExitSuccess, nil
+}
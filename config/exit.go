@@ -9,4 +9,6 @@ const (
 	ExitPrivateKeyCorrupt = 4 // Private key is corrupt.
 	ExitPrivateKeyCreate  = 5 // Cannot create a new private key.
 	ExitBlockchainCorrupt = 6 // Blockchain is corrupt.
+	ExitValidatorsCorrupt = 7 // Validator set in the genesis specification is invalid.
+	ExitGenesisCorrupt    = 8 // Genesis specification cannot be read or is invalid.
 )
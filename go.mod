@@ -3,17 +3,20 @@ module blockchain
 go 1.18
 
 require (
-	github.com/akrylysov/pogreb v0.10.1 // indirect
-	github.com/btcsuite/btcd/btcec/v2 v2.2.0 // indirect
+	github.com/akrylysov/pogreb v0.10.1
+	github.com/btcsuite/btcd/btcec/v2 v2.2.0
+	github.com/panjf2000/gnet/v2 v2.0.3
+	golang.org/x/crypto v0.0.0-20220518034528-6f7dac969898
+	gopkg.in/yaml.v3 v3.0.0
+	lukechampine.com/blake3 v1.1.7
+)
+
+require (
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
-	github.com/panjf2000/gnet/v2 v2.0.3 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
 	go.uber.org/zap v1.21.0 // indirect
-	golang.org/x/crypto v0.0.0-20220518034528-6f7dac969898 // indirect
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0 // indirect
-	lukechampine.com/blake3 v1.1.7 // indirect
 )
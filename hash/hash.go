@@ -15,3 +15,10 @@ func HashData(data []byte) (hash []byte) {
 func PublicKey2NodeID(publicKey *btcec.PublicKey) (nodeID []byte) {
 	return HashData(publicKey.SerializeCompressed())
 }
+
+// DeriveKey derives a 32 bytes key from the key material using the blake3 KDF. The context must be hardcoded and unique per purpose.
+func DeriveKey(context string, material []byte) (key []byte) {
+	key = make([]byte, 32)
+	blake3.DeriveKey(key, context, material)
+	return key
+}
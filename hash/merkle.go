@@ -0,0 +1,112 @@
+package hash
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Merkle tree over a list of hashes. Leaves and inner nodes are hashed with different prefixes, so an inner node cannot
+// be presented as a leaf:
+//
+//	leaf  = blake3(0x00 || data)
+//	inner = blake3(0x01 || left || right)
+//
+// A node without sibling at the end of a level is moved up unchanged instead of being duplicated, therefore different
+// lists of leaves cannot have the same root. The root of an empty list is the hash of no data.
+const (
+	merkleLeafPrefix  = 0x00
+	merkleInnerPrefix = 0x01
+)
+
+var ErrorMerkleIndex = errors.New("MERKLE PROOF INDEX OUT OF RANGE")
+
+// MerkleProof proves that a leaf is part of the tree at the index.
+type MerkleProof struct {
+	Index  int      // Index of the leaf
+	Count  int      // Count of leaves in the tree
+	Hashes [][]byte // Siblings from the leaf level up to the root. Levels where the node has no sibling are skipped.
+}
+
+func merkleLeaf(data []byte) []byte {
+	return HashData(append([]byte{merkleLeafPrefix}, data...))
+}
+
+func merkleInner(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(append(append(data, merkleInnerPrefix), left...), right...)
+	return HashData(data)
+}
+
+// merkleLevel returns the next level up.
+func merkleLevel(level [][]byte) (next [][]byte) {
+	next = make([][]byte, 0, (len(level)+1)/2)
+	for n := 0; n < len(level); n += 2 {
+		if n+1 == len(level) {
+			next = append(next, level[n])
+		} else {
+			next = append(next, merkleInner(level[n], level[n+1]))
+		}
+	}
+	return next
+}
+
+func merkleLeaves(leaves [][]byte) (level [][]byte) {
+	level = make([][]byte, len(leaves))
+	for n, leaf := range leaves {
+		level[n] = merkleLeaf(leaf)
+	}
+	return level
+}
+
+// MerkleRoot returns the root of the tree over the leaves.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return HashData(nil)
+	}
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+// MerkleProve returns the proof for the leaf at the index.
+func MerkleProve(leaves [][]byte, index int) (proof *MerkleProof, err error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, ErrorMerkleIndex
+	}
+	proof = &MerkleProof{Index: index, Count: len(leaves)}
+	level := merkleLeaves(leaves)
+	for position := index; len(level) > 1; position /= 2 {
+		if sibling := position ^ 1; sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, level[sibling])
+		}
+		level = merkleLevel(level)
+	}
+	return proof, nil
+}
+
+// MerkleVerify checks that the proof connects the leaf to the root.
+func MerkleVerify(root, leaf []byte, proof *MerkleProof) bool {
+	if proof == nil || proof.Index < 0 || proof.Index >= proof.Count {
+		return false
+	}
+	node := merkleLeaf(leaf)
+	next := 0
+	for position, count := proof.Index, proof.Count; count > 1; position, count = position/2, (count+1)/2 {
+		sibling := position ^ 1
+		if sibling >= count {
+			continue
+		}
+		if next >= len(proof.Hashes) {
+			return false
+		}
+		if sibling < position {
+			node = merkleInner(proof.Hashes[next], node)
+		} else {
+			node = merkleInner(node, proof.Hashes[next])
+		}
+		next++
+	}
+	return next == len(proof.Hashes) && bytes.Equal(node, root)
+}
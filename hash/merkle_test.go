@@ -0,0 +1,116 @@
+package hash
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testLeaves(count int) (leaves [][]byte) {
+	for n := 0; n < count; n++ {
+		leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", n)))
+	}
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := testLeaves(8)
+	a, b, c, d, e := merkleLeaf(leaves[0]), merkleLeaf(leaves[1]), merkleLeaf(leaves[2]), merkleLeaf(leaves[3]), merkleLeaf(leaves[4])
+	f, g, h := merkleLeaf(leaves[5]), merkleLeaf(leaves[6]), merkleLeaf(leaves[7])
+
+	// the node without sibling is moved up unchanged
+	for _, test := range []struct {
+		count int
+		root  []byte
+	}{
+		{0, HashData(nil)},
+		{1, a},
+		{2, merkleInner(a, b)},
+		{3, merkleInner(merkleInner(a, b), c)},
+		{5, merkleInner(merkleInner(merkleInner(a, b), merkleInner(c, d)), e)},
+		{8, merkleInner(merkleInner(merkleInner(a, b), merkleInner(c, d)), merkleInner(merkleInner(e, f), merkleInner(g, h)))},
+	} {
+		if root := MerkleRoot(leaves[:test.count]); !bytes.Equal(root, test.root) {
+			t.Errorf("count %d: root %x, expected %x", test.count, root, test.root)
+		}
+	}
+
+	// a single leaf is not its own root, and a duplicated last leaf changes the root
+	if bytes.Equal(MerkleRoot(leaves[:1]), HashData(leaves[0])) {
+		t.Error("leaf is not prefixed")
+	}
+	duplicated := append(append([][]byte{}, leaves[:3]...), leaves[2])
+	if bytes.Equal(MerkleRoot(leaves[:3]), MerkleRoot(duplicated)) {
+		t.Error("[a,b,c] and [a,b,c,c] have the same root")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 5, 8} {
+		leaves := testLeaves(count)
+		root := MerkleRoot(leaves)
+		for index := range leaves {
+			proof, err := MerkleProve(leaves, index)
+			if err != nil {
+				t.Fatalf("count %d index %d: %v", count, index, err)
+			}
+			if proof.Index != index || proof.Count != count {
+				t.Fatalf("count %d index %d: proof %+v", count, index, proof)
+			}
+			if !MerkleVerify(root, leaves[index], proof) {
+				t.Fatalf("count %d index %d: proof rejected", count, index)
+			}
+
+			// another leaf, another root, a tampered hash and another index
+			if MerkleVerify(root, []byte("other"), proof) {
+				t.Errorf("count %d index %d: other leaf accepted", count, index)
+			}
+			if MerkleVerify(MerkleRoot(testLeaves(count+1)), leaves[index], proof) {
+				t.Errorf("count %d index %d: other root accepted", count, index)
+			}
+			for n := range proof.Hashes {
+				tampered := *proof
+				tampered.Hashes = append([][]byte{}, proof.Hashes...)
+				tampered.Hashes[n] = HashData(proof.Hashes[n])
+				if MerkleVerify(root, leaves[index], &tampered) {
+					t.Errorf("count %d index %d: tampered hash %d accepted", count, index, n)
+				}
+			}
+			for _, wrongIndex := range []int{index - 1, index + 1} {
+				wrong := *proof
+				wrong.Index = wrongIndex
+				if MerkleVerify(root, leaves[index], &wrong) {
+					t.Errorf("count %d index %d: accepted at index %d", count, index, wrongIndex)
+				}
+			}
+		}
+	}
+
+	// the count determines at which levels a sibling is expected
+	leaves := testLeaves(5)
+	proof, _ := MerkleProve(leaves, 4)
+	for _, count := range []int{4, 6, 7, 0} {
+		wrong := *proof
+		wrong.Count = count
+		if MerkleVerify(MerkleRoot(leaves), leaves[4], &wrong) {
+			t.Errorf("accepted with count %d", count)
+		}
+	}
+	proof, _ = MerkleProve(leaves[:3], 2)
+	proof.Count = 4
+	if MerkleVerify(MerkleRoot(leaves[:3]), leaves[2], proof) {
+		t.Error("accepted with count 4")
+	}
+
+	for _, index := range []int{-1, 5} {
+		if _, err := MerkleProve(leaves, index); err != ErrorMerkleIndex {
+			t.Errorf("index %d: error %v", index, err)
+		}
+	}
+	if _, err := MerkleProve(nil, 0); err != ErrorMerkleIndex {
+		t.Errorf("empty tree: error %v", err)
+	}
+	if MerkleVerify(MerkleRoot(leaves), leaves[0], nil) {
+		t.Error("nil proof accepted")
+	}
+}
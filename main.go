@@ -29,14 +29,47 @@ func main() {
 
 	PrivateKey, PublicKey := btcec.PrivKeyFromBytes(configPK)
 	// BlockChain
-	_, err = chain.BootStrap()
+	genesis := new(chain.Genesis)
+	if status, err := config.LoadGenesis(nodeConfig.Genesis, genesis); status != config.ExitSuccess {
+		log.Printf("Init: unable to load genesis file: status = %d, error = %v", status, err)
+		os.Exit(status)
+	}
+	if _, err := genesis.Encode(); err != nil {
+		log.Printf("Init: genesis specification is invalid: %s", err.Error())
+		os.Exit(config.ExitGenesisCorrupt)
+	}
+	blockchain, err := chain.BootStrap(genesis)
 	if err != nil {
 		log.Printf("main -> error: %s", err.Error())
 		os.Exit(config.ExitBlockchainCorrupt)
 	}
+	if height, err := blockchain.VerifyIntegrity(); err != nil {
+		log.Printf("main -> blockchain integrity check failed at height %d: %s", height, err.Error())
+		if !nodeConfig.RepairBlockchain {
+			os.Exit(config.ExitBlockchainCorrupt)
+		}
+		if err = blockchain.Repair(height); err != nil {
+			log.Printf("main -> blockchain repair failed: %s", err.Error())
+			os.Exit(config.ExitBlockchainCorrupt)
+		}
+	}
+	if nodeConfig.ResetHeight > 0 && nodeConfig.ResetHeight < blockchain.Height() {
+		if err = blockchain.Reset(nodeConfig.ResetHeight); err != nil {
+			log.Printf("main -> blockchain reset to height %d failed: %s", nodeConfig.ResetHeight, err.Error())
+			os.Exit(config.ExitBlockchainCorrupt)
+		}
+	}
+	for _, change := range blockchain.VersionChanges() {
+		log.Printf("main -> blockchain version %d by %s at %s, height %d -> %d, fork height %d", change.Version, change.ReasonText(),
+			time.UnixMilli(int64(change.Timestamp)).Format(time.RFC3339), change.OldHeight, change.NewHeight, change.ForkHeight)
+	}
+	if blockchain.Schedule, err = chain.NewSchedule(genesis.Validators, time.Duration(nodeConfig.SlotDuration)*time.Second); err != nil {
+		log.Printf("main -> validator set error: %s", err.Error())
+		os.Exit(config.ExitValidatorsCorrupt)
+	}
 
 	// Network
-	network.BootStrap(PrivateKey, PublicKey)
+	network.BootStrap(nodeConfig, blockchain, PrivateKey, PublicKey)
 
 	for {
 		time.Sleep(1e8)
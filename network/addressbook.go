@@ -0,0 +1,327 @@
+package network
+
+import (
+	"blockchain/hash"
+	"blockchain/store"
+	"bytes"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	addressBookSize   = 1000                // Maximum count of nodes in the address book
+	addressBookExpire = 14 * 24 * time.Hour // Entries without successful connection for this duration are deleted
+	addressBookRecent = 24 * time.Hour      // Entries connected within this duration are dialed before the seeds
+	addressBookPrune  = time.Minute         // Interval for deleting expired entries
+)
+
+// AddressEntry is a node known from peer exchange or from a connection.
+type AddressEntry struct {
+	NodeID      []byte
+	PublicKey   *btcec.PublicKey
+	Features    uint8
+	Addresses   []string // IP:Port
+	Added       time.Time
+	LastSuccess time.Time // Latest authenticated outbound connection
+	LastFailure time.Time // Latest failed dial attempt
+	Successes   uint32
+	Failures    uint32
+
+	failures    int // Consecutive failures for the backoff, not persisted
+	nextAttempt time.Time
+}
+
+// Score returns the reliability of the node between 0 and 1, the ratio of successful connection attempts. Unknown nodes
+// have a score of 0.5.
+func (entry *AddressEntry) Score() float64 {
+	return float64(entry.Successes+1) / float64(entry.Successes+entry.Failures+2)
+}
+
+// expiration returns the time when the entry is deleted from the store.
+func (entry *AddressEntry) expiration() time.Time {
+	if entry.LastSuccess.After(entry.Added) {
+		return entry.LastSuccess.Add(addressBookExpire)
+	}
+	return entry.Added.Add(addressBookExpire)
+}
+
+// AddressBook holds the nodes that the dialer may connect to, by node ID. Entries are persisted in the store and expire
+// if the node cannot be connected for a long time.
+type AddressBook struct {
+	self    []byte
+	store   store.Store
+	entries map[string]*AddressEntry
+	mutex   sync.RWMutex
+
+	lastExpire time.Time // accessed only from OnTick
+}
+
+// NewAddressBook creates the address book and loads the entries from the store. The own node ID is never added.
+func NewAddressBook(self []byte, store store.Store) (book *AddressBook) {
+	book = &AddressBook{self: self, store: store, entries: make(map[string]*AddressEntry), lastExpire: time.Now()}
+
+	store.ExpireKeys()
+	store.Iterate(func(key, value []byte) {
+		entry, err := decodeAddressEntry(value)
+		if err != nil || !bytes.Equal(key, entry.NodeID) || bytes.Equal(key, self) {
+			log.Printf("AddressBook -> deleting invalid entry %X", key)
+			store.Delete(key)
+			return
+		}
+		book.entries[string(key)] = entry
+	})
+
+	log.Printf("AddressBook -> loaded %d nodes", len(book.entries))
+	return book
+}
+
+// Add inserts the node or merges the addresses into the existing entry. Invalid addresses are dropped, nodes without
+// valid addresses are ignored. If the book is full the entry with the lowest score is replaced.
+func (book *AddressBook) Add(publicKey *btcec.PublicKey, features uint8, addresses []string) (added bool) {
+	var valid []string
+	for _, address := range addresses {
+		if validAddress(address) {
+			valid = append(valid, address)
+		}
+	}
+	nodeID := hash.PublicKey2NodeID(publicKey)
+	if len(valid) == 0 || bytes.Equal(nodeID, book.self) {
+		return false
+	}
+
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+
+	if entry := book.entries[string(nodeID)]; entry != nil {
+		changed := entry.Features != features
+		entry.Features = features
+		for _, address := range valid {
+			known := false
+			for _, existing := range entry.Addresses {
+				known = known || existing == address
+			}
+			if !known {
+				entry.Addresses = append(entry.Addresses, address)
+				changed = true
+			}
+		}
+		if changed {
+			book.persist(entry)
+		}
+		return false
+	}
+
+	if len(book.entries) >= addressBookSize && !book.evict() {
+		return false
+	}
+	entry := &AddressEntry{NodeID: nodeID, PublicKey: publicKey, Features: features, Addresses: valid, Added: time.Now()}
+	book.entries[string(nodeID)] = entry
+	book.persist(entry)
+	return true
+}
+
+// evict removes the entry with the lowest score. Entries without failures are kept. The mutex must be locked.
+func (book *AddressBook) evict() bool {
+	var worst *AddressEntry
+	for _, entry := range book.entries {
+		if entry.Failures > 0 && (worst == nil || entry.Score() < worst.Score()) {
+			worst = entry
+		}
+	}
+	if worst == nil {
+		return false
+	}
+	delete(book.entries, string(worst.NodeID))
+	book.store.Delete(worst.NodeID)
+	return true
+}
+
+// persist writes the entry to the store. The mutex must be locked.
+func (book *AddressBook) persist(entry *AddressEntry) {
+	if err := book.store.StoreExpire(entry.NodeID, encodeAddressEntry(entry), entry.expiration()); err != nil {
+		log.Printf("AddressBook -> storing %X failed %v", entry.NodeID, err)
+	}
+}
+
+// Entries returns a copy of all entries.
+func (book *AddressBook) Entries() (list []AddressEntry) {
+	book.mutex.RLock()
+	defer book.mutex.RUnlock()
+	for _, entry := range book.entries {
+		list = append(list, *entry)
+	}
+	return list
+}
+
+// Count returns the count of entries.
+func (book *AddressBook) Count() int {
+	book.mutex.RLock()
+	defer book.mutex.RUnlock()
+	return len(book.entries)
+}
+
+// hasRecent reports whether any node was connected successfully within addressBookRecent.
+func (book *AddressBook) hasRecent() bool {
+	book.mutex.RLock()
+	defer book.mutex.RUnlock()
+	for _, entry := range book.entries {
+		if time.Since(entry.LastSuccess) < addressBookRecent {
+			return true
+		}
+	}
+	return false
+}
+
+// isRecent reports whether the node was connected successfully within addressBookRecent.
+func (book *AddressBook) isRecent(nodeID []byte) bool {
+	book.mutex.RLock()
+	defer book.mutex.RUnlock()
+	entry := book.entries[string(nodeID)]
+	return entry != nil && time.Since(entry.LastSuccess) < addressBookRecent
+}
+
+// due returns copies of the entries whose next dial attempt is due. Recently successful and reliable nodes come first.
+func (book *AddressBook) due(now time.Time) (list []*AddressEntry) {
+	book.mutex.RLock()
+	for _, entry := range book.entries {
+		if !now.Before(entry.nextAttempt) {
+			copied := *entry
+			copied.Addresses = append([]string{}, entry.Addresses...)
+			list = append(list, &copied)
+		}
+	}
+	book.mutex.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		recentI, recentJ := now.Sub(list[i].LastSuccess) < addressBookRecent, now.Sub(list[j].LastSuccess) < addressBookRecent
+		if recentI != recentJ {
+			return recentI
+		}
+		return list[i].Score() > list[j].Score()
+	})
+	return list
+}
+
+// failed records the failure and schedules the next attempt to the node with exponential backoff.
+func (book *AddressBook) failed(nodeID []byte) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	if entry := book.entries[string(nodeID)]; entry != nil {
+		backoff := dialBackoffMin << entry.failures
+		if backoff > dialBackoffMax || backoff <= 0 {
+			backoff = dialBackoffMax
+		} else {
+			entry.failures++
+		}
+		entry.nextAttempt = time.Now().Add(backoff)
+		entry.LastFailure = time.Now()
+		entry.Failures++
+		book.persist(entry)
+	}
+}
+
+// succeeded records the success and resets the backoff of the node.
+func (book *AddressBook) succeeded(nodeID []byte) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	if entry := book.entries[string(nodeID)]; entry != nil {
+		entry.failures = 0
+		entry.nextAttempt = time.Time{}
+		entry.LastSuccess = time.Now()
+		entry.Successes++
+		book.persist(entry)
+	}
+}
+
+// maintain removes the expired entries from memory and from the store. It is called from OnTick.
+func (book *AddressBook) maintain() {
+	now := time.Now()
+	if now.Sub(book.lastExpire) < addressBookPrune {
+		return
+	}
+	book.lastExpire = now
+
+	book.mutex.Lock()
+	for key, entry := range book.entries {
+		if now.After(entry.expiration()) {
+			delete(book.entries, key)
+		}
+	}
+	book.mutex.Unlock()
+
+	go book.store.ExpireKeys()
+}
+
+const addressEntryAddressesOffset = publicKeySize + 1 + 3*8 + 2*4
+
+// encodeAddressEntry encodes the entry for the store:
+// public key (33), features (1), added, last success, last failure (8 each, unix seconds), successes, failures (4 each),
+// count of addresses (1) and the addresses, each prefixed by its length (1).
+func encodeAddressEntry(entry *AddressEntry) (data []byte) {
+	data = make([]byte, addressEntryAddressesOffset)
+	copy(data[0:publicKeySize], entry.PublicKey.SerializeCompressed())
+	data[publicKeySize] = entry.Features
+	offset := publicKeySize + 1
+	binary.BigEndian.PutUint64(data[offset:offset+8], uint64(unixOrZero(entry.Added)))
+	binary.BigEndian.PutUint64(data[offset+8:offset+16], uint64(unixOrZero(entry.LastSuccess)))
+	binary.BigEndian.PutUint64(data[offset+16:offset+24], uint64(unixOrZero(entry.LastFailure)))
+	binary.BigEndian.PutUint32(data[offset+24:offset+28], entry.Successes)
+	binary.BigEndian.PutUint32(data[offset+28:offset+32], entry.Failures)
+	return encodeAddresses(data, entry.Addresses)
+}
+
+func decodeAddressEntry(data []byte) (entry *AddressEntry, err error) {
+	if len(data) < addressEntryAddressesOffset+1 {
+		return nil, ErrorPayloadMalformed
+	}
+	publicKey, err := btcec.ParsePubKey(data[0:publicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	offset := publicKeySize + 1
+	entry = &AddressEntry{
+		NodeID:      hash.PublicKey2NodeID(publicKey),
+		PublicKey:   publicKey,
+		Features:    data[publicKeySize],
+		Added:       timeOrZero(binary.BigEndian.Uint64(data[offset : offset+8])),
+		LastSuccess: timeOrZero(binary.BigEndian.Uint64(data[offset+8 : offset+16])),
+		LastFailure: timeOrZero(binary.BigEndian.Uint64(data[offset+16 : offset+24])),
+		Successes:   binary.BigEndian.Uint32(data[offset+24 : offset+28]),
+		Failures:    binary.BigEndian.Uint32(data[offset+28 : offset+32]),
+	}
+	if entry.Addresses, _, err = decodeAddresses(data, addressEntryAddressesOffset); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix uint64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(unix), 0)
+}
+
+// validAddress checks that the address is an IP with a port.
+func validAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	portN, err := strconv.Atoi(port)
+	return ip != nil && !ip.IsUnspecified() && !ip.IsMulticast() && err == nil && portN > 0 && portN <= 65535
+}
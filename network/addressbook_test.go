@@ -0,0 +1,143 @@
+package network
+
+import (
+	"blockchain/hash"
+	"blockchain/store"
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestAddressEntryRoundtrip(t *testing.T) {
+	publicKey := newTestKey(t).PubKey()
+	now := time.Unix(time.Now().Unix(), 0)
+	for _, entry := range []*AddressEntry{
+		{PublicKey: publicKey, Features: 3, Addresses: []string{"10.0.0.1:1000", "[2001:db8::1]:1000"}, Added: now,
+			LastSuccess: now.Add(time.Second), LastFailure: now.Add(2 * time.Second), Successes: 4, Failures: 5},
+		{PublicKey: publicKey, Added: now},
+	} {
+		data := encodeAddressEntry(entry)
+		decoded, err := decodeAddressEntry(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.PublicKey.IsEqual(publicKey) || !bytes.Equal(decoded.NodeID, hash.PublicKey2NodeID(publicKey)) ||
+			decoded.Features != entry.Features || fmt.Sprint(decoded.Addresses) != fmt.Sprint(entry.Addresses) ||
+			!decoded.Added.Equal(entry.Added) || !decoded.LastSuccess.Equal(entry.LastSuccess) ||
+			!decoded.LastFailure.Equal(entry.LastFailure) || decoded.Successes != entry.Successes || decoded.Failures != entry.Failures {
+			t.Fatalf("decoded %+v, expected %+v", decoded, entry)
+		}
+
+		// truncated data is malformed
+		for length := 0; length < len(data); length++ {
+			if _, err = decodeAddressEntry(data[:length]); err == nil {
+				t.Fatalf("length %d decoded", length)
+			}
+		}
+	}
+}
+
+func TestValidAddress(t *testing.T) {
+	for address, valid := range map[string]bool{
+		"10.0.0.1:1000":      true,
+		"[2001:db8::1]:1000": true,
+		"10.0.0.1":           false,
+		"10.0.0.1:0":         false,
+		"10.0.0.1:65536":     false,
+		"0.0.0.0:1000":       false,
+		"224.0.0.1:1000":     false,
+		"example.com:1000":   false,
+	} {
+		if validAddress(address) != valid {
+			t.Errorf("address %s valid %t", address, !valid)
+		}
+	}
+}
+
+func TestAddressBookPersist(t *testing.T) {
+	self, first, second := newTestKey(t), newTestKey(t), newTestKey(t)
+	database, err := store.NewPogrebStore(t.TempDir() + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := NewAddressBook(hash.PublicKey2NodeID(self.PubKey()), database)
+
+	// the own node and nodes without valid addresses are not added, known nodes are merged
+	for _, test := range []struct {
+		name      string
+		added     bool
+		publicKey *btcec.PublicKey
+		addresses []string
+	}{
+		{"own node", false, self.PubKey(), []string{"10.0.0.1:1000"}},
+		{"invalid address", false, first.PubKey(), []string{"10.0.0.1"}},
+		{"new node", true, first.PubKey(), []string{"10.0.0.1:1000", "10.0.0.1"}},
+		{"known node", false, first.PubKey(), []string{"10.0.0.2:1000", "10.0.0.1:1000"}},
+		{"second node", true, second.PubKey(), []string{"10.0.0.3:1000"}},
+	} {
+		if added := book.Add(test.publicKey, 1, test.addresses); added != test.added {
+			t.Fatalf("%s: added %t", test.name, added)
+		}
+	}
+	book.succeeded(hash.PublicKey2NodeID(first.PubKey()))
+	book.failed(hash.PublicKey2NodeID(second.PubKey()))
+
+	// an entry stored under another node ID is deleted on load
+	if err = database.Set(hash.PublicKey2NodeID(newTestKey(t).PubKey()), encodeAddressEntry(&AddressEntry{PublicKey: first.PubKey()})); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewAddressBook(hash.PublicKey2NodeID(self.PubKey()), database)
+	if loaded.Count() != 2 {
+		t.Fatalf("%d entries", loaded.Count())
+	}
+	for _, entry := range loaded.Entries() {
+		switch {
+		case entry.PublicKey.IsEqual(first.PubKey()):
+			if fmt.Sprint(entry.Addresses) != "[10.0.0.1:1000 10.0.0.2:1000]" || entry.Successes != 1 || entry.LastSuccess.IsZero() ||
+				!loaded.isRecent(entry.NodeID) {
+				t.Fatalf("first entry %+v", entry)
+			}
+		case entry.PublicKey.IsEqual(second.PubKey()):
+			if entry.Failures != 1 || entry.LastFailure.IsZero() || loaded.isRecent(entry.NodeID) {
+				t.Fatalf("second entry %+v", entry)
+			}
+		default:
+			t.Fatalf("entry %X", entry.NodeID)
+		}
+	}
+	if !loaded.hasRecent() || database.Count() != 2 {
+		t.Fatalf("%d stored entries", database.Count())
+	}
+}
+
+func TestAddressBookDue(t *testing.T) {
+	self := newTestKey(t)
+	database, err := store.NewPogrebStore(t.TempDir() + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := NewAddressBook(hash.PublicKey2NodeID(self.PubKey()), database)
+	var nodeIDs [][]byte
+	for n := 0; n < 4; n++ {
+		publicKey := newTestKey(t).PubKey()
+		book.Add(publicKey, 0, []string{fmt.Sprintf("10.0.0.%d:1000", n)})
+		nodeIDs = append(nodeIDs, hash.PublicKey2NodeID(publicKey))
+	}
+
+	// the failed node waits for its backoff, the recently connected one comes first, then by score
+	book.failed(nodeIDs[0])
+	book.succeeded(nodeIDs[1])
+	book.entries[string(nodeIDs[2])].Successes = 3
+	book.entries[string(nodeIDs[2])].Failures = 1
+	book.entries[string(nodeIDs[3])].Failures = 1
+	due := book.due(time.Now())
+	if len(due) != 3 || !bytes.Equal(due[0].NodeID, nodeIDs[1]) || !bytes.Equal(due[1].NodeID, nodeIDs[2]) || !bytes.Equal(due[2].NodeID, nodeIDs[3]) {
+		t.Fatalf("%d due entries", len(due))
+	}
+	if due = book.due(time.Now().Add(dialBackoffMin)); len(due) != 4 {
+		t.Fatalf("%d due entries after the backoff", len(due))
+	}
+}
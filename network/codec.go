@@ -3,54 +3,87 @@ package network
 import (
 	"blockchain/hash"
 	"bytes"
+	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
-	"golang.org/x/crypto/salsa20"
+	"golang.org/x/crypto/chacha20poly1305"
 	"log"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ErrorIncompletePacket = errors.New("INCOMPLETE PACKET")
+var ErrorProtocolVersion = errors.New("UNSUPPORTED PROTOCOL VERSION")
+var ErrorSenderMismatch = errors.New("SIGNATURE DOES NOT MATCH SENDER PUBLIC KEY")
+var ErrorPayloadLength = errors.New("INVALID PAYLOAD LENGTH")
+var ErrorFrameLength = errors.New("INVALID FRAME LENGTH")
 
 /*
 Offset  Size   Info
 0		2	   Magic Number
-2       4      Nonce
-6       1      Protocol version = 0
-7       1      Command
-8       4      Sequence
-12      2      Size of payload data
-14      ?      Payload
-        ?      Randomized garbage
-?		65     Signature, ECDSA secp256k1 512-bit + 1 header byte
+2       4      Frame length, the total length of the packet including header, tag and garbage
+6       1      Protocol version = 2, not encrypted
+7       33     Sender public key, compressed, not encrypted
+40      24     Nonce, random
+64      ?      Body encrypted with XChaCha20-Poly1305, the header [0:64] is authenticated as additional data
+?       16     Poly1305 tag
+
+The decrypted body:
+0       1      Command
+1       4      Sequence
+5       8      Timestamp, unix time in milliseconds
+13      2      Size of payload data
+15      ?      Payload
+?       ?      Randomized garbage
+?		65     Signature, ECDSA secp256k1 512-bit + 1 header byte, over header and body
 */
 const (
 	magicNumberSize     = 2
-	nonceSize           = 4
+	frameLengthSize     = 4
 	protocolVersionSize = 1
-	commandSize         = 1
-	sequenceSize        = 4
-	payloadLengthSize   = 2
+	publicKeySize       = 33
+	nonceSize           = chacha20poly1305.NonceSizeX
 	signatureSize       = 65
+	tagSize             = chacha20poly1305.Overhead
 
 	magicNumberOffset     = 0
-	nonceOffset           = magicNumberOffset + magicNumberSize
-	protocolVersionOffset = nonceOffset + nonceSize
-	commandOffset         = protocolVersionOffset + protocolVersionSize
-	sequenceOffset        = commandOffset + commandSize
-	payloadLengthOffset   = sequenceOffset + sequenceSize
-	payloadOffset         = payloadLengthOffset + payloadLengthSize
+	frameLengthOffset     = magicNumberOffset + magicNumberSize
+	protocolVersionOffset = frameLengthOffset + frameLengthSize
+	publicKeyOffset       = protocolVersionOffset + protocolVersionSize
+	nonceOffset           = publicKeyOffset + publicKeySize
+	bodyOffset            = nonceOffset + nonceSize
+
+	// offsets within the decrypted body. The legacy body has no timestamp.
+	bodyCommandOffset       = 0
+	bodySequenceOffset      = bodyCommandOffset + 1
+	bodyTimestampOffset     = bodySequenceOffset + 4
+	bodyPayloadLengthOffset = bodyTimestampOffset + 8
+	bodyPayloadOffset       = bodyPayloadLengthOffset + 2
 
 	magicNumber   = 0x2424
 	maxBodyLength = 1030
 )
-const PacketLengthMin = payloadOffset + signatureSize
+const PacketLengthMin = legacyPacketLengthMin
+const packetLengthMinAEAD = bodyOffset + bodyPayloadOffset + signatureSize + tagSize
+const packetLengthMaxAEAD = packetLengthMinAEAD + maxBodyLength + maxRandomGarbage
 const maxRandomGarbage = 20
 
+// Protocol versions are written in clear into the header at protocolVersionOffset.
+// Version 0 used the receivers public key as Salsa20 key and encrypted the version byte, it is not supported anymore.
+// Version 1 uses Salsa20 without authentication and is only accepted if the codec allows legacy packets.
+const (
+	ProtocolVersionLegacy = 1
+	ProtocolVersion       = 2
+)
+
+// sessionKeyContext is the blake3 KDF context used to derive the XChaCha20-Poly1305 key from the ECDH shared secret.
+const sessionKeyContext = "blockchain 2022-06-08 p2p packet session key v2"
+
 var magicNumberBytes []byte
 
 func init() {
@@ -58,129 +91,247 @@ func init() {
 	binary.BigEndian.PutUint16(magicNumberBytes, uint16(magicNumber))
 }
 
+// Codec encodes and decodes packets. It caches the session keys derived per remote public key, therefore a codec
+// must always be used with the same local private key.
 type Codec struct {
+	AllowLegacy bool // Accept packets in the legacy format. Replies use the format of the last received packet.
+
+	legacyPeer  int32 // 1 if the last packet of the remote peer was a legacy packet, accessed atomically
+	sessionKeys map[string]*[32]byte
+	keysMutex   sync.Mutex
 }
 
 // Encode encrypts a packet using the provided senders private key and receivers compressed public key.
-func (codec Codec) Encode(senderPrivateKey *btcec.PrivateKey, receiverPublicKey *btcec.PublicKey, packet *PacketBody) ([]byte, error) {
-	garbage := packetGarbage(maxRandomGarbage)
-	log.Printf("Encode -> garbage: %x", garbage)
-
-	data := make([]byte, PacketLengthMin+len(packet.Payload)+len(garbage))
-
-	// add magic number and nonce to header
-	binary.BigEndian.PutUint16(data[magicNumberOffset:nonceOffset], magicNumber)
-	log.Printf("Encode -> magic number: %x", data[magicNumberOffset:nonceOffset])
+func (codec *Codec) Encode(senderPrivateKey *btcec.PrivateKey, receiverPublicKey *btcec.PublicKey, packet *PacketBody) ([]byte, error) {
+	if codec.AllowLegacy && atomic.LoadInt32(&codec.legacyPeer) != 0 {
+		return codec.encodeLegacy(senderPrivateKey, receiverPublicKey, packet)
+	}
 
-	nonce := rand.Uint32()
-	nonceB := make([]byte, 8)
-	binary.BigEndian.PutUint32(nonceB[4:8], nonce)
+	garbage := packetGarbage(maxRandomGarbage)
 
-	copy(data[nonceOffset:protocolVersionOffset], nonceB[4:8])
-	log.Printf("Encode -> nonce: %x", data[nonceOffset:protocolVersionOffset])
+	header := make([]byte, bodyOffset)
+	binary.BigEndian.PutUint16(header[magicNumberOffset:frameLengthOffset], magicNumber)
+	binary.BigEndian.PutUint32(header[frameLengthOffset:protocolVersionOffset], uint32(bodyOffset+bodyPayloadOffset+len(packet.Payload)+len(garbage)+signatureSize+tagSize))
+	header[protocolVersionOffset] = ProtocolVersion
+	copy(header[publicKeyOffset:nonceOffset], senderPrivateKey.PubKey().SerializeCompressed())
+	if _, err := crand.Read(header[nonceOffset:bodyOffset]); err != nil {
+		return nil, err
+	}
+	log.Printf("Encode -> header: %x", header)
 
-	// populate body
-	data[protocolVersionOffset] = packet.Protocol
-	data[commandOffset] = packet.Command
+	// the signature covers the header and the plain body, it stays inside the encrypted envelope
+	body := encodeBody(packet, garbage, true)
+	signature, err := ecdsa.SignCompact(senderPrivateKey, hash.HashData(append(header[:bodyOffset:bodyOffset], body...)), true)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, signature...)
+	log.Printf("Encode -> body: %x", body)
 
-	binary.BigEndian.PutUint32(data[sequenceOffset:payloadOffset], packet.Sequence)
-	binary.BigEndian.PutUint16(data[payloadLengthOffset:payloadOffset], uint16(len(packet.Payload)))
+	aead, err := chacha20poly1305.NewX(codec.sessionKey(sessionKeyContext, senderPrivateKey, receiverPublicKey)[:])
+	if err != nil {
+		return nil, err
+	}
 
-	copy(data[payloadOffset:], packet.Payload)
+	return aead.Seal(header, header[nonceOffset:bodyOffset], body, header), nil
+}
 
-	garbageOffset := payloadOffset + len(packet.Payload)
-	copy(data[garbageOffset:garbageOffset+len(garbage)], garbage)
+// Decode decrypts the packet using the session key derived from the receivers private key and the senders public key from the header.
+// Exactly one packet is consumed from the inbound buffer, any following data stays buffered for the next call.
+func (codec *Codec) Decode(peer *Peer, receiverPrivateKey *btcec.PrivateKey) (packet *IncomingPacket, err error) {
+	receivedAt := time.Now()
 
-	log.Printf("Encode -> body: %x", data[protocolVersionOffset:garbageOffset+len(garbage)])
+	if peer.InboundBuffered() < protocolVersionOffset+protocolVersionSize {
+		log.Printf("[%s]: Decode -> ErrorIncompletePacket buffered %d", peer.RemoteAddr().String(), peer.InboundBuffered())
+		return nil, ErrorIncompletePacket
+	}
+	header, _ := peer.Peek(protocolVersionOffset + protocolVersionSize)
+	if !bytes.Equal(magicNumberBytes, header[magicNumberOffset:frameLengthOffset]) {
+		err = errors.New(fmt.Sprintf("INVALID MAGIC NUMBER: Expected '%s' but got '%s'", magicNumberBytes, header[magicNumberOffset:frameLengthOffset]))
+		return nil, err
+	}
 
-	log.Printf("Encode -> data: %x", data[:len(data)-signatureSize])
+	var raw []byte
+	var packetBody *PacketBody
+	var senderPublicKey *btcec.PublicKey
+	var nonce []byte
+
+	switch {
+	case header[protocolVersionOffset] == ProtocolVersion:
+		frameLength := int(binary.BigEndian.Uint32(header[frameLengthOffset:protocolVersionOffset]))
+		if frameLength < packetLengthMinAEAD || frameLength > packetLengthMaxAEAD {
+			return nil, ErrorFrameLength
+		}
+		if peer.InboundBuffered() < frameLength {
+			log.Printf("[%s]: Decode -> ErrorIncompletePacket buffered %d frame length %d", peer.RemoteAddr().String(), peer.InboundBuffered(), frameLength)
+			return nil, ErrorIncompletePacket
+		}
+		raw, _ = peer.Peek(frameLength)
+		log.Printf("[%s]: Decode -> raw= %X", peer.RemoteAddr().String(), raw)
+
+		packetBody, senderPublicKey, err = codec.decodeAEAD(peer, receiverPrivateKey, raw)
+		nonce = append(nonce, raw[nonceOffset:bodyOffset]...)
+		if err == nil {
+			atomic.StoreInt32(&codec.legacyPeer, 0)
+		}
+	case header[protocolVersionOffset] == ProtocolVersionLegacy && codec.AllowLegacy:
+		// the legacy format is not delimited, the whole buffer is one packet
+		raw, _ = peer.Peek(-1)
+		log.Printf("[%s]: Decode -> raw= %X", peer.RemoteAddr().String(), raw)
+
+		packetBody, senderPublicKey, err = codec.decodeLegacy(peer, receiverPrivateKey, raw)
+		nonce = append(nonce, raw[legacyNonceOffset:protocolVersionOffset]...)
+		if err == nil {
+			atomic.StoreInt32(&codec.legacyPeer, 1)
+		}
+	default:
+		log.Printf("[%s]: Decode -> protocol version %d not supported", peer.RemoteAddr().String(), header[protocolVersionOffset])
+		err = ErrorProtocolVersion
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// encrypt body using Salsa20
-	keySalsa := publicKeyToSalsa20Key(receiverPublicKey)
-	log.Printf("Encode -> key salsa: %x", keySalsa)
-	salsa20.XORKeyStream(data[protocolVersionOffset:garbageOffset+len(garbage)], data[protocolVersionOffset:garbageOffset+len(garbage)], nonceB, keySalsa)
+	peer.Discard(len(raw))
 
-	log.Printf("Encode -> data encrypted: %x", data[:len(data)-signatureSize])
+	packet = &IncomingPacket{Peer: peer, Body: *packetBody, Nonce: nonce, PublicKey: senderPublicKey, NodeID: hash.PublicKey2NodeID(senderPublicKey), ReceivedAt: receivedAt}
+	log.Printf("[%s]: Decode -> Received IncomingPacket Body= %s", peer.RemoteAddr().String(), packet.Body.String())
+	return packet, nil
+}
 
-	signature, e := ecdsa.SignCompact(senderPrivateKey, hash.HashData(data[:len(data)-signatureSize]), true)
+// decodeAEAD authenticates and decrypts the raw packet. Tampered packets are rejected before the body is parsed.
+func (codec *Codec) decodeAEAD(peer *Peer, receiverPrivateKey *btcec.PrivateKey, raw []byte) (packetBody *PacketBody, senderPublicKey *btcec.PublicKey, err error) {
+	if len(raw) < packetLengthMinAEAD {
+		log.Printf("[%s]: Decode -> ErrorIncompletePacket buffered %d minimum expected %d", peer.RemoteAddr().String(), len(raw), packetLengthMinAEAD)
+		return nil, nil, ErrorIncompletePacket
+	}
 
-	log.Printf("Encode -> signature: %x", signature)
+	headerPublicKey, err := btcec.ParsePubKey(raw[publicKeyOffset:nonceOffset])
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if e != nil {
-		return nil, e
+	aead, err := chacha20poly1305.NewX(codec.sessionKey(sessionKeyContext, receiverPrivateKey, headerPublicKey)[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := aead.Open(nil, raw[nonceOffset:bodyOffset], raw[bodyOffset:], raw[:bodyOffset])
+	if err != nil {
+		return nil, nil, err
 	}
-	// encrypt signature using Salsa20
-	salsa20.XORKeyStream(signature[:], signature[:], nonceB, keySalsa)
+	log.Printf("[%s]: Decode -> Decrypted IncomingPacket= %x", peer.RemoteAddr().String(), body)
 
-	log.Printf("Encode -> signature encrypted: %x", signature)
+	// Verify the signature and extract the public key from it.
+	signed := append(append(make([]byte, 0, len(raw)), raw[:bodyOffset]...), body[:len(body)-signatureSize]...)
+	senderPublicKey, _, err = ecdsa.RecoverCompact(body[len(body)-signatureSize:], hash.HashData(signed))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !senderPublicKey.IsEqual(headerPublicKey) {
+		return nil, nil, ErrorSenderMismatch
+	}
+	log.Printf("[%s]: Decode -> SenderPublicKey= %X", peer.RemoteAddr().String(), senderPublicKey.SerializeCompressed())
 
-	copy(data[len(data)-signatureSize:], signature)
+	if packetBody, err = decodeBody(body[:len(body)-signatureSize], true); err != nil {
+		return nil, nil, err
+	}
+	packetBody.Protocol = ProtocolVersion
 
-	return data, nil
+	return packetBody, senderPublicKey, nil
 }
 
-func (codec *Codec) Decode(peer *Peer, receiverPublicKey *btcec.PublicKey) (packet *IncomingPacket, err error) {
-	receivedAt := time.Now()
-	raw, _ := peer.Peek(-1)
-
-	log.Printf("[%s]: Decode -> raw= %X", peer.RemoteAddr().String(), raw)
-
-	if peer.InboundBuffered() < PacketLengthMin {
-		log.Printf("[%s]: Decode -> ErrorIncompletePacket buffered %d minimum expected %d", peer.RemoteAddr().String(), peer.InboundBuffered(), PacketLengthMin)
+// Unpack returns the first packet in the buffer without decrypting it. Legacy packets are not delimited, the whole buffer is returned.
+func (codec *Codec) Unpack(buffer []byte) ([]byte, error) {
+	if len(buffer) < protocolVersionOffset+protocolVersionSize {
 		return nil, ErrorIncompletePacket
 	}
-	if !bytes.Equal(magicNumberBytes, raw[magicNumberOffset:nonceOffset]) {
-		err = errors.New(fmt.Sprintf("INVALID MAGIC NUMBER: Expected '%s' but got '%s'", magicNumberBytes, raw[magicNumberOffset:nonceOffset]))
-		return nil, err
+	if buffer[protocolVersionOffset] != ProtocolVersion {
+		if len(buffer) < PacketLengthMin {
+			return nil, ErrorIncompletePacket
+		}
+		return buffer, nil
 	}
 
-	nonce := make([]byte, nonceSize+4)
-	copy(nonce[4:8], raw[nonceOffset:protocolVersionOffset])
+	frameLength := int(binary.BigEndian.Uint32(buffer[frameLengthOffset:protocolVersionOffset]))
+	if frameLength < packetLengthMinAEAD || frameLength > packetLengthMaxAEAD {
+		return nil, ErrorFrameLength
+	}
+	if len(buffer) < frameLength {
+		return nil, ErrorIncompletePacket
+	}
+	return buffer[:frameLength], nil
+}
 
-	// Verify the signature and extract the public key from it.
-	var signature [signatureSize]byte
-	copy(signature[:], raw[len(raw)-signatureSize:])
-	keySalsa := publicKeyToSalsa20Key(receiverPublicKey)
-	salsa20.XORKeyStream(signature[:], signature[:], nonce, keySalsa)
+// encodeBody serializes the plain body followed by the garbage. The timestamp is set to the current time.
+func encodeBody(packet *PacketBody, garbage []byte, withTimestamp bool) (body []byte) {
+	payloadLengthOffset := bodyTimestampOffset
+	if withTimestamp {
+		payloadLengthOffset = bodyPayloadLengthOffset
+	}
+	payloadOffset := payloadLengthOffset + 2
 
-	senderPublicKey, _, err := ecdsa.RecoverCompact(signature[:], hash.HashData(raw[:len(raw)-signatureSize]))
-	if err != nil {
-		return nil, err
+	body = make([]byte, payloadOffset+len(packet.Payload)+len(garbage))
+	body[bodyCommandOffset] = packet.Command
+	binary.BigEndian.PutUint32(body[bodySequenceOffset:bodyTimestampOffset], packet.Sequence)
+	if withTimestamp {
+		binary.BigEndian.PutUint64(body[bodyTimestampOffset:bodyPayloadLengthOffset], uint64(time.Now().UnixMilli()))
 	}
-	log.Printf("[%s]: Decode -> SenderPublicKey= %X", peer.RemoteAddr().String(), senderPublicKey.SerializeCompressed())
+	binary.BigEndian.PutUint16(body[payloadLengthOffset:payloadOffset], uint16(len(packet.Payload)))
+	copy(body[payloadOffset:], packet.Payload)
+	copy(body[payloadOffset+len(packet.Payload):], garbage)
+	return body
+}
 
-	// Decrypt the packet using Salsa20.
-	bufferBodyDecrypted := make([]byte, len(raw)-protocolVersionOffset-signatureSize) // full length -signature -nonce - magic number
-	salsa20.XORKeyStream(bufferBodyDecrypted[:], raw[protocolVersionOffset:len(raw)-signatureSize], nonce, keySalsa)
-	log.Printf("[%s]: Decode -> Decrypted IncomingPacket= %x", peer.RemoteAddr().String(), bufferBodyDecrypted)
+// decodeBody parses the plain body. The garbage following the payload is ignored.
+func decodeBody(body []byte, withTimestamp bool) (packetBody *PacketBody, err error) {
+	payloadLengthOffset := bodyTimestampOffset
+	if withTimestamp {
+		payloadLengthOffset = bodyPayloadLengthOffset
+	}
+	payloadOffset := payloadLengthOffset + 2
 
-	packetBody := PacketBody{Protocol: bufferBodyDecrypted[0], Command: bufferBodyDecrypted[commandOffset-protocolVersionOffset]}
-	packetBody.Sequence = binary.BigEndian.Uint32(bufferBodyDecrypted[sequenceOffset-protocolVersionOffset : payloadLengthOffset-protocolVersionOffset])
+	if len(body) < payloadOffset {
+		return nil, ErrorIncompletePacket
+	}
 
-	payloadLength := binary.BigEndian.Uint16(bufferBodyDecrypted[payloadLengthOffset-protocolVersionOffset : payloadOffset-protocolVersionOffset])
+	packetBody = &PacketBody{Command: body[bodyCommandOffset]}
+	packetBody.Sequence = binary.BigEndian.Uint32(body[bodySequenceOffset:bodyTimestampOffset])
+	if withTimestamp {
+		packetBody.Timestamp = binary.BigEndian.Uint64(body[bodyTimestampOffset:bodyPayloadLengthOffset])
+	}
 
-	if payloadLength > maxBodyLength {
-		log.Printf("[%s]: Decode -> msgLength %d > max allowed %d", peer.RemoteAddr().String(), payloadLength, maxBodyLength)
-		peer.Discard(peer.InboundBuffered())
+	payloadLength := int(binary.BigEndian.Uint16(body[payloadLengthOffset:payloadOffset]))
+	if payloadLength > maxBodyLength || payloadLength > len(body)-payloadOffset {
+		log.Printf("decodeBody -> msgLength %d > max allowed %d or available %d", payloadLength, maxBodyLength, len(body)-payloadOffset)
+		return nil, ErrorPayloadLength
 	}
 
 	if payloadLength > 0 {
 		packetBody.Payload = make([]byte, payloadLength)
-		copy(packetBody.Payload, bufferBodyDecrypted[payloadOffset-protocolVersionOffset:payloadOffset-protocolVersionOffset+payloadLength])
+		copy(packetBody.Payload, body[payloadOffset:payloadOffset+payloadLength])
 	}
+	return packetBody, nil
+}
 
-	peer.Discard(len(raw))
+// sessionKey returns the key shared between the local private key and the remote public key for the given KDF context.
+// Both sides compute the same secp256k1 ECDH secret, which is run through the blake3 KDF.
+func (codec *Codec) sessionKey(context string, privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) (key *[32]byte) {
+	codec.keysMutex.Lock()
+	defer codec.keysMutex.Unlock()
 
-	packet = &IncomingPacket{Peer: peer, Body: packetBody, PublicKey: senderPublicKey, NodeID: hash.PublicKey2NodeID(senderPublicKey), ReceivedAt: receivedAt}
-	log.Printf("[%s]: Decode -> Received IncomingPacket Body= %s", peer.RemoteAddr().String(), packet.Body.String())
-	return packet, nil
-}
+	cacheKey := context + string(publicKey.SerializeCompressed())
+	if key = codec.sessionKeys[cacheKey]; key != nil {
+		return key
+	}
 
-func (codec Codec) Unpack(buffer []byte) ([]byte, error) {
-	if len(buffer) < PacketLengthMin {
-		return nil, ErrorIncompletePacket
+	key = new([32]byte)
+	copy(key[:], hash.DeriveKey(context, btcec.GenerateSharedSecret(privateKey, publicKey)))
+
+	if codec.sessionKeys == nil {
+		codec.sessionKeys = make(map[string]*[32]byte)
 	}
-	return buffer, nil
+	codec.sessionKeys[cacheKey] = key
+	return key
 }
 
 func packetGarbage(packetLength int) (random []byte) {
@@ -190,10 +341,3 @@ func packetGarbage(packetLength int) (random []byte) {
 	}
 	return b
 }
-
-func publicKeyToSalsa20Key(publicKey *btcec.PublicKey) (key *[32]byte) {
-	// bit 0 from PublicKey.Y is ignored here, but is negligible for this purpose
-	key = new([32]byte)
-	copy(key[:], publicKey.SerializeCompressed()[1:])
-	return key
-}
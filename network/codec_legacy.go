@@ -0,0 +1,128 @@
+package network
+
+import (
+	"blockchain/hash"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"golang.org/x/crypto/salsa20"
+	"log"
+	"math/rand"
+)
+
+/*
+Legacy packet format, protocol version 1. Only decoded if the codec allows it.
+
+Offset  Size   Info
+0		2	   Magic Number
+2       4      Nonce
+6       1      Protocol version = 1, not encrypted
+7       33     Sender public key, compressed, not encrypted
+40      1      Command
+41      4      Sequence
+45      2      Size of payload data
+47      ?      Payload
+?       ?      Randomized garbage
+?		65     Signature, ECDSA secp256k1 512-bit + 1 header byte
+*/
+const (
+	legacyNonceSize = 4
+
+	legacyNonceOffset = frameLengthOffset // the legacy format has no frame length
+	legacyBodyOffset  = publicKeyOffset + publicKeySize
+
+	legacyPacketLengthMin = legacyBodyOffset + bodyTimestampOffset + 2 + signatureSize // no timestamp in the legacy body
+)
+
+// legacySessionKeyContext is the blake3 KDF context used to derive the Salsa20 key from the ECDH shared secret.
+const legacySessionKeyContext = "blockchain 2022-06-01 p2p packet session key v1"
+
+// encodeLegacy encrypts the packet using Salsa20 followed by the encrypted signature.
+func (codec *Codec) encodeLegacy(senderPrivateKey *btcec.PrivateKey, receiverPublicKey *btcec.PublicKey, packet *PacketBody) ([]byte, error) {
+	garbage := packetGarbage(maxRandomGarbage)
+	log.Printf("Encode -> garbage: %x", garbage)
+
+	data := make([]byte, legacyBodyOffset, legacyPacketLengthMin+len(packet.Payload)+len(garbage))
+
+	// add magic number and nonce to header
+	binary.BigEndian.PutUint16(data[magicNumberOffset:legacyNonceOffset], magicNumber)
+	log.Printf("Encode -> magic number: %x", data[magicNumberOffset:legacyNonceOffset])
+
+	nonce := rand.Uint32()
+	nonceB := make([]byte, 8)
+	binary.BigEndian.PutUint32(nonceB[4:8], nonce)
+
+	copy(data[legacyNonceOffset:protocolVersionOffset], nonceB[4:8])
+	log.Printf("Encode -> nonce: %x", data[legacyNonceOffset:protocolVersionOffset])
+
+	// the version and the sender public key stay in clear, the receiver needs them to derive the session key
+	data[protocolVersionOffset] = ProtocolVersionLegacy
+	copy(data[publicKeyOffset:legacyBodyOffset], senderPrivateKey.PubKey().SerializeCompressed())
+
+	// populate body
+	data = append(data, encodeBody(packet, garbage, false)...)
+	log.Printf("Encode -> data: %x", data)
+
+	// encrypt body using Salsa20
+	keySalsa := codec.sessionKey(legacySessionKeyContext, senderPrivateKey, receiverPublicKey)
+	salsa20.XORKeyStream(data[legacyBodyOffset:], data[legacyBodyOffset:], nonceB, keySalsa)
+
+	log.Printf("Encode -> data encrypted: %x", data)
+
+	signature, e := ecdsa.SignCompact(senderPrivateKey, hash.HashData(data), true)
+
+	log.Printf("Encode -> signature: %x", signature)
+
+	if e != nil {
+		return nil, e
+	}
+	// encrypt signature using Salsa20
+	salsa20.XORKeyStream(signature[:], signature[:], nonceB, keySalsa)
+
+	log.Printf("Encode -> signature encrypted: %x", signature)
+
+	return append(data, signature...), nil
+}
+
+// decodeLegacy verifies the signature of the raw packet and decrypts it.
+func (codec *Codec) decodeLegacy(peer *Peer, receiverPrivateKey *btcec.PrivateKey, raw []byte) (packetBody *PacketBody, senderPublicKey *btcec.PublicKey, err error) {
+	if len(raw) < legacyPacketLengthMin {
+		log.Printf("[%s]: Decode -> ErrorIncompletePacket buffered %d minimum expected %d", peer.RemoteAddr().String(), len(raw), legacyPacketLengthMin)
+		return nil, nil, ErrorIncompletePacket
+	}
+
+	headerPublicKey, err := btcec.ParsePubKey(raw[publicKeyOffset:legacyBodyOffset])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, legacyNonceSize+4)
+	copy(nonce[4:8], raw[legacyNonceOffset:protocolVersionOffset])
+
+	// Verify the signature and extract the public key from it.
+	var signature [signatureSize]byte
+	copy(signature[:], raw[len(raw)-signatureSize:])
+	keySalsa := codec.sessionKey(legacySessionKeyContext, receiverPrivateKey, headerPublicKey)
+	salsa20.XORKeyStream(signature[:], signature[:], nonce, keySalsa)
+
+	senderPublicKey, _, err = ecdsa.RecoverCompact(signature[:], hash.HashData(raw[:len(raw)-signatureSize]))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !senderPublicKey.IsEqual(headerPublicKey) {
+		return nil, nil, ErrorSenderMismatch
+	}
+	log.Printf("[%s]: Decode -> SenderPublicKey= %X", peer.RemoteAddr().String(), senderPublicKey.SerializeCompressed())
+
+	// Decrypt the packet using Salsa20.
+	bufferBodyDecrypted := make([]byte, len(raw)-legacyBodyOffset-signatureSize) // full length -signature -header
+	salsa20.XORKeyStream(bufferBodyDecrypted[:], raw[legacyBodyOffset:len(raw)-signatureSize], nonce, keySalsa)
+	log.Printf("[%s]: Decode -> Decrypted IncomingPacket= %x", peer.RemoteAddr().String(), bufferBodyDecrypted)
+
+	if packetBody, err = decodeBody(bufferBodyDecrypted, false); err != nil {
+		return nil, nil, err
+	}
+	packetBody.Protocol = ProtocolVersionLegacy
+
+	return packetBody, senderPublicKey, nil
+}
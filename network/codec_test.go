@@ -0,0 +1,307 @@
+package network
+
+import (
+	"blockchain/hash"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// testConn is a connection with an inbound buffer. Written data is collected.
+type testConn struct {
+	gnet.Conn
+	inbound  []byte
+	outbound []byte
+	context  interface{}
+	closed   bool
+}
+
+func (conn *testConn) Peek(n int) ([]byte, error) {
+	if n < 0 || n > len(conn.inbound) {
+		return conn.inbound, nil
+	}
+	return conn.inbound[:n], nil
+}
+
+func (conn *testConn) Discard(n int) (int, error) {
+	conn.inbound = conn.inbound[n:]
+	return n, nil
+}
+
+func (conn *testConn) InboundBuffered() int           { return len(conn.inbound) }
+func (conn *testConn) RemoteAddr() net.Addr           { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (conn *testConn) LocalAddr() net.Addr            { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2} }
+func (conn *testConn) Context() interface{}           { return conn.context }
+func (conn *testConn) SetContext(context interface{}) { conn.context = context }
+
+func (conn *testConn) Close() error {
+	conn.closed = true
+	return nil
+}
+
+func (conn *testConn) Write(data []byte) (int, error) {
+	conn.outbound = append(conn.outbound, data...)
+	return len(data), nil
+}
+
+func (conn *testConn) AsyncWrite(data []byte, callback gnet.AsyncCallback) error {
+	conn.outbound = append(conn.outbound, data...)
+	return nil
+}
+
+func newTestKey(t *testing.T) *btcec.PrivateKey {
+	t.Helper()
+	privateKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+// newTestServer returns a server with a lookup table, it is not started.
+func newTestServer(t *testing.T) *TcpServer {
+	t.Helper()
+	privateKey := newTestKey(t)
+	return &TcpServer{PrivateKey: privateKey, PublicKey: privateKey.PubKey(), LookupTable: &LookupTable{}}
+}
+
+// newTestPeer returns an authenticated peer of the server and its private key.
+func newTestPeer(t *testing.T, server *TcpServer) (peer *Peer, privateKey *btcec.PrivateKey) {
+	t.Helper()
+	privateKey = newTestKey(t)
+	peer = &Peer{Conn: &testConn{}, Codec: &Codec{}, Authenticated: true, PublicKey: privateKey.PubKey(),
+		NodeID: hash.PublicKey2NodeID(privateKey.PubKey())}
+	server.LookupTable.add(peer)
+	server.LookupTable.authenticate(peer, hash.PublicKey2NodeID(server.PublicKey))
+	return peer, privateKey
+}
+
+// sentTestPackets decodes and clears the packets written to the peer.
+func sentTestPackets(t *testing.T, peer *Peer, privateKey *btcec.PrivateKey) (packets []*IncomingPacket) {
+	t.Helper()
+	conn := peer.Conn.(*testConn)
+	receiver := &Peer{Conn: &testConn{inbound: conn.outbound}}
+	conn.outbound = nil
+	var codec Codec
+	for receiver.InboundBuffered() > 0 {
+		packet, err := codec.Decode(receiver, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// encodeTestPacket encodes a packet from the sender to the receiver.
+func encodeTestPacket(t *testing.T, sender *btcec.PrivateKey, receiver *btcec.PublicKey, sequence uint32, payload string) []byte {
+	t.Helper()
+	var codec Codec
+	data, err := codec.Encode(sender, receiver, &PacketBody{Command: CommandPing, Sequence: sequence, Payload: []byte(payload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// expectPacket decodes the next packet and compares it.
+func expectPacket(t *testing.T, codec *Codec, peer *Peer, receiver, sender *btcec.PrivateKey, sequence uint32, payload string) {
+	t.Helper()
+	packet, err := codec.Decode(peer, receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Body.Protocol != ProtocolVersion || packet.Body.Command != CommandPing || packet.Body.Sequence != sequence ||
+		string(packet.Body.Payload) != payload || !packet.PublicKey.IsEqual(sender.PubKey()) || packet.Body.Timestamp == 0 {
+		t.Fatalf("packet %s", packet.Body.String())
+	}
+}
+
+func TestCodecRoundtrip(t *testing.T) {
+	sender, receiver := newTestKey(t), newTestKey(t)
+	data := encodeTestPacket(t, sender, receiver.PubKey(), 7, "hello")
+	if frameLength := binary.BigEndian.Uint32(data[frameLengthOffset:protocolVersionOffset]); int(frameLength) != len(data) {
+		t.Fatalf("frame length %d, packet length %d", frameLength, len(data))
+	}
+
+	conn := &testConn{inbound: data}
+	var codec Codec
+	expectPacket(t, &codec, &Peer{Conn: conn}, receiver, sender, 7, "hello")
+	if conn.InboundBuffered() != 0 {
+		t.Fatalf("buffered %d", conn.InboundBuffered())
+	}
+
+	// another receiver cannot decrypt it, the codec caches the session keys of one local key
+	var other Codec
+	if _, err := other.Decode(&Peer{Conn: &testConn{inbound: data}}, newTestKey(t)); err == nil {
+		t.Fatal("decoded by another receiver")
+	}
+}
+
+func TestCodecMultiplePackets(t *testing.T) {
+	sender, receiver := newTestKey(t), newTestKey(t)
+	first := encodeTestPacket(t, sender, receiver.PubKey(), 1, "first")
+	second := encodeTestPacket(t, sender, receiver.PubKey(), 2, "second")
+
+	// both packets arrive in one read
+	conn := &testConn{inbound: append(append([]byte{}, first...), second...)}
+	peer := &Peer{Conn: conn}
+	var codec Codec
+	expectPacket(t, &codec, peer, receiver, sender, 1, "first")
+	if conn.InboundBuffered() != len(second) {
+		t.Fatalf("buffered %d, expected %d", conn.InboundBuffered(), len(second))
+	}
+	expectPacket(t, &codec, peer, receiver, sender, 2, "second")
+	if _, err := codec.Decode(peer, receiver); err != ErrorIncompletePacket {
+		t.Fatalf("error %v", err)
+	}
+
+	if unpacked, err := codec.Unpack(append(append([]byte{}, first...), second...)); err != nil || !bytes.Equal(unpacked, first) {
+		t.Fatalf("unpack error %v", err)
+	}
+}
+
+func TestCodecSplitPacket(t *testing.T) {
+	sender, receiver := newTestKey(t), newTestKey(t)
+	data := encodeTestPacket(t, sender, receiver.PubKey(), 3, "split")
+
+	// the packet is split across two reads, also within the header
+	for _, split := range []int{1, protocolVersionOffset + 1, bodyOffset, len(data) - 1} {
+		conn := &testConn{inbound: append([]byte{}, data[:split]...)}
+		peer := &Peer{Conn: conn}
+		var codec Codec
+		if _, err := codec.Decode(peer, receiver); err != ErrorIncompletePacket {
+			t.Fatalf("split %d: error %v", split, err)
+		}
+		if !bytes.Equal(conn.inbound, data[:split]) {
+			t.Fatalf("split %d: buffer changed", split)
+		}
+		conn.inbound = append(conn.inbound, data[split:]...)
+		expectPacket(t, &codec, peer, receiver, sender, 3, "split")
+	}
+}
+
+func TestCodecTampered(t *testing.T) {
+	sender, receiver := newTestKey(t), newTestKey(t)
+	data := encodeTestPacket(t, sender, receiver.PubKey(), 4, "tampered")
+
+	tamper := func(change func(data []byte)) []byte {
+		tampered := append([]byte{}, data...)
+		change(tampered)
+		return tampered
+	}
+	setFrameLength := func(frameLength int) []byte {
+		return tamper(func(data []byte) {
+			binary.BigEndian.PutUint32(data[frameLengthOffset:protocolVersionOffset], uint32(frameLength))
+		})
+	}
+
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected error // nil if any error is expected
+	}{
+		{"tag", tamper(func(data []byte) { data[len(data)-1] ^= 1 }), nil},
+		{"body", tamper(func(data []byte) { data[bodyOffset] ^= 1 }), nil},
+		{"nonce", tamper(func(data []byte) { data[nonceOffset] ^= 1 }), nil},
+		{"frame length shorter", setFrameLength(len(data) - 1), nil},
+		{"frame length below minimum", setFrameLength(packetLengthMinAEAD - 1), ErrorFrameLength},
+		{"frame length above maximum", setFrameLength(packetLengthMaxAEAD + 1), ErrorFrameLength},
+		{"magic number", tamper(func(data []byte) { data[magicNumberOffset] ^= 1 }), nil},
+		{"protocol version", tamper(func(data []byte) { data[protocolVersionOffset] = ProtocolVersionLegacy }), ErrorProtocolVersion},
+	} {
+		var codec Codec
+		packet, err := codec.Decode(&Peer{Conn: &testConn{inbound: test.data}}, receiver)
+		if err == nil || packet != nil || test.expected != nil && err != test.expected {
+			t.Errorf("%s: error %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	// a longer frame length waits for more data
+	var codec Codec
+	if _, err := codec.Decode(&Peer{Conn: &testConn{inbound: setFrameLength(len(data) + 1)}}, receiver); err != ErrorIncompletePacket {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestCodecLegacyReplies(t *testing.T) {
+	sender, receiver := newTestKey(t), newTestKey(t)
+	legacySender := &Codec{AllowLegacy: true, legacyPeer: 1}
+	legacy, err := legacySender.Encode(sender, receiver.PubKey(), &PacketBody{Command: CommandPing, Sequence: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReply := func(codec *Codec, protocol uint8) {
+		t.Helper()
+		reply, err := codec.Encode(receiver, sender.PubKey(), &PacketBody{Command: CommandPing, Sequence: 1})
+		if err != nil || reply[protocolVersionOffset] != protocol {
+			t.Fatalf("reply protocol version %d, expected %d, error %v", reply[protocolVersionOffset], protocol, err)
+		}
+	}
+
+	// replies use the format of the last packet, the peer may switch back to version 2
+	conn := &testConn{inbound: legacy}
+	peer := &Peer{Conn: conn}
+	codec := &Codec{AllowLegacy: true}
+	expectReply(codec, ProtocolVersion)
+	if packet, err := codec.Decode(peer, receiver); err != nil || packet.Body.Protocol != ProtocolVersionLegacy {
+		t.Fatalf("legacy packet error %v", err)
+	}
+	expectReply(codec, ProtocolVersionLegacy)
+	conn.inbound = encodeTestPacket(t, sender, receiver.PubKey(), 2, "")
+	expectPacket(t, codec, peer, receiver, sender, 2, "")
+	expectReply(codec, ProtocolVersion)
+
+	// replies are encoded while packets are decoded
+	done := make(chan struct{})
+	go func() {
+		for n := 0; n < 10; n++ {
+			codec.Encode(receiver, sender.PubKey(), &PacketBody{Command: CommandPing, Sequence: 1})
+		}
+		close(done)
+	}()
+	for n := 0; n < 10; n++ {
+		conn.inbound = append([]byte{}, legacy...)
+		codec.Decode(peer, receiver)
+	}
+	<-done
+
+	// without the config switch the legacy packet is rejected and the replies stay in version 2
+	conn.inbound = legacy
+	codec = &Codec{}
+	if _, err := codec.Decode(peer, receiver); err != ErrorProtocolVersion {
+		t.Fatalf("error %v", err)
+	}
+	expectReply(codec, ProtocolVersion)
+}
+
+func TestCodecSessionKey(t *testing.T) {
+	first, second := newTestKey(t), newTestKey(t)
+	var firstCodec, secondCodec Codec
+	key := firstCodec.sessionKey(sessionKeyContext, first, second.PubKey())
+
+	// both sides derive the same key, and the cached one on later calls
+	if *secondCodec.sessionKey(sessionKeyContext, second, first.PubKey()) != *key {
+		t.Fatal("session keys differ")
+	}
+	if firstCodec.sessionKey(sessionKeyContext, first, second.PubKey()) != key {
+		t.Fatal("session key not cached")
+	}
+
+	// the key is secret to the pair and differs per context, it is not the receiver public key
+	for name, other := range map[string]*[32]byte{
+		"third key":      firstCodec.sessionKey(sessionKeyContext, first, newTestKey(t).PubKey()),
+		"legacy context": firstCodec.sessionKey(legacySessionKeyContext, first, second.PubKey()),
+	} {
+		if *other == *key {
+			t.Fatalf("%s: same session key", name)
+		}
+	}
+	if bytes.Equal(key[:], second.PubKey().SerializeCompressed()[1:]) {
+		t.Fatal("session key is the receiver public key")
+	}
+}
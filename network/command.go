@@ -2,7 +2,12 @@ package network
 
 import (
 	"blockchain/chain"
+	"blockchain/hash"
 	"encoding/binary"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"sync/atomic"
+	"time"
 )
 
 // Commands between peers
@@ -11,30 +16,417 @@ var (
 	CommandAnnouncement uint8 = 0 // Announcement
 	CommandResponse     uint8 = 1 // Response
 	CommandPing         uint8 = 2 // Keep-alive message (no payload).
-	CommandPong         uint8 = 3 // Response to ping (no payload).
+	CommandPong         uint8 = 3 // Response to ping, echoes the sequence of the ping.
 	// Blockchain
-	CommandGetBlock uint8 = 4 // Request blocks for specified peer.
-
+	CommandGetBlock uint8 = 4  // Request blocks for specified peer.
+	CommandBlock    uint8 = 12 // Response with a part of a block.
+	CommandNewBlock uint8 = 16 // Announce a new blockchain height after a block was appended.
+	// DHT
+	CommandFindNode  uint8 = 5 // Request the closest contacts to a node ID.
+	CommandFindValue uint8 = 6 // Request a value. Answered with CommandValue if stored, otherwise with CommandNodes.
+	CommandStore     uint8 = 7 // Store a value.
+	CommandNodes     uint8 = 8 // Response with contacts.
+	CommandValue     uint8 = 9 // Response with a value.
+	// Peer exchange
+	CommandGetPeers uint8 = 10 // Request a sample of connected peers.
+	CommandPeers    uint8 = 11 // Response with peers.
+	// Transactions
+	CommandInventory   uint8 = 13 // Announce hashes of new transactions.
+	CommandGetData     uint8 = 14 // Request transactions by hash.
+	CommandTransaction uint8 = 15 // Response with a transaction.
 )
 
+var ErrorPayloadMalformed = errors.New("MALFORMED PAYLOAD")
+
+const announcementSize = 23
+
 type AnnouncementPayload struct {
 	Features          uint8  // 0:1 Feature support
 	Port              uint16 // 1:3 External port if known. 0 if not.
-	BlockchainVersion uint64 // 3:7 Blockchain version
-	BlockchainHeight  uint64 // 7:11 Blockchain height
-	PortInternal      uint16 // 11:13 Internal port. Can be used to detect NATs.
+	BlockchainVersion uint64 // 3:11 Blockchain version
+	BlockchainHeight  uint64 // 11:19 Blockchain height
+	ChainID           uint32 // 19:23 Chain ID of the network, peers of other networks are disconnected
+	PortInternal      uint16 // Internal port, not encoded. Can be used to detect NATs.
 }
 
 func EncodeAnnouncement(node *chain.Node, sequence uint32) (packetBody *PacketBody) {
 	packetBody = new(PacketBody)
-	payload := make([]byte, 20)
+	payload := make([]byte, announcementSize)
 	payload[0] = node.FeaturesSupport()
 	binary.BigEndian.PutUint16(payload[1:1+2], node.Port)
-	binary.BigEndian.PutUint64(payload[3:3+8], node.BlockchainVersion)
-	binary.BigEndian.PutUint64(payload[11:11+8], node.BlockchainHeight)
+	binary.BigEndian.PutUint64(payload[3:3+8], atomic.LoadUint64(&node.BlockchainVersion))
+	binary.BigEndian.PutUint64(payload[11:11+8], atomic.LoadUint64(&node.BlockchainHeight))
+	binary.BigEndian.PutUint32(payload[19:19+4], node.ChainID)
 	packetBody.Command = CommandAnnouncement
-	packetBody.Protocol = 0
+	packetBody.Protocol = ProtocolVersion
 	packetBody.Payload = payload
 	packetBody.Sequence = sequence
 	return packetBody
 }
+
+// DecodeAnnouncement decodes the payload of an Announcement.
+func DecodeAnnouncement(payload []byte) (announcement *AnnouncementPayload, err error) {
+	if len(payload) != announcementSize {
+		return nil, ErrorPayloadMalformed
+	}
+	return &AnnouncementPayload{
+		Features:          payload[0],
+		Port:              binary.BigEndian.Uint16(payload[1:3]),
+		BlockchainVersion: binary.BigEndian.Uint64(payload[3 : 3+8]),
+		BlockchainHeight:  binary.BigEndian.Uint64(payload[11 : 11+8]),
+		ChainID:           binary.BigEndian.Uint32(payload[19 : 19+4]),
+	}, nil
+}
+
+func EncodePing(sequence uint32) (packetBody *PacketBody) {
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandPing, Sequence: sequence}
+}
+
+// EncodePong creates the response to the ping with the sequence. The payload is the 4 bytes ping sequence.
+func EncodePong(pingSequence uint32) (packetBody *PacketBody) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, pingSequence)
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandPong, Payload: payload}
+}
+
+// DecodePong returns the sequence of the answered ping.
+func DecodePong(payload []byte) (pingSequence uint32, err error) {
+	if len(payload) != 4 {
+		return 0, ErrorPayloadMalformed
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// FindPayload is the payload of CommandFindNode and CommandFindValue.
+type FindPayload struct {
+	RequestID uint32 // 0:4 Request ID, echoed in the response
+	Key       []byte // 4:36 Node ID or key of the value
+}
+
+func EncodeFind(command uint8, requestID uint32, key []byte) (packetBody *PacketBody) {
+	payload := make([]byte, 4+nodeIDSize)
+	binary.BigEndian.PutUint32(payload[0:4], requestID)
+	copy(payload[4:4+nodeIDSize], key)
+	return &PacketBody{Protocol: ProtocolVersion, Command: command, Payload: payload}
+}
+
+func DecodeFind(payload []byte) (find *FindPayload, err error) {
+	if len(payload) != 4+nodeIDSize {
+		return nil, ErrorPayloadMalformed
+	}
+	return &FindPayload{RequestID: binary.BigEndian.Uint32(payload[0:4]), Key: payload[4 : 4+nodeIDSize]}, nil
+}
+
+// StorePayload is the payload of CommandStore.
+type StorePayload struct {
+	Key   []byte        // 0:32 Key
+	TTL   time.Duration // 32:36 Time to live in seconds
+	Value []byte        // 36: Value
+}
+
+func EncodeStore(key []byte, ttl time.Duration, value []byte) (packetBody *PacketBody) {
+	payload := make([]byte, nodeIDSize+4+len(value))
+	copy(payload[0:nodeIDSize], key)
+	binary.BigEndian.PutUint32(payload[nodeIDSize:nodeIDSize+4], uint32(ttl/time.Second))
+	copy(payload[nodeIDSize+4:], value)
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandStore, Payload: payload}
+}
+
+func DecodeStore(payload []byte) (store *StorePayload, err error) {
+	if len(payload) < nodeIDSize+4 {
+		return nil, ErrorPayloadMalformed
+	}
+	return &StorePayload{
+		Key:   payload[0:nodeIDSize],
+		TTL:   time.Duration(binary.BigEndian.Uint32(payload[nodeIDSize:nodeIDSize+4])) * time.Second,
+		Value: payload[nodeIDSize+4:],
+	}, nil
+}
+
+// NodesPayload is the payload of CommandNodes. Each contact is encoded as public key (33 bytes), count of addresses
+// (1 byte) and the addresses, each prefixed by its length (1 byte).
+type NodesPayload struct {
+	RequestID uint32     // 0:4 Request ID of the find request
+	Contacts  []*Contact // 4:5 Count of contacts, followed by the contacts
+}
+
+// EncodeNodes encodes as many contacts as fit into a packet.
+func EncodeNodes(requestID uint32, contacts []*Contact) (packetBody *PacketBody) {
+	payload := make([]byte, 5, maxBodyLength)
+	binary.BigEndian.PutUint32(payload[0:4], requestID)
+
+	for _, contact := range contacts {
+		encoded := encodeAddresses(contact.PublicKey.SerializeCompressed(), contact.Addresses)
+		if len(payload)+len(encoded) > maxBodyLength || payload[4] == 255 {
+			break
+		}
+		payload = append(payload, encoded...)
+		payload[4]++
+	}
+
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandNodes, Payload: payload}
+}
+
+func DecodeNodes(payload []byte) (nodes *NodesPayload, err error) {
+	if len(payload) < 5 {
+		return nil, ErrorPayloadMalformed
+	}
+	nodes = &NodesPayload{RequestID: binary.BigEndian.Uint32(payload[0:4])}
+	count := int(payload[4])
+	offset := 5
+
+	for n := 0; n < count; n++ {
+		if offset+publicKeySize+1 > len(payload) {
+			return nil, ErrorPayloadMalformed
+		}
+		publicKey, err := btcec.ParsePubKey(payload[offset : offset+publicKeySize])
+		if err != nil {
+			return nil, err
+		}
+		var addresses []string
+		if addresses, offset, err = decodeAddresses(payload, offset+publicKeySize); err != nil {
+			return nil, err
+		}
+		nodes.Contacts = append(nodes.Contacts, NewContact(publicKey, addresses))
+	}
+
+	return nodes, nil
+}
+
+// encodeAddresses appends the count of addresses (1 byte) and the addresses, each prefixed by its length (1 byte).
+func encodeAddresses(encoded []byte, addresses []string) []byte {
+	countOffset := len(encoded)
+	encoded = append(encoded, 0)
+	for _, address := range addresses {
+		if len(address) > 255 || encoded[countOffset] == 255 {
+			continue
+		}
+		encoded = append(append(encoded, byte(len(address))), address...)
+		encoded[countOffset]++
+	}
+	return encoded
+}
+
+// decodeAddresses decodes the addresses encoded at the offset and returns the offset behind them.
+func decodeAddresses(payload []byte, offset int) (addresses []string, next int, err error) {
+	if offset >= len(payload) {
+		return nil, 0, ErrorPayloadMalformed
+	}
+	count := int(payload[offset])
+	offset++
+
+	for n := 0; n < count; n++ {
+		if offset >= len(payload) || offset+1+int(payload[offset]) > len(payload) {
+			return nil, 0, ErrorPayloadMalformed
+		}
+		addresses = append(addresses, string(payload[offset+1:offset+1+int(payload[offset])]))
+		offset += 1 + int(payload[offset])
+	}
+	return addresses, offset, nil
+}
+
+// ValuePayload is the payload of CommandValue.
+type ValuePayload struct {
+	RequestID uint32 // 0:4 Request ID of the find request
+	Value     []byte // 4: Value
+}
+
+func EncodeValue(requestID uint32, value []byte) (packetBody *PacketBody) {
+	payload := make([]byte, 4+len(value))
+	binary.BigEndian.PutUint32(payload[0:4], requestID)
+	copy(payload[4:], value)
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandValue, Payload: payload}
+}
+
+func DecodeValue(payload []byte) (value *ValuePayload, err error) {
+	if len(payload) < 4 {
+		return nil, ErrorPayloadMalformed
+	}
+	return &ValuePayload{RequestID: binary.BigEndian.Uint32(payload[0:4]), Value: payload[4:]}, nil
+}
+
+// EncodeGetPeers requests up to count peers.
+func EncodeGetPeers(count uint8) (packetBody *PacketBody) {
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandGetPeers, Payload: []byte{count}}
+}
+
+func DecodeGetPeers(payload []byte) (count uint8, err error) {
+	if len(payload) != 1 {
+		return 0, ErrorPayloadMalformed
+	}
+	return payload[0], nil
+}
+
+// PeerRecord is a single peer in CommandPeers. It is encoded as public key (33 bytes), features (1 byte), count of
+// addresses (1 byte) and the addresses, each prefixed by its length (1 byte). The node ID is derived from the public key.
+type PeerRecord struct {
+	NodeID    []byte
+	PublicKey *btcec.PublicKey
+	Features  uint8
+	Addresses []string // IP:Port
+}
+
+// EncodePeers encodes as many peers as fit into a packet. The first byte of the payload is the count of peers.
+func EncodePeers(records []*PeerRecord) (packetBody *PacketBody) {
+	payload := make([]byte, 1, maxBodyLength)
+
+	for _, record := range records {
+		encoded := append(record.PublicKey.SerializeCompressed(), record.Features)
+		encoded = encodeAddresses(encoded, record.Addresses)
+		if len(payload)+len(encoded) > maxBodyLength || payload[0] == 255 {
+			break
+		}
+		payload = append(payload, encoded...)
+		payload[0]++
+	}
+
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandPeers, Payload: payload}
+}
+
+func DecodePeers(payload []byte) (records []*PeerRecord, err error) {
+	if len(payload) < 1 {
+		return nil, ErrorPayloadMalformed
+	}
+	count := int(payload[0])
+	offset := 1
+
+	for n := 0; n < count; n++ {
+		if offset+publicKeySize+1 > len(payload) {
+			return nil, ErrorPayloadMalformed
+		}
+		publicKey, err := btcec.ParsePubKey(payload[offset : offset+publicKeySize])
+		if err != nil {
+			return nil, err
+		}
+		record := &PeerRecord{NodeID: hash.PublicKey2NodeID(publicKey), PublicKey: publicKey, Features: payload[offset+publicKeySize]}
+		if record.Addresses, offset, err = decodeAddresses(payload, offset+publicKeySize+1); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// GetBlockPayload is the payload of CommandGetBlock.
+type GetBlockPayload struct {
+	Height uint64 // 0:8 Height of the first requested block
+	Count  uint16 // 8:10 Count of blocks
+}
+
+func EncodeGetBlock(height uint64, count uint16) (packetBody *PacketBody) {
+	payload := make([]byte, 10)
+	binary.BigEndian.PutUint64(payload[0:8], height)
+	binary.BigEndian.PutUint16(payload[8:10], count)
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandGetBlock, Payload: payload}
+}
+
+func DecodeGetBlock(payload []byte) (request *GetBlockPayload, err error) {
+	if len(payload) != 10 {
+		return nil, ErrorPayloadMalformed
+	}
+	return &GetBlockPayload{Height: binary.BigEndian.Uint64(payload[0:8]), Count: binary.BigEndian.Uint16(payload[8:10])}, nil
+}
+
+// NewBlockPayload is the payload of CommandNewBlock.
+type NewBlockPayload struct {
+	BlockchainVersion uint64 // 0:8 Blockchain version
+	BlockchainHeight  uint64 // 8:16 Blockchain height, which is the count of blocks
+}
+
+func EncodeNewBlock(version, height uint64) (packetBody *PacketBody) {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[0:8], version)
+	binary.BigEndian.PutUint64(payload[8:16], height)
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandNewBlock, Payload: payload}
+}
+
+func DecodeNewBlock(payload []byte) (newBlock *NewBlockPayload, err error) {
+	if len(payload) != 16 {
+		return nil, ErrorPayloadMalformed
+	}
+	return &NewBlockPayload{BlockchainVersion: binary.BigEndian.Uint64(payload[0:8]), BlockchainHeight: binary.BigEndian.Uint64(payload[8:16])}, nil
+}
+
+// BlockPayload is the payload of CommandBlock. Blocks are split into parts that fit into a packet. A part count of 0
+// indicates that the block is not available.
+type BlockPayload struct {
+	Height uint64 // 0:8 Height of the block
+	Part   uint16 // 8:10 Index of the part
+	Parts  uint16 // 10:12 Count of parts
+	Data   []byte // 12: Part of the encoded block
+}
+
+const blockPartSize = maxBodyLength - 12
+
+// EncodeBlockParts splits the encoded block into packets. If the data is nil a single packet indicating that the block
+// is not available is returned.
+func EncodeBlockParts(height uint64, data []byte) (packetBodies []*PacketBody) {
+	parts := (len(data) + blockPartSize - 1) / blockPartSize
+	if parts > 0xFFFF {
+		parts = 0
+	}
+	for n := 0; n < parts || n == 0; n++ {
+		part := data[n*blockPartSize:]
+		if parts == 0 {
+			part = nil
+		} else if len(part) > blockPartSize {
+			part = part[:blockPartSize]
+		}
+		payload := make([]byte, 12+len(part))
+		binary.BigEndian.PutUint64(payload[0:8], height)
+		binary.BigEndian.PutUint16(payload[8:10], uint16(n))
+		binary.BigEndian.PutUint16(payload[10:12], uint16(parts))
+		copy(payload[12:], part)
+		packetBodies = append(packetBodies, &PacketBody{Protocol: ProtocolVersion, Command: CommandBlock, Payload: payload})
+	}
+	return packetBodies
+}
+
+func DecodeBlockPart(payload []byte) (block *BlockPayload, err error) {
+	if len(payload) < 12 {
+		return nil, ErrorPayloadMalformed
+	}
+	block = &BlockPayload{
+		Height: binary.BigEndian.Uint64(payload[0:8]),
+		Part:   binary.BigEndian.Uint16(payload[8:10]),
+		Parts:  binary.BigEndian.Uint16(payload[10:12]),
+		Data:   payload[12:],
+	}
+	if block.Parts > 0 && block.Part >= block.Parts || block.Parts == 0 && len(block.Data) > 0 {
+		return nil, ErrorPayloadMalformed
+	}
+	return block, nil
+}
+
+// inventoryHashesMax is the maximum count of transaction hashes in CommandInventory and CommandGetData.
+const inventoryHashesMax = (maxBodyLength - 1) / transactionIDSize
+
+// EncodeInventory encodes up to inventoryHashesMax transaction hashes for CommandInventory or CommandGetData. The first
+// byte of the payload is the count of hashes, followed by the hashes (32 bytes each).
+func EncodeInventory(command uint8, hashes [][]byte) (packetBody *PacketBody) {
+	if len(hashes) > inventoryHashesMax {
+		hashes = hashes[:inventoryHashesMax]
+	}
+	payload := make([]byte, 1, 1+len(hashes)*transactionIDSize)
+	payload[0] = byte(len(hashes))
+	for _, hash := range hashes {
+		payload = append(payload, hash...)
+	}
+	return &PacketBody{Protocol: ProtocolVersion, Command: command, Payload: payload}
+}
+
+func DecodeInventory(payload []byte) (hashes [][]byte, err error) {
+	if len(payload) < 1 || len(payload) != 1+int(payload[0])*transactionIDSize || int(payload[0]) > inventoryHashesMax {
+		return nil, ErrorPayloadMalformed
+	}
+	for offset := 1; offset < len(payload); offset += transactionIDSize {
+		hashes = append(hashes, payload[offset:offset+transactionIDSize])
+	}
+	return hashes, nil
+}
+
+// EncodeTransaction creates CommandTransaction. The payload is the encoded transaction.
+func EncodeTransaction(transaction *chain.Transaction) (packetBody *PacketBody) {
+	return &PacketBody{Protocol: ProtocolVersion, Command: CommandTransaction, Payload: transaction.Encode()}
+}
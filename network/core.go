@@ -1,18 +1,29 @@
 package network
 
 import (
+	"blockchain/chain"
+	"blockchain/config"
+	"blockchain/hash"
+	"blockchain/store"
 	"flag"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/panjf2000/gnet/v2"
 	"log"
+	"time"
 )
 
 var (
 	server TcpServer
 )
 
-func BootStrap(privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) {
+// dhtPath is the path of the database storing the DHT values.
+const dhtPath = "/tmp/blockchain/dht"
+
+// addressBookPath is the path of the database storing the address book.
+const addressBookPath = "/tmp/blockchain/peers"
+
+func BootStrap(nodeConfig *config.Config, blockchain *chain.Blockchain, privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) {
 	var port int
 	var multicore bool
 
@@ -24,9 +35,38 @@ func BootStrap(privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) {
 		port:        uint16(port),
 		PrivateKey:  privateKey,
 		PublicKey:   publicKey,
+		Blockchain:  blockchain,
 		LookupTable: new(LookupTable),
+		allowLegacy: nodeConfig.LegacyPacketFormat,
+		replayFilter: &ReplayFilter{
+			MaxClockSkew: time.Duration(nodeConfig.MaxClockSkew) * time.Second,
+		},
+		keepAlive: &KeepAlive{
+			PingInterval: time.Duration(nodeConfig.PingInterval) * time.Second,
+			PeerTimeout:  time.Duration(nodeConfig.PeerTimeout) * time.Second,
+		},
+	}
+	addressStore, err := store.NewPogrebStore(addressBookPath)
+	if err != nil {
+		log.Printf("Address book store cannot be opened: %v", err)
+		panic(err.Error())
 	}
-	err := gnet.Run(&server, fmt.Sprintf("tcp://:%d", port), gnet.WithMulticore(multicore), gnet.WithTicker(true))
+	server.AddressBook = NewAddressBook(hash.PublicKey2NodeID(publicKey), addressStore)
+	server.dialer = newDialer(&server, nodeConfig.SeedList)
+
+	dhtStore, err := store.NewPogrebStore(dhtPath)
+	if err != nil {
+		log.Printf("DHT store cannot be opened: %v", err)
+		panic(err.Error())
+	}
+	server.DHT = newDHT(&server, dhtStore)
+	server.Sync = newSyncManager(&server, blockchain)
+	server.Gossip = newTransactionGossip(&server, blockchain.Mempool)
+	if nodeConfig.Validator {
+		server.producer = newBlockProducer(&server, blockchain, privateKey)
+	}
+
+	err = gnet.Run(&server, fmt.Sprintf("tcp://:%d", port), gnet.WithMulticore(multicore), gnet.WithTicker(true))
 	if err != nil {
 		log.Printf("server exits with error: %v", err)
 		panic(err.Error())
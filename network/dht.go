@@ -0,0 +1,310 @@
+package network
+
+import (
+	"blockchain/store"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dhtAlpha          = 3               // Parallel requests of iterative lookups
+	dhtRequestTimeout = 5 * time.Second // Timeout for connecting and for the response
+	dhtValueTTLMax    = 24 * time.Hour  // Maximum time to live of stored values
+	dhtExpireInterval = time.Minute     // Interval for deleting expired values
+	dhtValueSizeMax   = maxBodyLength - nodeIDSize - 4
+)
+
+var ErrorValueSize = errors.New("VALUE SIZE EXCEEDS MAXIMUM")
+var ErrorRequestTimeout = errors.New("REQUEST TIMEOUT")
+
+// DHT is a Kademlia distributed hash table on top of the node IDs. Values are persisted in the store.
+type DHT struct {
+	server  *TcpServer
+	Routing *RoutingTable
+	store   store.Store
+
+	requestID    uint32
+	pending      map[uint32]*dhtRequest
+	pendingMutex sync.Mutex
+	refreshing   int32     // 1 while a bucket refresh runs
+	lastExpire   time.Time // accessed only from OnTick
+}
+
+// dhtRequest is an outstanding find request waiting for its response.
+type dhtRequest struct {
+	nodeID   []byte
+	response chan *IncomingPacket
+}
+
+// newDHT creates the DHT. The routing table is created on boot when the own node ID is known.
+func newDHT(server *TcpServer, store store.Store) *DHT {
+	return &DHT{server: server, store: store, pending: make(map[uint32]*dhtRequest), lastExpire: time.Now()}
+}
+
+// start creates the routing table for the own node ID.
+func (dht *DHT) start(self []byte) {
+	dht.Routing = NewRoutingTable(self, func(nodeID []byte) bool {
+		return dht.server.LookupTable.PeerByID(nodeID) != nil
+	})
+}
+
+// addPeer adds the authenticated peer to the routing table.
+func (dht *DHT) addPeer(peer *Peer) {
+	if peer.Authenticated && peer.PublicKey != nil {
+		dht.Routing.Add(NewContact(peer.PublicKey, peer.Addresses()))
+	}
+}
+
+// FindNode returns the closest contacts to the target known in the network.
+func (dht *DHT) FindNode(target []byte) []*Contact {
+	contacts, _ := dht.lookup(target, false)
+	return contacts
+}
+
+// FindValue returns the value stored under the key, locally or in the network.
+func (dht *DHT) FindValue(key []byte) (value []byte, found bool) {
+	if value, found = dht.store.Get(key); found {
+		return value, true
+	}
+	_, value = dht.lookup(key, true)
+	return value, value != nil
+}
+
+// Store stores the value on the closest nodes to the key and locally.
+func (dht *DHT) Store(key []byte, value []byte, ttl time.Duration) error {
+	if len(value) > dhtValueSizeMax {
+		return ErrorValueSize
+	}
+	if ttl > dhtValueTTLMax {
+		ttl = dhtValueTTLMax
+	}
+	if err := dht.store.StoreExpire(key, value, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	contacts, _ := dht.lookup(key, false)
+	for _, contact := range contacts {
+		peer, err := dht.server.dialer.Connect(contact.PublicKey, contact.Addresses, dhtRequestTimeout)
+		if err != nil {
+			continue
+		}
+		if err = dht.server.SendPacket(peer, EncodeStore(key, ttl, value)); err != nil {
+			log.Printf("[%X]: DHT -> store failed %v", contact.NodeID, err)
+		}
+	}
+	return nil
+}
+
+// lookupResult is the response of a single contact during a lookup.
+type lookupResult struct {
+	contact  *Contact
+	response *IncomingPacket
+	err      error
+}
+
+// lookup performs an iterative lookup: The alpha closest contacts that were not queried yet are asked in parallel for
+// closer contacts, until the k closest known contacts have all been queried. A lookup for a value stops at the first
+// contact that returns it.
+func (dht *DHT) lookup(target []byte, findValue bool) (shortlist []*Contact, value []byte) {
+	command := CommandFindNode
+	if findValue {
+		command = CommandFindValue
+	}
+	dht.Routing.markLookup(target)
+
+	shortlist = dht.Routing.Closest(target, bucketSize)
+	seen := map[string]bool{string(dht.Routing.self): true}
+	queried := make(map[string]bool)
+	for _, contact := range shortlist {
+		seen[string(contact.NodeID)] = true
+	}
+
+	for {
+		var batch []*Contact
+		for _, contact := range shortlist {
+			if !queried[string(contact.NodeID)] {
+				queried[string(contact.NodeID)] = true
+				batch = append(batch, contact)
+				if len(batch) == dhtAlpha {
+					break
+				}
+			}
+		}
+		if len(batch) == 0 {
+			return shortlist, nil
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, contact := range batch {
+			go func(contact *Contact) {
+				requestID := dht.nextRequestID()
+				response, err := dht.request(contact, requestID, EncodeFind(command, requestID, target))
+				results <- lookupResult{contact: contact, response: response, err: err}
+			}(contact)
+		}
+
+		for range batch {
+			result := <-results
+			if result.err != nil {
+				shortlist = removeContact(shortlist, result.contact.NodeID)
+				continue
+			}
+			dht.Routing.Add(result.contact)
+
+			switch result.response.Body.Command {
+			case CommandValue:
+				if payload, err := DecodeValue(result.response.Body.Payload); err == nil {
+					return shortlist, payload.Value
+				}
+			case CommandNodes:
+				payload, err := DecodeNodes(result.response.Body.Payload)
+				if err != nil {
+					continue
+				}
+				for _, contact := range payload.Contacts {
+					if !seen[string(contact.NodeID)] {
+						seen[string(contact.NodeID)] = true
+						shortlist = append(shortlist, contact)
+					}
+				}
+			}
+		}
+
+		sortByDistance(shortlist, target)
+		if len(shortlist) > bucketSize {
+			shortlist = shortlist[:bucketSize]
+		}
+	}
+}
+
+// request sends the packet to the contact and waits for the response with the request ID.
+func (dht *DHT) request(contact *Contact, requestID uint32, packetBody *PacketBody) (response *IncomingPacket, err error) {
+	peer, err := dht.server.dialer.Connect(contact.PublicKey, contact.Addresses, dhtRequestTimeout)
+	if err != nil {
+		dht.Routing.Remove(contact.NodeID)
+		return nil, err
+	}
+
+	request := &dhtRequest{nodeID: contact.NodeID, response: make(chan *IncomingPacket, 1)}
+	dht.pendingMutex.Lock()
+	dht.pending[requestID] = request
+	dht.pendingMutex.Unlock()
+
+	defer func() {
+		dht.pendingMutex.Lock()
+		delete(dht.pending, requestID)
+		dht.pendingMutex.Unlock()
+	}()
+
+	if err = dht.server.SendPacket(peer, packetBody); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response = <-request.response:
+		return response, nil
+	case <-time.After(dhtRequestTimeout):
+		return nil, ErrorRequestTimeout
+	}
+}
+
+func (dht *DHT) nextRequestID() uint32 {
+	return atomic.AddUint32(&dht.requestID, 1)
+}
+
+// handlePacket processes the DHT commands. Only authenticated peers are served.
+func (dht *DHT) handlePacket(packet *IncomingPacket) {
+	if !packet.Peer.Authenticated {
+		return
+	}
+	dht.addPeer(packet.Peer)
+
+	switch packet.Body.Command {
+	case CommandFindNode, CommandFindValue:
+		find, err := DecodeFind(packet.Body.Payload)
+		if err != nil {
+			log.Printf("[%X]: DHT -> invalid find request %v", packet.NodeID, err)
+			return
+		}
+
+		response := EncodeNodes(find.RequestID, removeContact(dht.Routing.Closest(find.Key, bucketSize+1), packet.NodeID))
+		if packet.Body.Command == CommandFindValue {
+			if value, found := dht.store.Get(find.Key); found {
+				response = EncodeValue(find.RequestID, value)
+			}
+		}
+		if err = dht.server.SendPacket(packet.Peer, response); err != nil {
+			log.Printf("[%X]: DHT -> sending response failed %v", packet.NodeID, err)
+		}
+
+	case CommandStore:
+		payload, err := DecodeStore(packet.Body.Payload)
+		if err != nil || len(payload.Value) == 0 {
+			log.Printf("[%X]: DHT -> invalid store request %v", packet.NodeID, err)
+			return
+		}
+		ttl := payload.TTL
+		if ttl > dhtValueTTLMax {
+			ttl = dhtValueTTLMax
+		}
+		if err = dht.store.StoreExpire(payload.Key, payload.Value, time.Now().Add(ttl)); err != nil {
+			log.Printf("[%X]: DHT -> storing value failed %v", packet.NodeID, err)
+		}
+
+	case CommandNodes, CommandValue:
+		if len(packet.Body.Payload) < 4 {
+			return
+		}
+		requestID := binary.BigEndian.Uint32(packet.Body.Payload[0:4])
+
+		dht.pendingMutex.Lock()
+		request := dht.pending[requestID]
+		dht.pendingMutex.Unlock()
+
+		// only the asked node may answer
+		if request != nil && bytes.Equal(request.nodeID, packet.NodeID) {
+			select {
+			case request.response <- packet:
+			default:
+			}
+		}
+	}
+}
+
+// maintain refreshes stale buckets and deletes expired values. It is called from OnTick and does not block.
+func (dht *DHT) maintain() {
+	if time.Since(dht.lastExpire) > dhtExpireInterval {
+		dht.lastExpire = time.Now()
+		go dht.store.ExpireKeys()
+	}
+
+	if !atomic.CompareAndSwapInt32(&dht.refreshing, 0, 1) {
+		return
+	}
+	targets := dht.Routing.staleBuckets()
+	if len(targets) == 0 {
+		atomic.StoreInt32(&dht.refreshing, 0)
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&dht.refreshing, 0)
+		for _, target := range targets {
+			dht.lookup(target, false)
+		}
+	}()
+}
+
+// removeContact returns the list without the node ID.
+func removeContact(contacts []*Contact, nodeID []byte) (result []*Contact) {
+	for _, contact := range contacts {
+		if !bytes.Equal(contact.NodeID, nodeID) {
+			result = append(result, contact)
+		}
+	}
+	return result
+}
@@ -0,0 +1,318 @@
+package network
+
+import (
+	"blockchain/config"
+	"blockchain/hash"
+	"encoding/hex"
+	"errors"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/panjf2000/gnet/v2"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dialBackoffMin = time.Second
+	dialBackoffMax = 5 * time.Minute
+	dialPeersMax   = 32               // Nodes from the address book are dialed until this many peers are connected
+	dialSeedDelay  = 10 * time.Second // Delay of the seeds on startup if the address book has recently connected nodes
+)
+
+// dialTarget is a remote node that the dialer keeps connected.
+type dialTarget struct {
+	PublicKey *btcec.PublicKey
+	NodeID    []byte
+	Addresses []string // IP:Port
+
+	persistent  bool // Seeds are redialed after failures, other targets are forgotten
+	dialing     bool
+	connected   bool
+	failures    int
+	nextAttempt time.Time
+	waiters     []chan *Peer // Notified when the connection is authenticated or failed (nil)
+}
+
+var ErrorNotConnected = errors.New("NODE NOT CONNECTED")
+
+// Dialer maintains outbound connections to the seed nodes and to nodes from the address book, and dials other nodes on
+// demand. It uses a gnet client, the connections are handled by the same handlers as inbound ones.
+type Dialer struct {
+	server  *TcpServer
+	client  *gnet.Client
+	targets map[string]*dialTarget // by compressed public key
+	pending map[string]*dialTarget // by resolved remote address, until the connection is opened
+	mutex   sync.Mutex
+}
+
+// outboundHandler passes the events of the gnet client to the server. It must not boot the server again.
+type outboundHandler struct {
+	*TcpServer
+}
+
+func (handler outboundHandler) OnBoot(engine gnet.Engine) gnet.Action {
+	return gnet.None
+}
+
+func (handler outboundHandler) OnTick() (delay time.Duration, action gnet.Action) {
+	return time.Second, gnet.None
+}
+
+func (handler outboundHandler) OnOpen(connection gnet.Conn) (out []byte, action gnet.Action) {
+	return handler.dialer.opened(connection)
+}
+
+// newDialer creates a dialer for the seeds in the config. The own public key is skipped. The address book must be loaded.
+func newDialer(server *TcpServer, seeds []config.PeerSeed) (dialer *Dialer) {
+	dialer = &Dialer{
+		server:  server,
+		targets: make(map[string]*dialTarget),
+		pending: make(map[string]*dialTarget),
+	}
+
+	for _, seed := range seeds {
+		publicKeyB, err := hex.DecodeString(seed.PublicKey)
+		if err != nil {
+			log.Printf("Dialer -> seed public key %s is not hex encoded: %v", seed.PublicKey, err)
+			continue
+		}
+		publicKey, err := btcec.ParsePubKey(publicKeyB)
+		if err != nil {
+			log.Printf("Dialer -> seed public key %s is invalid: %v", seed.PublicKey, err)
+			continue
+		}
+		if publicKey.IsEqual(server.PublicKey) || len(seed.Address) == 0 {
+			continue
+		}
+		dialer.targets[string(publicKey.SerializeCompressed())] = &dialTarget{PublicKey: publicKey, NodeID: hash.PublicKey2NodeID(publicKey), Addresses: seed.Address, persistent: true}
+	}
+
+	// nodes that were connected recently are dialed first, the other seeds are the fallback
+	if server.AddressBook.hasRecent() {
+		for _, target := range dialer.targets {
+			if !server.AddressBook.isRecent(target.NodeID) {
+				target.nextAttempt = time.Now().Add(dialSeedDelay)
+			}
+		}
+	}
+
+	return dialer
+}
+
+// Start starts the event loop of the client.
+func (dialer *Dialer) Start() (err error) {
+	if dialer.client, err = gnet.NewClient(outboundHandler{dialer.server}, gnet.WithMulticore(dialer.server.multicore)); err != nil {
+		return err
+	}
+	return dialer.client.Start()
+}
+
+// Maintain dials all targets that are not connected and due. It does not block.
+func (dialer *Dialer) Maintain() {
+	if dialer.client == nil {
+		return
+	}
+
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+
+	now := time.Now()
+	for _, target := range dialer.targets {
+		if !target.persistent || target.dialing || target.connected || now.Before(target.nextAttempt) {
+			continue
+		}
+		// the node may have connected to us
+		if dialer.server.LookupTable.PeerByID(target.NodeID) != nil {
+			continue
+		}
+		target.dialing = true
+		go dialer.dial(target)
+	}
+
+	dialer.dialAddressBook(now)
+}
+
+// dialAddressBook dials due nodes from the address book while there are free peer slots. The mutex must be locked.
+func (dialer *Dialer) dialAddressBook(now time.Time) {
+	slots := dialPeersMax - int(dialer.server.LookupTable.size())
+	for _, target := range dialer.targets {
+		if target.dialing {
+			slots--
+		}
+	}
+
+	for _, entry := range dialer.server.AddressBook.due(now) {
+		if slots <= 0 {
+			return
+		}
+		key := string(entry.PublicKey.SerializeCompressed())
+		if dialer.targets[key] != nil || dialer.server.LookupTable.PeerByID(entry.NodeID) != nil {
+			continue
+		}
+		target := &dialTarget{PublicKey: entry.PublicKey, NodeID: entry.NodeID, Addresses: entry.Addresses, dialing: true}
+		dialer.targets[key] = target
+		go dialer.dial(target)
+		slots--
+	}
+}
+
+// dial tries the addresses of the target until one connects.
+func (dialer *Dialer) dial(target *dialTarget) {
+	for _, address := range target.Addresses {
+		// the remote address reported by the connection is the resolved one
+		tcpAddress, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			log.Printf("Dialer -> resolving %s: %v", address, err)
+			continue
+		}
+		resolved := tcpAddress.String()
+
+		dialer.mutex.Lock()
+		dialer.pending[resolved] = target
+		dialer.mutex.Unlock()
+
+		if _, err = dialer.client.Dial("tcp", resolved); err == nil {
+			log.Printf("Dialer -> connected to %s", resolved)
+			return
+		}
+		log.Printf("Dialer -> dialing %s: %v", resolved, err)
+
+		dialer.mutex.Lock()
+		delete(dialer.pending, resolved)
+		dialer.mutex.Unlock()
+	}
+
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	target.dialing = false
+	dialer.failed(target)
+}
+
+// Connect returns the authenticated peer of the node. If the node is not connected, it is dialed and Connect waits until
+// the connection is authenticated or the timeout elapses.
+func (dialer *Dialer) Connect(publicKey *btcec.PublicKey, addresses []string, timeout time.Duration) (peer *Peer, err error) {
+	if peer = dialer.server.LookupTable.PeerByID(hash.PublicKey2NodeID(publicKey)); peer != nil {
+		return peer, nil
+	}
+	if dialer.client == nil || publicKey.IsEqual(dialer.server.PublicKey) {
+		return nil, ErrorNotConnected
+	}
+
+	dialer.mutex.Lock()
+	target := dialer.targets[string(publicKey.SerializeCompressed())]
+	if target == nil {
+		if len(addresses) == 0 {
+			dialer.mutex.Unlock()
+			return nil, ErrorNotConnected
+		}
+		target = &dialTarget{PublicKey: publicKey, NodeID: hash.PublicKey2NodeID(publicKey), Addresses: addresses}
+		dialer.targets[string(publicKey.SerializeCompressed())] = target
+	}
+	wait := make(chan *Peer, 1)
+	target.waiters = append(target.waiters, wait)
+	if !target.dialing && !target.connected {
+		target.dialing = true
+		go dialer.dial(target)
+	}
+	dialer.mutex.Unlock()
+
+	select {
+	case peer = <-wait:
+	case <-time.After(timeout):
+	}
+	if peer == nil {
+		return nil, ErrorNotConnected
+	}
+	return peer, nil
+}
+
+// notify passes the result to everybody waiting for the target. The mutex must be locked.
+func (target *dialTarget) notify(peer *Peer) {
+	for _, wait := range target.waiters {
+		wait <- peer
+	}
+	target.waiters = nil
+}
+
+// failed notifies the waiters and schedules the next attempt of seeds. The mutex must be locked.
+func (dialer *Dialer) failed(target *dialTarget) {
+	target.notify(nil)
+	dialer.server.AddressBook.failed(target.NodeID)
+	if !target.persistent {
+		delete(dialer.targets, string(target.PublicKey.SerializeCompressed()))
+		return
+	}
+	target.fail()
+}
+
+// opened is called when an outbound connection is registered in the event loop. The announcement is sent immediately.
+func (dialer *Dialer) opened(connection gnet.Conn) (out []byte, action gnet.Action) {
+	dialer.mutex.Lock()
+	target := dialer.pending[connection.RemoteAddr().String()]
+	delete(dialer.pending, connection.RemoteAddr().String())
+	dialer.mutex.Unlock()
+
+	if target == nil {
+		log.Printf("[%s]: Dialer -> unexpected outbound connection", connection.RemoteAddr().String())
+		return nil, gnet.Close
+	}
+
+	codec := &Codec{AllowLegacy: dialer.server.allowLegacy}
+	peer := &Peer{Conn: connection, Codec: codec, ConnectionTime: time.Now(), Outbound: true, PublicKey: target.PublicKey}
+	connection.SetContext(peer)
+	dialer.server.LookupTable.add(peer)
+
+	// the announcement is encrypted to the configured key, only the real seed can answer it
+	out, err := codec.Encode(dialer.server.PrivateKey, target.PublicKey, EncodeAnnouncement(dialer.server.Node, dialer.server.nextSequence()))
+	if err != nil {
+		log.Printf("[%s]: Dialer -> encoding announcement: %v", connection.RemoteAddr().String(), err)
+		return nil, gnet.Close
+	}
+	return out, gnet.None
+}
+
+// authenticated marks the target as connected and resets its backoff.
+func (dialer *Dialer) authenticated(peer *Peer) {
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+
+	if target := dialer.targets[string(peer.PublicKey.SerializeCompressed())]; target != nil {
+		target.dialing = false
+		target.connected = true
+		target.failures = 0
+		target.notify(peer)
+	}
+}
+
+// closed schedules the next attempt. Connections that never authenticated count as failure.
+func (dialer *Dialer) closed(peer *Peer) {
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+
+	target := dialer.targets[string(peer.PublicKey.SerializeCompressed())]
+	if target == nil {
+		return
+	}
+	target.dialing = false
+	target.connected = false
+	if !peer.Authenticated {
+		dialer.failed(target)
+	} else if !target.persistent {
+		delete(dialer.targets, string(peer.PublicKey.SerializeCompressed()))
+	} else {
+		target.nextAttempt = time.Now().Add(dialBackoffMin)
+	}
+}
+
+// fail schedules the next attempt with exponential backoff.
+func (target *dialTarget) fail() {
+	backoff := dialBackoffMin << target.failures
+	if backoff > dialBackoffMax || backoff <= 0 {
+		backoff = dialBackoffMax
+	} else {
+		target.failures++
+	}
+	target.nextAttempt = time.Now().Add(backoff)
+	log.Printf("Dialer -> %X next attempt in %s", target.PublicKey.SerializeCompressed(), backoff.String())
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"blockchain/chain"
+	"blockchain/config"
+	"blockchain/hash"
+	"blockchain/store"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// newTestAddressBook returns an empty address book of the server in a temporary directory.
+func newTestAddressBook(t *testing.T, server *TcpServer) *AddressBook {
+	t.Helper()
+	database, err := store.NewPogrebStore(t.TempDir() + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAddressBook(hash.PublicKey2NodeID(server.PublicKey), database)
+}
+
+func TestDialerSeeds(t *testing.T) {
+	server := newTestServer(t)
+	server.AddressBook = newTestAddressBook(t, server)
+	seed, other := newTestKey(t), newTestKey(t)
+	seedKey := hex.EncodeToString(seed.PubKey().SerializeCompressed())
+
+	// only seeds with a valid public key of another node and an address are dialed
+	dialer := newDialer(server, []config.PeerSeed{
+		{PublicKey: seedKey, Address: []string{"127.0.0.1:1"}},
+		{PublicKey: "no hex", Address: []string{"127.0.0.1:2"}},
+		{PublicKey: hex.EncodeToString(make([]byte, publicKeySize)), Address: []string{"127.0.0.1:3"}},
+		{PublicKey: hex.EncodeToString(server.PublicKey.SerializeCompressed()), Address: []string{"127.0.0.1:4"}},
+		{PublicKey: hex.EncodeToString(other.PubKey().SerializeCompressed())},
+	})
+	target := dialer.targets[string(seed.PubKey().SerializeCompressed())]
+	if len(dialer.targets) != 1 || target == nil || !target.persistent || len(target.Addresses) != 1 || !target.nextAttempt.IsZero() {
+		t.Fatalf("%d targets", len(dialer.targets))
+	}
+
+	// the backoff doubles up to the maximum
+	for n := 0; n < 20; n++ {
+		target.fail()
+	}
+	if backoff := time.Until(target.nextAttempt); backoff > dialBackoffMax || backoff < dialBackoffMax-time.Second {
+		t.Fatalf("backoff %s", backoff)
+	}
+}
+
+func TestDialerOpened(t *testing.T) {
+	server := newTestServer(t)
+	server.AddressBook = newTestAddressBook(t, server)
+	server.Node = &chain.Node{PublicKey: server.PublicKey, ID: hash.PublicKey2NodeID(server.PublicKey)}
+	seed := newTestKey(t)
+	dialer := newDialer(server, []config.PeerSeed{{PublicKey: hex.EncodeToString(seed.PubKey().SerializeCompressed()), Address: []string{"127.0.0.1:1"}}})
+	server.dialer = dialer
+
+	// connections that were not dialed are closed
+	if _, action := dialer.opened(&testConn{}); action != gnet.Close {
+		t.Fatalf("action %d", action)
+	}
+
+	// the announcement can only be decrypted by the seed
+	target := dialer.targets[string(seed.PubKey().SerializeCompressed())]
+	dialer.pending["127.0.0.1:1"] = target
+	conn := &testConn{}
+	out, action := dialer.opened(conn)
+	if action != gnet.None {
+		t.Fatalf("action %d", action)
+	}
+	var codec Codec
+	packet, err := codec.Decode(&Peer{Conn: &testConn{inbound: out}}, seed)
+	if err != nil || packet.Body.Command != CommandAnnouncement || !packet.PublicKey.IsEqual(server.PublicKey) {
+		t.Fatalf("error %v", err)
+	}
+	var other Codec
+	if _, err = other.Decode(&Peer{Conn: &testConn{inbound: out}}, newTestKey(t)); err == nil {
+		t.Fatal("decoded by another node")
+	}
+
+	// the connection is bound to the seed, a packet of another node closes it
+	server.replayFilter = &ReplayFilter{}
+	peer := conn.Context().(*Peer)
+	if !peer.Outbound || !peer.PublicKey.IsEqual(seed.PubKey()) {
+		t.Fatal("peer of the connection")
+	}
+	conn.inbound = encodeTestPacket(t, newTestKey(t), server.PublicKey, 1, "ping")
+	if action = server.OnTraffic(conn); action != gnet.Close {
+		t.Fatalf("action %d", action)
+	}
+
+	// a connection closed before the authentication counts as failure
+	dialer.closed(peer)
+	if target.failures != 1 || time.Until(target.nextAttempt) <= 0 {
+		t.Fatalf("failures %d", target.failures)
+	}
+}
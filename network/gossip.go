@@ -0,0 +1,177 @@
+package network
+
+import (
+	"blockchain/chain"
+	"bytes"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	transactionIDSize     = 32               // Transaction IDs are blake3 hashes of the encoded transaction
+	gossipKnownMax        = 4096             // Transaction hashes remembered per peer
+	gossipRequestTimeout  = 10 * time.Second // A transaction is requested from another peer after this timeout
+	gossipRejectedTimeout = 10 * time.Minute // Invalid transactions are not requested again within this time
+)
+
+// gossipRequest is an outstanding request of a transaction.
+type gossipRequest struct {
+	nodeID []byte // peer that was asked
+	sent   time.Time
+}
+
+// TransactionGossip spreads the transactions of the mempool. New transactions are announced by their hash to all peers
+// that do not know them yet. Peers request the transactions they lack and relay them after adding them to their mempool.
+type TransactionGossip struct {
+	server  *TcpServer
+	mempool *chain.Mempool
+
+	mutex     sync.Mutex
+	requested map[string]*gossipRequest // by transaction ID
+	rejected  map[string]time.Time      // invalid transactions by ID
+}
+
+func newTransactionGossip(server *TcpServer, mempool *chain.Mempool) *TransactionGossip {
+	return &TransactionGossip{
+		server:    server,
+		mempool:   mempool,
+		requested: make(map[string]*gossipRequest),
+		rejected:  make(map[string]time.Time),
+	}
+}
+
+// announce queues the hash of a transaction added to the mempool for all authenticated peers that do not know it yet.
+// It is the TransactionAdded callback of the mempool.
+func (gossip *TransactionGossip) announce(transaction *chain.Transaction) {
+	for _, peer := range gossip.server.LookupTable.Peers() {
+		peer.queueInventory(transaction.ID)
+	}
+}
+
+// flush sends the queued hashes to the peers and forgets expired requests and rejections. It is called from OnTick.
+func (gossip *TransactionGossip) flush() {
+	for _, peer := range gossip.server.LookupTable.Peers() {
+		for hashes := peer.takeInventory(inventoryHashesMax); len(hashes) > 0; hashes = peer.takeInventory(inventoryHashesMax) {
+			if err := gossip.server.SendPacket(peer, EncodeInventory(CommandInventory, hashes)); err != nil {
+				log.Printf("[%X]: Gossip -> inventory failed %v", peer.NodeID, err)
+				break
+			}
+		}
+	}
+
+	gossip.mutex.Lock()
+	defer gossip.mutex.Unlock()
+	for id, request := range gossip.requested {
+		if time.Since(request.sent) > gossipRequestTimeout {
+			delete(gossip.requested, id)
+		}
+	}
+	for id, rejected := range gossip.rejected {
+		if time.Since(rejected) > gossipRejectedTimeout {
+			delete(gossip.rejected, id)
+		}
+	}
+}
+
+// handlePacket processes the transaction commands of authenticated peers.
+func (gossip *TransactionGossip) handlePacket(packet *IncomingPacket) {
+	if !packet.Peer.Authenticated {
+		return
+	}
+
+	switch packet.Body.Command {
+	case CommandInventory:
+		hashes, err := DecodeInventory(packet.Body.Payload)
+		if err != nil {
+			log.Printf("[%X]: Gossip -> invalid inventory %v", packet.NodeID, err)
+			return
+		}
+		if missing := gossip.missing(packet.Peer, hashes); len(missing) > 0 {
+			if err = gossip.server.SendPacket(packet.Peer, EncodeInventory(CommandGetData, missing)); err != nil {
+				log.Printf("[%X]: Gossip -> request failed %v", packet.NodeID, err)
+			}
+		}
+
+	case CommandGetData:
+		hashes, err := DecodeInventory(packet.Body.Payload)
+		if err != nil {
+			log.Printf("[%X]: Gossip -> invalid request %v", packet.NodeID, err)
+			return
+		}
+		for _, id := range hashes {
+			transaction, found := gossip.mempool.Get(id)
+			if !found {
+				continue
+			}
+			packet.Peer.learned(id)
+			if err = gossip.server.SendPacket(packet.Peer, EncodeTransaction(transaction)); err != nil {
+				log.Printf("[%X]: Gossip -> sending transaction failed %v", packet.NodeID, err)
+				return
+			}
+		}
+
+	case CommandTransaction:
+		transaction, err := chain.DecodeTransaction(packet.Body.Payload)
+		if err != nil {
+			log.Printf("[%X]: Gossip -> invalid transaction %v", packet.NodeID, err)
+			return
+		}
+		// unsolicited transactions are ignored
+		if !gossip.received(packet.Peer, transaction.ID) {
+			return
+		}
+		packet.Peer.learned(transaction.ID)
+
+		// the mempool announces the transaction to the other peers
+		switch err = gossip.mempool.Add(transaction); err {
+		case nil:
+			log.Printf("[%X]: Gossip -> transaction %X added", packet.NodeID, transaction.ID)
+		case chain.ErrorTransactionDuplicate:
+		case chain.ErrorTransactionNonce, chain.ErrorMempoolFull:
+			// may be accepted later, for example after the missing nonces arrived
+			log.Printf("[%X]: Gossip -> transaction %X not added %v", packet.NodeID, transaction.ID, err)
+		default:
+			log.Printf("[%X]: Gossip -> transaction %X rejected %v", packet.NodeID, transaction.ID, err)
+			gossip.mutex.Lock()
+			gossip.rejected[string(transaction.ID)] = time.Now()
+			gossip.mutex.Unlock()
+		}
+	}
+}
+
+// missing records that the peer knows the hashes and returns the ones to request from it. Transactions that are pending,
+// already requested from another peer or were rejected recently are not requested.
+func (gossip *TransactionGossip) missing(peer *Peer, hashes [][]byte) (missing [][]byte) {
+	gossip.mutex.Lock()
+	defer gossip.mutex.Unlock()
+
+	for _, id := range hashes {
+		peer.learned(id)
+		if _, found := gossip.mempool.Get(id); found {
+			continue
+		}
+		if _, rejected := gossip.rejected[string(id)]; rejected {
+			continue
+		}
+		if request := gossip.requested[string(id)]; request != nil && time.Since(request.sent) <= gossipRequestTimeout {
+			continue
+		}
+		gossip.requested[string(id)] = &gossipRequest{nodeID: peer.NodeID, sent: time.Now()}
+		missing = append(missing, append([]byte{}, id...))
+	}
+	return missing
+}
+
+// received reports whether the transaction was requested from the peer and clears the request.
+func (gossip *TransactionGossip) received(peer *Peer, id []byte) bool {
+	gossip.mutex.Lock()
+	defer gossip.mutex.Unlock()
+
+	request := gossip.requested[string(id)]
+	if request == nil || !bytes.Equal(request.nodeID, peer.NodeID) {
+		return false
+	}
+	delete(gossip.requested, string(id))
+	return true
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"blockchain/chain"
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestTransactions returns transfers of one sender with consecutive nonces.
+func newTestTransactions(t *testing.T, count int) (transactions []*chain.Transaction) {
+	t.Helper()
+	sender := newTestKey(t)
+	for nonce := 0; nonce < count; nonce++ {
+		transaction, err := chain.NewTransfer(sender, 1, uint64(nonce), chain.AccountID(sender.PubKey()), 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions
+}
+
+// expectInventory fails unless the packets are one inventory command with the hashes.
+func expectInventory(t *testing.T, packets []*IncomingPacket, command uint8, expected ...[]byte) {
+	t.Helper()
+	if len(packets) != 1 || packets[0].Body.Command != command {
+		t.Fatalf("%d packets, expected command %d", len(packets), command)
+	}
+	hashes, err := DecodeInventory(packets[0].Body.Payload)
+	if err != nil || len(hashes) != len(expected) {
+		t.Fatalf("%d hashes, expected %d, error %v", len(hashes), len(expected), err)
+	}
+	for n := range hashes {
+		if !bytes.Equal(hashes[n], expected[n]) {
+			t.Fatalf("hash %d %X, expected %X", n, hashes[n], expected[n])
+		}
+	}
+}
+
+func TestGossipAnnounce(t *testing.T) {
+	server := newTestServer(t)
+	gossip := newTransactionGossip(server, chain.NewMempool(1))
+	first, firstKey := newTestPeer(t, server)
+	second, secondKey := newTestPeer(t, server)
+	transactions := newTestTransactions(t, 2)
+	for _, transaction := range transactions {
+		if err := gossip.mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second peer announced the first transaction, it is pending and not requested
+	gossip.handlePacket(&IncomingPacket{Peer: second, NodeID: second.NodeID,
+		Body: *EncodeInventory(CommandInventory, [][]byte{transactions[0].ID})})
+	if packets := sentTestPackets(t, second, secondKey); len(packets) != 0 {
+		t.Fatalf("%d packets", len(packets))
+	}
+
+	// a known hash is announced once and never to the peer that announced it
+	for n := 0; n < 2; n++ {
+		gossip.announce(transactions[0])
+	}
+	gossip.flush()
+	expectInventory(t, sentTestPackets(t, first, firstKey), CommandInventory, transactions[0].ID)
+	if packets := sentTestPackets(t, second, secondKey); len(packets) != 0 {
+		t.Fatalf("%d packets", len(packets))
+	}
+	gossip.announce(transactions[0])
+	gossip.announce(transactions[1])
+	gossip.flush()
+	expectInventory(t, sentTestPackets(t, first, firstKey), CommandInventory, transactions[1].ID)
+	expectInventory(t, sentTestPackets(t, second, secondKey), CommandInventory, transactions[1].ID)
+}
+
+func TestGossipMissing(t *testing.T) {
+	server := newTestServer(t)
+	gossip := newTransactionGossip(server, chain.NewMempool(1))
+	first, firstKey := newTestPeer(t, server)
+	second, secondKey := newTestPeer(t, server)
+	transactions := newTestTransactions(t, 4)
+	for _, transaction := range transactions[:2] {
+		if err := gossip.mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gossip.rejected[string(transactions[3].ID)] = time.Now()
+	inventory := EncodeInventory(CommandInventory, [][]byte{transactions[0].ID, transactions[1].ID, transactions[2].ID, transactions[3].ID})
+
+	// pending and rejected transactions are not requested, a requested one not from another peer
+	gossip.handlePacket(&IncomingPacket{Peer: first, NodeID: first.NodeID, Body: *inventory})
+	expectInventory(t, sentTestPackets(t, first, firstKey), CommandGetData, transactions[2].ID)
+	gossip.handlePacket(&IncomingPacket{Peer: second, NodeID: second.NodeID, Body: *inventory})
+	if packets := sentTestPackets(t, second, secondKey); len(packets) != 0 {
+		t.Fatalf("%d packets", len(packets))
+	}
+
+	// only the requested peer may deliver, then the transaction is pending and not requested again
+	for _, peer := range []*Peer{second, first} {
+		gossip.handlePacket(&IncomingPacket{Peer: peer, NodeID: peer.NodeID, Body: *EncodeTransaction(transactions[2])})
+	}
+	if _, found := gossip.mempool.Get(transactions[2].ID); !found {
+		t.Fatal("transaction not added")
+	}
+
+	// both peers announced it, it is not announced back to them
+	gossip.announce(transactions[2])
+	gossip.flush()
+	for _, peer := range []*Peer{first, second} {
+		if !peer.knows(transactions[2].ID) || len(peer.takeInventory(inventoryHashesMax)) > 0 {
+			t.Fatal("announced to a peer that knows it")
+		}
+	}
+}
+
+func TestGossipGetData(t *testing.T) {
+	server := newTestServer(t)
+	gossip := newTransactionGossip(server, chain.NewMempool(1))
+	peer, privateKey := newTestPeer(t, server)
+	transactions := newTestTransactions(t, inventoryHashesMax+1)
+	var hashes [][]byte
+	for _, transaction := range transactions {
+		if err := gossip.mempool.Add(transaction); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, transaction.ID)
+	}
+
+	// at most inventoryHashesMax hashes are encoded, a request with more is ignored
+	request := EncodeInventory(CommandGetData, hashes)
+	if decoded, err := DecodeInventory(request.Payload); err != nil || len(decoded) != inventoryHashesMax {
+		t.Fatalf("%d hashes, error %v", len(decoded), err)
+	}
+	oversized := append(append([]byte{byte(len(hashes))}, request.Payload[1:]...), hashes[inventoryHashesMax]...)
+	gossip.handlePacket(&IncomingPacket{Peer: peer, NodeID: peer.NodeID,
+		Body: PacketBody{Protocol: ProtocolVersion, Command: CommandGetData, Payload: oversized}})
+	if packets := sentTestPackets(t, peer, privateKey); len(packets) != 0 {
+		t.Fatalf("%d packets", len(packets))
+	}
+
+	// every requested pending transaction is sent, unknown hashes are skipped
+	unknown := make([]byte, transactionIDSize)
+	gossip.handlePacket(&IncomingPacket{Peer: peer, NodeID: peer.NodeID, Body: *EncodeInventory(CommandGetData, append([][]byte{unknown}, hashes[:inventoryHashesMax-1]...))})
+	packets := sentTestPackets(t, peer, privateKey)
+	if len(packets) != inventoryHashesMax-1 {
+		t.Fatalf("%d packets", len(packets))
+	}
+	for n, packet := range packets {
+		if packet.Body.Command != CommandTransaction || !bytes.Equal(packet.Body.Payload, transactions[n].Encode()) {
+			t.Fatalf("packet %d command %d", n, packet.Body.Command)
+		}
+		if !peer.knows(transactions[n].ID) {
+			t.Fatalf("transaction %d not known", n)
+		}
+	}
+}
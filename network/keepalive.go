@@ -0,0 +1,54 @@
+package network
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	DefaultPingInterval = 15 * time.Second // Default interval between pings to a peer.
+	DefaultPeerTimeout  = 60 * time.Second // Default duration after which silent peers are disconnected.
+)
+
+// KeepAlive pings authenticated peers periodically and disconnects peers that did not send any packet for PeerTimeout.
+type KeepAlive struct {
+	PingInterval time.Duration
+	PeerTimeout  time.Duration
+}
+
+func (keepAlive *KeepAlive) pingInterval() time.Duration {
+	if keepAlive.PingInterval <= 0 {
+		return DefaultPingInterval
+	}
+	return keepAlive.PingInterval
+}
+
+func (keepAlive *KeepAlive) peerTimeout() time.Duration {
+	if keepAlive.PeerTimeout <= 0 {
+		return DefaultPeerTimeout
+	}
+	return keepAlive.PeerTimeout
+}
+
+// maintain closes silent peers and sends the due pings. It is called from OnTick.
+func (keepAlive *KeepAlive) maintain(server *TcpServer) {
+	for _, peer := range server.LookupTable.Peers() {
+		if silent := time.Since(peer.LastSeen()); silent > keepAlive.peerTimeout() {
+			log.Printf("[%X]: KeepAlive -> closing connection to %s, silent for %s", peer.NodeID, peer.String(), silent.String())
+			peer.Close()
+			continue
+		}
+		if !peer.pingDue(keepAlive.pingInterval()) {
+			continue
+		}
+
+		ping := EncodePing(server.nextSequence())
+		data, err := peer.Codec.Encode(server.PrivateKey, peer.PublicKey, ping)
+		if err != nil {
+			log.Printf("[%X]: KeepAlive -> encoding ping failed %v", peer.NodeID, err)
+			continue
+		}
+		peer.pinged(ping.Sequence)
+		peer.AsyncWrite(data, nil)
+	}
+}
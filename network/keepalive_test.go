@@ -0,0 +1,54 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	server := newTestServer(t)
+	keepAlive := &KeepAlive{PingInterval: time.Minute, PeerTimeout: 2 * time.Minute}
+	silent, _ := newTestPeer(t, server)
+	silent.ConnectionTime = time.Now().Add(-3 * time.Minute)
+	active, privateKey := newTestPeer(t, server)
+	active.ConnectionTime = silent.ConnectionTime
+	active.seen(time.Now().Add(-time.Minute))
+
+	// the silent peer is disconnected, the active one is pinged once per interval
+	for n := 0; n < 2; n++ {
+		keepAlive.maintain(server)
+	}
+	if !silent.Conn.(*testConn).closed || len(silent.Conn.(*testConn).outbound) != 0 || active.Conn.(*testConn).closed {
+		t.Fatal("silent peer not disconnected")
+	}
+	packets := sentTestPackets(t, active, privateKey)
+	if len(packets) != 1 || packets[0].Body.Command != CommandPing {
+		t.Fatalf("%d packets", len(packets))
+	}
+
+	// only the pong of the outstanding ping is accepted
+	sequence := packets[0].Body.Sequence
+	if _, ok := active.ponged(sequence+1, time.Now()); ok {
+		t.Fatal("pong of another ping")
+	}
+	if rtt, ok := active.ponged(sequence, time.Now()); !ok || rtt < 0 || active.RTT() != rtt {
+		t.Fatalf("round trip time %s", rtt)
+	}
+	if _, ok := active.ponged(sequence, time.Now()); ok {
+		t.Fatal("pong answered twice")
+	}
+
+	// without an accepted packet within the timeout the active peer is disconnected too
+	active.seen(time.Now().Add(-3 * time.Minute))
+	keepAlive.maintain(server)
+	if !active.Conn.(*testConn).closed {
+		t.Fatal("peer not disconnected")
+	}
+}
+
+func TestKeepAliveDefaults(t *testing.T) {
+	keepAlive := &KeepAlive{}
+	if keepAlive.pingInterval() != DefaultPingInterval || keepAlive.peerTimeout() != DefaultPeerTimeout {
+		t.Fatal("defaults")
+	}
+}
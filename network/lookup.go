@@ -1,34 +1,119 @@
 package network
 
 import (
+	"bytes"
 	"log"
 	"sync"
 )
 
+// LookupTable keeps all open connections and the authenticated peers by node ID. There is at most one connection per
+// node ID, duplicates are resolved when the second connection authenticates.
 type LookupTable struct {
-	peers     map[string]*Peer
-	listMutex sync.RWMutex
+	connections map[*Peer]struct{} // all open connections, including unauthenticated ones
+	peers       map[string]*Peer   // authenticated peers by node ID
+	listMutex   sync.RWMutex
 }
 
 func (lut *LookupTable) size() uint16 {
+	lut.listMutex.RLock()
+	defer lut.listMutex.RUnlock()
 	return uint16(len(lut.peers))
 }
 
+// add registers a new connection. It is not reachable by node ID until authenticated.
 func (lut *LookupTable) add(peer *Peer) {
 	lut.listMutex.Lock()
 	defer lut.listMutex.Unlock()
-	if lut.peers == nil {
-		lut.peers = make(map[string]*Peer)
+	if lut.connections == nil {
+		lut.connections = make(map[*Peer]struct{})
 	}
-	lut.peers[peer.String()] = peer
+	lut.connections[peer] = struct{}{}
 	log.Printf("peer added: %s", peer.String())
 }
 
+// remove removes the connection, and the node ID entry if it points to this connection.
 func (lut *LookupTable) remove(peer *Peer) {
 	lut.listMutex.Lock()
 	defer lut.listMutex.Unlock()
-	if _, ok := lut.peers[peer.String()]; ok {
-		delete(lut.peers, peer.String())
+	if _, ok := lut.connections[peer]; ok {
+		delete(lut.connections, peer)
 		log.Printf("peer removed: %s", peer.String())
 	}
+	if peer.NodeID != nil && lut.peers[string(peer.NodeID)] == peer {
+		delete(lut.peers, string(peer.NodeID))
+	}
+}
+
+// authenticate indexes the peer by its node ID. If the node is already connected only one connection is kept:
+// The connection dialed by the node with the lower node ID wins, if both have the same direction the existing one wins.
+// The returned peer is the connection to close, nil if none.
+func (lut *LookupTable) authenticate(peer *Peer, localNodeID []byte) (drop *Peer) {
+	lut.listMutex.Lock()
+	defer lut.listMutex.Unlock()
+	if lut.peers == nil {
+		lut.peers = make(map[string]*Peer)
+	}
+
+	existing := lut.peers[string(peer.NodeID)]
+	if existing == nil || existing == peer {
+		lut.peers[string(peer.NodeID)] = peer
+		return nil
+	}
+
+	keep := existing
+	if existing.Outbound != peer.Outbound {
+		localIsLower := bytes.Compare(localNodeID, peer.NodeID) < 0
+		if peer.Outbound == localIsLower {
+			keep = peer
+		}
+	}
+	drop = peer
+	if keep == peer {
+		drop = existing
+	}
+
+	keep.addAddresses(drop.Addresses()...)
+	if keep.NodeInfo() == nil {
+		keep.SetNodeInfo(drop.NodeInfo())
+	}
+	lut.peers[string(peer.NodeID)] = keep
+	log.Printf("[%X]: duplicate connection, keeping %s dropping %s", peer.NodeID, keep.String(), drop.String())
+	return drop
+}
+
+// connectionList returns all open connections.
+func (lut *LookupTable) connectionList() (list []*Peer) {
+	lut.listMutex.RLock()
+	defer lut.listMutex.RUnlock()
+	for peer := range lut.connections {
+		list = append(list, peer)
+	}
+	return list
+}
+
+// PeerByID returns the authenticated peer with the node ID, nil if not connected.
+func (lut *LookupTable) PeerByID(nodeID []byte) *Peer {
+	lut.listMutex.RLock()
+	defer lut.listMutex.RUnlock()
+	return lut.peers[string(nodeID)]
+}
+
+// Peers returns all authenticated peers.
+func (lut *LookupTable) Peers() (list []*Peer) {
+	lut.listMutex.RLock()
+	defer lut.listMutex.RUnlock()
+	for _, peer := range lut.peers {
+		list = append(list, peer)
+	}
+	return list
+}
+
+// PeersWithFeature returns the authenticated peers that announced the feature, for example chain.FeatureValidator.
+func (lut *LookupTable) PeersWithFeature(feature uint8) (list []*Peer) {
+	for _, peer := range lut.Peers() {
+		if node := peer.NodeInfo(); node != nil && node.FeaturesSupport()&(1<<feature) > 0 {
+			list = append(list, peer)
+		}
+	}
+	return list
 }
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"blockchain/chain"
+	"blockchain/hash"
+	"bytes"
+	"testing"
+)
+
+func TestLookupTableDuplicate(t *testing.T) {
+	remote := newTestKey(t)
+	nodeID := hash.PublicKey2NodeID(remote.PubKey())
+	lower, higher := make([]byte, len(nodeID)), bytes.Repeat([]byte{0xFF}, len(nodeID))
+	newPeer := func(outbound bool) *Peer {
+		return &Peer{Conn: &testConn{}, Outbound: outbound, NodeID: nodeID, PublicKey: remote.PubKey()}
+	}
+
+	// the connection dialed by the node with the lower node ID wins, with the same direction the existing one
+	for _, test := range []struct {
+		name                       string
+		local                      []byte
+		existingOutbound, outbound bool
+		keepExisting               bool
+	}{
+		{"both inbound", lower, false, false, true},
+		{"both outbound", higher, true, true, true},
+		{"local lower, new outbound", lower, false, true, false},
+		{"local lower, new inbound", lower, true, false, true},
+		{"local higher, new outbound", higher, false, true, true},
+		{"local higher, new inbound", higher, true, false, false},
+	} {
+		lut := &LookupTable{}
+		existing, peer := newPeer(test.existingOutbound), newPeer(test.outbound)
+		existing.addAddresses("127.0.0.1:1")
+		peer.addAddresses("127.0.0.1:2")
+		existing.SetNodeInfo(&chain.Node{Port: 1})
+		for _, connection := range []*Peer{existing, peer} {
+			lut.add(connection)
+		}
+		if drop := lut.authenticate(existing, test.local); drop != nil {
+			t.Fatalf("%s: first connection dropped", test.name)
+		}
+		if drop := lut.authenticate(existing, test.local); drop != nil {
+			t.Fatalf("%s: authenticated twice", test.name)
+		}
+
+		keep, drop := peer, existing
+		if test.keepExisting {
+			keep, drop = existing, peer
+		}
+		if dropped := lut.authenticate(peer, test.local); dropped != drop || lut.PeerByID(nodeID) != keep {
+			t.Fatalf("%s: wrong connection kept", test.name)
+		}
+		// the kept connection learns the addresses and the node information of the dropped one
+		if len(keep.Addresses()) != 2 || keep.NodeInfo() == nil || keep.NodeInfo().Port != 1 {
+			t.Fatalf("%s: addresses %v", test.name, keep.Addresses())
+		}
+
+		// closing the dropped connection keeps the node reachable
+		lut.remove(drop)
+		if lut.PeerByID(nodeID) != keep || len(lut.connectionList()) != 1 || lut.size() != 1 {
+			t.Fatalf("%s: kept connection removed", test.name)
+		}
+		lut.remove(keep)
+		if lut.PeerByID(nodeID) != nil || len(lut.connectionList()) != 0 {
+			t.Fatalf("%s: removed connection found", test.name)
+		}
+	}
+}
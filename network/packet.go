@@ -8,10 +8,11 @@ import (
 
 // PacketBody is a decrypted P2P message
 type PacketBody struct {
-	Protocol uint8  // Protocol version = 0
-	Command  uint8  // Command code
-	Sequence uint32 // Sequence number
-	Payload  []byte // Payload
+	Protocol  uint8  // Protocol version, see ProtocolVersion
+	Command   uint8  // Command code
+	Sequence  uint32 // Sequence number
+	Timestamp uint64 // Unix time in milliseconds when the packet was encoded. Not available in the legacy format.
+	Payload   []byte // Payload
 }
 
 type OutboundPacket struct {
@@ -22,11 +23,12 @@ type OutboundPacket struct {
 type IncomingPacket struct {
 	Peer       *Peer
 	Body       PacketBody
+	Nonce      []byte
 	PublicKey  *btcec.PublicKey
 	NodeID     []byte
 	ReceivedAt time.Time
 }
 
 func (packetBody *PacketBody) String() string {
-	return fmt.Sprintf("Protcol: %d, Command: %d, Sequence: %d, Payload: %x", packetBody.Protocol, packetBody.Command, packetBody.Sequence, packetBody.Payload)
+	return fmt.Sprintf("Protcol: %d, Command: %d, Sequence: %d, Timestamp: %d, Payload: %x", packetBody.Protocol, packetBody.Command, packetBody.Sequence, packetBody.Timestamp, packetBody.Payload)
 }
@@ -1,15 +1,45 @@
 package network
 
 import (
+	"blockchain/chain"
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/panjf2000/gnet/v2"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const peerPenaltyMax = 100 // Penalty points at which the peer is disconnected
+
+// Peer is a single connection to a remote node. It is stored as context of the gnet connection.
 type Peer struct {
 	gnet.Conn
+	Codec          *Codec
 	ConnectionTime time.Time
-	LastSeen       time.Time
 	Authenticated  bool
+	Outbound       bool             // Connection was dialed by this node
+	PublicKey      *btcec.PublicKey // Public key of the remote node. Known in advance for outbound connections.
+	NodeID         []byte           // Node ID of the remote node, set when authenticated
+	Rejected       uint32           // Count of packets rejected by the replay filter. Use RejectedPackets to read.
+	Penalty        uint32           // Penalty points for invalid data sent by the peer. Use PenaltyPoints to read.
+
+	node      *chain.Node // Latest announced information of the remote node
+	addresses []string    // Known addresses of the remote node (IP:Port)
+	infoMutex sync.RWMutex
+
+	lastSeen     time.Time     // Time of the latest accepted packet
+	rtt          time.Duration // Round trip time of the latest answered ping
+	pingSequence uint32        // Sequence of the outstanding ping, 0 if none
+	pingSent     time.Time
+	pexNext      time.Time // Time of the next peer exchange request
+	pexPending   bool      // A peer exchange response is expected
+
+	rejectedSince  time.Time // Start of the current window of rejected packets
+	rejectedRecent uint32    // Rejected packets within the current window
+
+	known      map[string]struct{} // Transaction hashes the peer knows, it announced or received them
+	knownOrder []string            // Known hashes in insertion order, the oldest are forgotten first
+	inventory  [][]byte            // Transaction hashes queued for announcement
 }
 
 func (peer *Peer) ShouldMaintain() bool {
@@ -22,6 +52,208 @@ func (peer *Peer) ShouldMaintain() bool {
 	}
 	return true
 }
+
+// RejectedPackets returns the count of packets rejected from this peer.
+func (peer *Peer) RejectedPackets() uint32 {
+	return atomic.LoadUint32(&peer.Rejected)
+}
+
+// reject counts a packet rejected by the replay filter. It reports whether replayRejectMax packets were rejected within
+// replayRejectWindow, then the count starts again. A few rejections are expected, for example after a reconnect.
+func (peer *Peer) reject(receivedAt time.Time) (penalize bool) {
+	atomic.AddUint32(&peer.Rejected, 1)
+
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	if receivedAt.Sub(peer.rejectedSince) > replayRejectWindow {
+		peer.rejectedSince = receivedAt
+		peer.rejectedRecent = 0
+	}
+	peer.rejectedRecent++
+	if peer.rejectedRecent < replayRejectMax {
+		return false
+	}
+	peer.rejectedRecent = 0
+	return true
+}
+
+// PenaltyPoints returns the penalty points of this peer.
+func (peer *Peer) PenaltyPoints() uint32 {
+	return atomic.LoadUint32(&peer.Penalty)
+}
+
+// penalize adds penalty points and reports whether the peer reached peerPenaltyMax.
+func (peer *Peer) penalize(points uint32) bool {
+	return atomic.AddUint32(&peer.Penalty, points) >= peerPenaltyMax
+}
+
+// NodeInfo returns the information from the latest Announcement, nil if none was received yet.
+func (peer *Peer) NodeInfo() *chain.Node {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	return peer.node
+}
+
+// SetNodeInfo replaces the node information. The node must not be modified afterwards.
+func (peer *Peer) SetNodeInfo(node *chain.Node) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	peer.node = node
+}
+
+// Addresses returns the known addresses of the remote node.
+func (peer *Peer) Addresses() []string {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	return append([]string{}, peer.addresses...)
+}
+
+func (peer *Peer) addAddresses(addresses ...string) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	for _, address := range addresses {
+		known := false
+		for _, existing := range peer.addresses {
+			known = known || existing == address
+		}
+		if !known {
+			peer.addresses = append(peer.addresses, address)
+		}
+	}
+}
+
+// LastSeen returns the time of the latest accepted packet from the peer, or the connection time if none was received.
+func (peer *Peer) LastSeen() time.Time {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	if peer.lastSeen.IsZero() {
+		return peer.ConnectionTime
+	}
+	return peer.lastSeen
+}
+
+// RTT returns the round trip time measured by the latest answered ping, 0 if none was answered yet.
+func (peer *Peer) RTT() time.Duration {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	return peer.rtt
+}
+
+func (peer *Peer) seen(at time.Time) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	peer.lastSeen = at
+}
+
+// pingDue reports whether the interval since the last ping elapsed.
+func (peer *Peer) pingDue(interval time.Duration) bool {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	return time.Since(peer.pingSent) >= interval
+}
+
+// pinged records the outstanding ping. A previous unanswered ping is forgotten.
+func (peer *Peer) pinged(sequence uint32) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	peer.pingSequence = sequence
+	peer.pingSent = time.Now()
+}
+
+// ponged updates the round trip time if the pong answers the outstanding ping.
+func (peer *Peer) ponged(sequence uint32, at time.Time) (rtt time.Duration, ok bool) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	if peer.pingSequence == 0 || sequence != peer.pingSequence {
+		return 0, false
+	}
+	peer.pingSequence = 0
+	peer.rtt = at.Sub(peer.pingSent)
+	return peer.rtt, true
+}
+
+func (peer *Peer) pexDue() bool {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	return !time.Now().Before(peer.pexNext)
+}
+
+// pexRequested records the request and schedules the next one after the interval.
+func (peer *Peer) pexRequested(interval time.Duration) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	peer.pexNext = time.Now().Add(interval)
+	peer.pexPending = true
+}
+
+// pexRetry schedules the next request earlier.
+func (peer *Peer) pexRetry(after time.Duration) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	peer.pexNext = time.Now().Add(after)
+}
+
+// pexAnswered reports whether a peer exchange response was expected and clears the expectation.
+func (peer *Peer) pexAnswered() (expected bool) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	expected = peer.pexPending
+	peer.pexPending = false
+	return expected
+}
+
+// knows reports whether the peer knows the transaction hash.
+func (peer *Peer) knows(id []byte) bool {
+	peer.infoMutex.RLock()
+	defer peer.infoMutex.RUnlock()
+	_, known := peer.known[string(id)]
+	return known
+}
+
+// learned records that the peer knows the transaction hash. It reports false if it was already known.
+func (peer *Peer) learned(id []byte) bool {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	return peer.learnedLocked(id)
+}
+
+func (peer *Peer) learnedLocked(id []byte) bool {
+	if _, known := peer.known[string(id)]; known {
+		return false
+	}
+	if peer.known == nil {
+		peer.known = make(map[string]struct{})
+	}
+	if len(peer.knownOrder) >= gossipKnownMax {
+		delete(peer.known, peer.knownOrder[0])
+		peer.knownOrder = peer.knownOrder[1:]
+	}
+	peer.known[string(id)] = struct{}{}
+	peer.knownOrder = append(peer.knownOrder, string(id))
+	return true
+}
+
+// queueInventory queues the transaction hash for announcement, unless the peer already knows it.
+func (peer *Peer) queueInventory(id []byte) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	if peer.learnedLocked(id) && len(peer.inventory) < gossipKnownMax {
+		peer.inventory = append(peer.inventory, id)
+	}
+}
+
+// takeInventory removes up to count queued hashes.
+func (peer *Peer) takeInventory(count int) (hashes [][]byte) {
+	peer.infoMutex.Lock()
+	defer peer.infoMutex.Unlock()
+	if count > len(peer.inventory) {
+		count = len(peer.inventory)
+	}
+	hashes = peer.inventory[:count:count]
+	peer.inventory = peer.inventory[count:]
+	return hashes
+}
+
 func (peer *Peer) String() string {
 	return peer.RemoteAddr().String()
 }
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	pexInterval   = 5 * time.Minute  // Interval between peer exchange requests to a peer
+	pexRetry      = 30 * time.Second // Interval after an empty response, the peer may not know other nodes yet
+	pexEntriesMax = 32               // Maximum count of peers requested and answered
+)
+
+// exchangePeers requests peers from every authenticated peer that was not asked recently. It is called from OnTick.
+func (server *TcpServer) exchangePeers() {
+	for _, peer := range server.LookupTable.Peers() {
+		if !peer.pexDue() {
+			continue
+		}
+		peer.pexRequested(pexInterval)
+		if err := server.SendPacket(peer, EncodeGetPeers(pexEntriesMax)); err != nil {
+			log.Printf("[%X]: PEX -> request failed %v", peer.NodeID, err)
+		}
+	}
+}
+
+// handlePeerExchange answers peer requests from the LookupTable and adds the peers of responses to the address book.
+func (server *TcpServer) handlePeerExchange(packet *IncomingPacket) {
+	if !packet.Peer.Authenticated {
+		return
+	}
+
+	switch packet.Body.Command {
+	case CommandGetPeers:
+		count, err := DecodeGetPeers(packet.Body.Payload)
+		if err != nil {
+			log.Printf("[%X]: PEX -> invalid request %v", packet.NodeID, err)
+			return
+		}
+		if count > pexEntriesMax {
+			count = pexEntriesMax
+		}
+
+		var records []*PeerRecord
+		for _, peer := range server.LookupTable.Peers() {
+			addresses := peer.Addresses()
+			if !peer.Authenticated || bytes.Equal(peer.NodeID, packet.NodeID) || len(addresses) == 0 {
+				continue
+			}
+			record := &PeerRecord{NodeID: peer.NodeID, PublicKey: peer.PublicKey, Addresses: addresses}
+			if node := peer.NodeInfo(); node != nil {
+				record.Features = node.FeaturesSupport()
+			}
+			records = append(records, record)
+		}
+		rand.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+		if len(records) > int(count) {
+			records = records[:count]
+		}
+
+		if err = server.SendPacket(packet.Peer, EncodePeers(records)); err != nil {
+			log.Printf("[%X]: PEX -> response failed %v", packet.NodeID, err)
+		}
+
+	case CommandPeers:
+		// unsolicited responses are ignored
+		if !packet.Peer.pexAnswered() {
+			return
+		}
+		records, err := DecodePeers(packet.Body.Payload)
+		if err != nil {
+			log.Printf("[%X]: PEX -> invalid response %v", packet.NodeID, err)
+			return
+		}
+		if len(records) == 0 {
+			packet.Peer.pexRetry(pexRetry)
+		} else if len(records) > pexEntriesMax {
+			records = records[:pexEntriesMax]
+		}
+
+		added := 0
+		for _, record := range records {
+			if bytes.Equal(record.NodeID, packet.NodeID) {
+				continue
+			}
+			if server.AddressBook.Add(record.PublicKey, record.Features, record.Addresses) {
+				added++
+			}
+		}
+		log.Printf("[%X]: PEX -> received %d peers, %d new", packet.NodeID, len(records), added)
+	}
+}
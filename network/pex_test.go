@@ -0,0 +1,107 @@
+package network
+
+import (
+	"blockchain/chain"
+	"blockchain/hash"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// expectPeerRecords fails unless the records have the public keys, features and addresses of the expected ones.
+func expectPeerRecords(t *testing.T, records, expected []*PeerRecord) {
+	t.Helper()
+	if len(records) != len(expected) {
+		t.Fatalf("%d records, expected %d", len(records), len(expected))
+	}
+	for n := range records {
+		if !records[n].PublicKey.IsEqual(expected[n].PublicKey) || !bytes.Equal(records[n].NodeID, expected[n].NodeID) ||
+			records[n].Features != expected[n].Features || fmt.Sprint(records[n].Addresses) != fmt.Sprint(expected[n].Addresses) {
+			t.Fatalf("record %d: %+v, expected %+v", n, records[n], expected[n])
+		}
+	}
+}
+
+func TestPeersRoundtrip(t *testing.T) {
+	var records []*PeerRecord
+	for n := 0; n < 3; n++ {
+		publicKey := newTestKey(t).PubKey()
+		record := &PeerRecord{NodeID: hash.PublicKey2NodeID(publicKey), PublicKey: publicKey, Features: uint8(n)}
+		for m := 0; m < n; m++ {
+			record.Addresses = append(record.Addresses, fmt.Sprintf("10.0.0.%d:%d", n, 1000+m))
+		}
+		records = append(records, record)
+	}
+	packetBody := EncodePeers(records)
+	decoded, err := DecodePeers(packetBody.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPeerRecords(t, decoded, records)
+
+	// truncated payloads are malformed
+	for length := 0; length < len(packetBody.Payload); length++ {
+		if _, err = DecodePeers(packetBody.Payload[:length]); err == nil {
+			t.Fatalf("length %d decoded", length)
+		}
+	}
+
+	// the peers that do not fit into a packet are left out
+	for len(records) < 100 {
+		records = append(records, records[2])
+	}
+	if packetBody = EncodePeers(records); len(packetBody.Payload) > maxBodyLength || int(packetBody.Payload[0]) >= len(records) {
+		t.Fatalf("%d peers in %d bytes", packetBody.Payload[0], len(packetBody.Payload))
+	}
+	if decoded, err = DecodePeers(packetBody.Payload); err != nil || len(decoded) != int(packetBody.Payload[0]) {
+		t.Fatalf("%d peers, error %v", len(decoded), err)
+	}
+
+	if count, err := DecodeGetPeers(EncodeGetPeers(7).Payload); err != nil || count != 7 {
+		t.Fatalf("count %d, error %v", count, err)
+	}
+	if _, err = DecodeGetPeers([]byte{1, 2}); err != ErrorPayloadMalformed {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestPeerExchange(t *testing.T) {
+	server := newTestServer(t)
+	server.AddressBook = newTestAddressBook(t, server)
+	requester, requesterKey := newTestPeer(t, server)
+	requester.addAddresses("10.0.0.1:1000")
+	validator, _ := newTestPeer(t, server)
+	validator.addAddresses("10.0.0.2:1000")
+	validator.SetNodeInfo(&chain.Node{IsValidator: true})
+	unreachable, _ := newTestPeer(t, server)
+
+	// the answer contains the other peers with addresses, not the requester
+	server.handlePeerExchange(&IncomingPacket{Peer: requester, NodeID: requester.NodeID, Body: *EncodeGetPeers(pexEntriesMax)})
+	packets := sentTestPackets(t, requester, requesterKey)
+	if len(packets) != 1 || packets[0].Body.Command != CommandPeers {
+		t.Fatalf("%d packets", len(packets))
+	}
+	records, err := DecodePeers(packets[0].Body.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validatorRecord := &PeerRecord{NodeID: validator.NodeID, PublicKey: validator.PublicKey, Features: 1 << chain.FeatureValidator,
+		Addresses: []string{"10.0.0.2:1000"}}
+	expectPeerRecords(t, records, []*PeerRecord{validatorRecord})
+
+	// unsolicited responses are ignored, the record of the sender itself is skipped
+	response := EncodePeers([]*PeerRecord{
+		validatorRecord,
+		{NodeID: unreachable.NodeID, PublicKey: unreachable.PublicKey, Addresses: []string{"10.0.0.3:1000"}},
+	})
+	server.handlePeerExchange(&IncomingPacket{Peer: unreachable, NodeID: unreachable.NodeID, Body: *response})
+	if server.AddressBook.Count() != 0 {
+		t.Fatalf("%d entries", server.AddressBook.Count())
+	}
+	unreachable.pexRequested(pexInterval)
+	server.handlePeerExchange(&IncomingPacket{Peer: unreachable, NodeID: unreachable.NodeID, Body: *response})
+	entries := server.AddressBook.Entries()
+	if len(entries) != 1 || !bytes.Equal(entries[0].NodeID, validator.NodeID) || entries[0].Features != 1<<chain.FeatureValidator {
+		t.Fatalf("%d entries", len(entries))
+	}
+}
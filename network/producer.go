@@ -0,0 +1,61 @@
+package network
+
+import (
+	"blockchain/chain"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// BlockProducer produces the blocks of the slots in which this node is the leader. It runs only on validators.
+type BlockProducer struct {
+	server     *TcpServer
+	blockchain *chain.Blockchain
+	privateKey *btcec.PrivateKey
+	slot       uint64 // latest slot a block was produced for
+}
+
+func newBlockProducer(server *TcpServer, blockchain *chain.Blockchain, privateKey *btcec.PrivateKey) *BlockProducer {
+	if !blockchain.Schedule.IsValidator(privateKey.PubKey()) {
+		log.Printf("Block producer: public key %X is not in the validator set, no blocks will be produced", privateKey.PubKey().SerializeCompressed())
+	}
+	return &BlockProducer{server: server, blockchain: blockchain, privateKey: privateKey}
+}
+
+// maintain produces the block if this node is the leader of the current slot. It is called from OnTick. The block gets
+// the timestamp the slot was determined from. The new height is broadcast by the BlockchainUpdate callback, the block
+// itself is not pushed: peers pull it by their sync.
+func (producer *BlockProducer) maintain() {
+	schedule := producer.blockchain.Schedule
+	timestamp := uint64(time.Now().UnixMilli())
+	slot := schedule.Slot(timestamp)
+	if slot == producer.slot {
+		return
+	}
+	if leader := schedule.Leader(slot); leader == nil || !leader.IsEqual(producer.privateKey.PubKey()) {
+		return
+	}
+	producer.slot = slot
+
+	// a block on top of an outdated blockchain would be orphaned
+	if atomic.LoadInt32(&producer.server.Sync.active) != 0 {
+		log.Printf("Block producer: skipping slot %d while syncing", slot)
+		return
+	}
+	block, err := producer.blockchain.ProduceBlock(producer.privateKey, timestamp)
+	if err != nil {
+		log.Printf("Block producer: producing block for slot %d failed %v", slot, err)
+		return
+	}
+	log.Printf("Block producer: produced block %d with %d transactions for slot %d", block.Height, len(block.Transactions), slot)
+}
+
+// broadcastHeight announces the new blockchain height to all authenticated peers.
+func (server *TcpServer) broadcastHeight(version, height uint64) {
+	for _, peer := range server.LookupTable.Peers() {
+		if err := server.SendPacket(peer, EncodeNewBlock(version, height)); err != nil {
+			log.Printf("[%X]: NewBlock -> sending failed %v", peer.NodeID, err)
+		}
+	}
+}
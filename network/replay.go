@@ -0,0 +1,142 @@
+package network
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrorReplayedPacket = errors.New("REPLAYED PACKET")
+var ErrorPacketTimestamp = errors.New("PACKET TIMESTAMP OUTSIDE CLOCK SKEW TOLERANCE")
+
+const (
+	replayWindowSize     = 64               // Sequences below the highest accepted one that are still tracked individually.
+	replayWindowExpire   = 10 * time.Minute // Windows of senders without an accepted packet for this duration are dropped.
+	DefaultMaxClockSkew  = 30 * time.Second // Default tolerance between the packet timestamp and the local clock.
+	replayNoncesMaxCount = 4096             // Upper limit of nonces remembered per sender.
+	replayRejectMax      = 10               // Rejected packets of a peer within replayRejectWindow that are penalized.
+	replayRejectWindow   = time.Minute      // Time in which replayRejectMax rejected packets are penalized.
+	replayRejectPenalty  = 25               // Penalty points for replayRejectMax rejected packets.
+)
+
+// replayWindow tracks the accepted packets of a single sender.
+type replayWindow struct {
+	highest  uint32            // Highest accepted sequence
+	bitmap   uint64            // Bit i is set if sequence highest-i was accepted
+	newest   uint64            // Newest accepted timestamp
+	nonces   map[string]uint64 // Accepted nonces with the packet timestamp, only within the clock skew tolerance
+	lastSeen time.Time         // Time of the latest accepted packet
+}
+
+// ReplayFilter drops packets that were already accepted from the same sender. Each sender (node ID) has a sliding
+// window over the sequence numbers and a list of recent nonces. Timestamps outside the clock skew are rejected, which
+// bounds how long nonces must be remembered.
+type ReplayFilter struct {
+	MaxClockSkew time.Duration
+
+	windows map[string]*replayWindow
+	mutex   sync.Mutex
+}
+
+// Accept checks the packet against the senders window and records it if it is accepted.
+func (filter *ReplayFilter) Accept(packet *IncomingPacket) error {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	legacy := packet.Body.Protocol == ProtocolVersionLegacy
+	now := uint64(packet.ReceivedAt.UnixMilli())
+	skew := uint64(filter.maxClockSkew().Milliseconds())
+
+	// the legacy format has no timestamp
+	if !legacy && (packet.Body.Timestamp+skew < now || packet.Body.Timestamp > now+skew) {
+		return ErrorPacketTimestamp
+	}
+
+	if filter.windows == nil {
+		filter.windows = make(map[string]*replayWindow)
+	}
+	window := filter.windows[string(packet.NodeID)]
+	if window == nil {
+		window = &replayWindow{nonces: make(map[string]uint64)}
+		filter.windows[string(packet.NodeID)] = window
+	}
+
+	// forget nonces that are outside the clock skew, packets carrying them are rejected by the timestamp check
+	for nonce, timestamp := range window.nonces {
+		if timestamp+skew < now {
+			delete(window.nonces, nonce)
+		}
+	}
+	if _, found := window.nonces[string(packet.Nonce)]; found {
+		return ErrorReplayedPacket
+	}
+
+	if !window.acceptSequence(packet.Body.Sequence) {
+		// A replayed packet can never be newer than all accepted ones. A newer one with an old sequence means the sender
+		// restarted its counter.
+		if legacy || packet.Body.Timestamp <= window.newest {
+			return ErrorReplayedPacket
+		}
+		log.Printf("[%X]: ReplayFilter -> sequence reset to %d", packet.NodeID, packet.Body.Sequence)
+		window.highest = packet.Body.Sequence
+		window.bitmap = 1
+	}
+
+	if !legacy {
+		if len(window.nonces) < replayNoncesMaxCount {
+			window.nonces[string(packet.Nonce)] = packet.Body.Timestamp
+		}
+		if packet.Body.Timestamp > window.newest {
+			window.newest = packet.Body.Timestamp
+		}
+	}
+
+	// rejected packets do not keep the window alive, so that a restarted legacy sender is accepted again once it is pruned
+	window.lastSeen = packet.ReceivedAt
+	return nil
+}
+
+// Prune drops the windows of senders without a recently accepted packet.
+func (filter *ReplayFilter) Prune() {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	for nodeID, window := range filter.windows {
+		if time.Since(window.lastSeen) > replayWindowExpire && time.Since(window.lastSeen) > 2*filter.maxClockSkew() {
+			delete(filter.windows, nodeID)
+		}
+	}
+}
+
+func (filter *ReplayFilter) maxClockSkew() time.Duration {
+	if filter.MaxClockSkew <= 0 {
+		return DefaultMaxClockSkew
+	}
+	return filter.MaxClockSkew
+}
+
+// acceptSequence marks the sequence as seen. It returns false if the sequence was already seen or is too old.
+func (window *replayWindow) acceptSequence(sequence uint32) bool {
+	switch {
+	case window.bitmap == 0 || sequence > window.highest:
+		shift := uint64(sequence - window.highest)
+		if window.bitmap == 0 || shift >= replayWindowSize {
+			window.bitmap = 0
+		} else {
+			window.bitmap <<= shift
+		}
+		window.bitmap |= 1
+		window.highest = sequence
+		return true
+	case window.highest-sequence < replayWindowSize:
+		bit := uint64(1) << (window.highest - sequence)
+		if window.bitmap&bit != 0 {
+			return false
+		}
+		window.bitmap |= bit
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,187 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// replayTestPacket returns a packet of the sender. Each nonce byte must be unique unless a replay is tested.
+func replayTestPacket(protocol uint8, sequence uint32, timestamp, receivedAt time.Time, nonce byte) *IncomingPacket {
+	packet := &IncomingPacket{
+		NodeID:     []byte{1},
+		Nonce:      []byte{nonce},
+		ReceivedAt: receivedAt,
+		Body:       PacketBody{Protocol: protocol, Sequence: sequence},
+	}
+	if protocol == ProtocolVersion {
+		packet.Body.Timestamp = uint64(timestamp.UnixMilli())
+	}
+	return packet
+}
+
+func TestReplayWindow(t *testing.T) {
+	now := time.Now()
+	filter := &ReplayFilter{}
+	expect := func(sequence uint32, timestamp time.Time, nonce byte, expected error) {
+		t.Helper()
+		if err := filter.Accept(replayTestPacket(ProtocolVersion, sequence, timestamp, now, nonce)); err != expected {
+			t.Fatalf("sequence %d nonce %d: error %v, expected %v", sequence, nonce, err, expected)
+		}
+	}
+
+	expect(100, now, 1, nil)
+	// the same packet, and the same sequence with another nonce
+	expect(100, now, 1, ErrorReplayedPacket)
+	expect(100, now.Add(-time.Millisecond), 2, ErrorReplayedPacket)
+
+	// out of order within the window, each sequence once
+	expect(99, now.Add(-time.Millisecond), 3, nil)
+	expect(100-replayWindowSize+1, now.Add(-time.Millisecond), 4, nil)
+	expect(100-replayWindowSize+1, now.Add(-time.Millisecond), 5, ErrorReplayedPacket)
+	// older than the window
+	expect(100-replayWindowSize, now.Add(-time.Millisecond), 6, ErrorReplayedPacket)
+
+	// moving the window forward drops the old sequences
+	expect(100+replayWindowSize, now, 7, nil)
+	expect(100, now.Add(-time.Millisecond), 8, ErrorReplayedPacket)
+	expect(101, now.Add(-time.Millisecond), 9, nil)
+	expect(101, now.Add(-time.Millisecond), 10, ErrorReplayedPacket)
+}
+
+func TestReplaySequenceReset(t *testing.T) {
+	now := time.Now()
+	filter := &ReplayFilter{}
+	for sequence := uint32(1000); sequence < 1010; sequence++ {
+		if err := filter.Accept(replayTestPacket(ProtocolVersion, sequence, now, now, byte(sequence-900))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an old sequence that is not newer than all accepted packets is a replay
+	if err := filter.Accept(replayTestPacket(ProtocolVersion, 1, now, now, 1)); err != ErrorReplayedPacket {
+		t.Fatalf("error %v", err)
+	}
+	// the restarted sender starts again with a newer timestamp
+	restart := now.Add(time.Millisecond)
+	if err := filter.Accept(replayTestPacket(ProtocolVersion, 1, restart, now, 2)); err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if err := filter.Accept(replayTestPacket(ProtocolVersion, 2, restart, now, 3)); err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if err := filter.Accept(replayTestPacket(ProtocolVersion, 1, restart, now, 4)); err != ErrorReplayedPacket {
+		t.Fatalf("error %v", err)
+	}
+	// the packets before the restart are not accepted again
+	if err := filter.Accept(replayTestPacket(ProtocolVersion, 1009, now, now, 109)); err != ErrorReplayedPacket {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestReplayClockSkew(t *testing.T) {
+	now := time.Now()
+	filter := &ReplayFilter{MaxClockSkew: time.Second}
+	for _, test := range []struct {
+		offset   time.Duration
+		expected error
+	}{
+		{-2 * time.Second, ErrorPacketTimestamp},
+		{2 * time.Second, ErrorPacketTimestamp},
+		{-time.Second + time.Millisecond, nil},
+		{time.Second - time.Millisecond, nil},
+	} {
+		packet := replayTestPacket(ProtocolVersion, uint32(test.offset/time.Millisecond)+10000, now.Add(test.offset), now, byte(test.offset/time.Millisecond))
+		if err := filter.Accept(packet); err != test.expected {
+			t.Fatalf("offset %s: error %v, expected %v", test.offset, err, test.expected)
+		}
+	}
+
+	// legacy packets have no timestamp
+	filter = &ReplayFilter{MaxClockSkew: time.Second}
+	if err := filter.Accept(replayTestPacket(ProtocolVersionLegacy, 1, time.Time{}, now, 1)); err != nil {
+		t.Fatalf("legacy: error %v", err)
+	}
+}
+
+func TestReplayPrune(t *testing.T) {
+	filter := &ReplayFilter{}
+	accepted := time.Now().Add(-replayWindowExpire - time.Minute)
+	if err := filter.Accept(replayTestPacket(ProtocolVersionLegacy, 100, time.Time{}, accepted, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted legacy sender is rejected until the window is pruned, rejected packets do not keep it alive
+	now := time.Now()
+	for sequence := uint32(1); sequence <= 3; sequence++ {
+		if err := filter.Accept(replayTestPacket(ProtocolVersionLegacy, sequence, time.Time{}, now, byte(sequence))); err != ErrorReplayedPacket {
+			t.Fatalf("sequence %d: error %v", sequence, err)
+		}
+	}
+	filter.Prune()
+	if len(filter.windows) != 0 {
+		t.Fatal("window not pruned")
+	}
+	if err := filter.Accept(replayTestPacket(ProtocolVersionLegacy, 1, time.Time{}, now, 4)); err != nil {
+		t.Fatalf("error %v", err)
+	}
+
+	// the window of a recently accepted sender is kept
+	filter.Prune()
+	if len(filter.windows) != 1 {
+		t.Fatal("window pruned")
+	}
+}
+
+func TestReplayRejectWindow(t *testing.T) {
+	now := time.Now()
+	peer := &Peer{}
+	for n := 1; n < replayRejectMax; n++ {
+		if peer.reject(now) {
+			t.Fatalf("penalized after %d rejections", n)
+		}
+	}
+	// the rejections of an expired window are not counted
+	later := now.Add(replayRejectWindow + time.Second)
+	for n := 1; n < replayRejectMax; n++ {
+		if peer.reject(later) {
+			t.Fatalf("penalized after %d rejections in a new window", n)
+		}
+	}
+	if !peer.reject(later) || peer.reject(later) || peer.RejectedPackets() != 2*replayRejectMax {
+		t.Fatalf("%d rejected packets", peer.RejectedPackets())
+	}
+}
+
+func TestReplayPenalty(t *testing.T) {
+	server := newTestServer(t)
+	server.replayFilter = &ReplayFilter{}
+	data := encodeTestPacket(t, newTestKey(t), server.PublicKey, 1, "ping")
+
+	// the packet was accepted before, every copy is a replay
+	var codec Codec
+	packet, err := codec.Decode(&Peer{Conn: &testConn{inbound: data}}, server.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.replayFilter.Accept(packet); err != nil {
+		t.Fatal(err)
+	}
+	conn := &testConn{}
+	peer := &Peer{Conn: conn, Codec: &Codec{}}
+	conn.SetContext(peer)
+
+	// each replayRejectMax replays add the penalty, the connection is closed at peerPenaltyMax
+	for n := 1; n*replayRejectPenalty < peerPenaltyMax; n++ {
+		conn.inbound = bytes.Repeat(data, replayRejectMax)
+		if action := server.OnTraffic(conn); action != gnet.None || peer.PenaltyPoints() != uint32(n*replayRejectPenalty) {
+			t.Fatalf("action %d penalty %d", action, peer.PenaltyPoints())
+		}
+	}
+	conn.inbound = bytes.Repeat(data, replayRejectMax)
+	if action := server.OnTraffic(conn); action != gnet.Close || peer.PenaltyPoints() != peerPenaltyMax {
+		t.Fatalf("action %d penalty %d", action, peer.PenaltyPoints())
+	}
+}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"blockchain/hash"
+	"bytes"
+	"crypto/rand"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	nodeIDSize        = 32               // Node IDs are blake3 hashes of the public key
+	bucketCount       = nodeIDSize * 8   // One bucket per bit of the distance
+	bucketSize        = 20               // k, maximum contacts per bucket and result size of lookups
+	bucketRefreshTime = 15 * time.Minute // Buckets without lookup for this duration are refreshed
+)
+
+// Contact is a remote node known to the routing table.
+type Contact struct {
+	NodeID    []byte
+	PublicKey *btcec.PublicKey
+	Addresses []string // IP:Port
+	LastSeen  time.Time
+}
+
+// NewContact creates a contact from the public key.
+func NewContact(publicKey *btcec.PublicKey, addresses []string) *Contact {
+	return &Contact{NodeID: hash.PublicKey2NodeID(publicKey), PublicKey: publicKey, Addresses: addresses, LastSeen: time.Now()}
+}
+
+// bucket holds the contacts of one distance range, least recently seen first.
+type bucket struct {
+	contacts   []*Contact
+	lastLookup time.Time
+}
+
+// RoutingTable is a Kademlia k-bucket routing table. Bucket i holds the contacts whose XOR distance to the local node
+// ID has its highest set bit at position i.
+type RoutingTable struct {
+	self    []byte
+	buckets [bucketCount]bucket
+	mutex   sync.RWMutex
+
+	// isConnected reports whether a contact is reachable. Connected contacts are not evicted from full buckets.
+	isConnected func(nodeID []byte) bool
+}
+
+// NewRoutingTable creates an empty routing table for the local node ID.
+func NewRoutingTable(self []byte, isConnected func(nodeID []byte) bool) *RoutingTable {
+	table := &RoutingTable{self: self, isConnected: isConnected}
+	now := time.Now()
+	for n := range table.buckets {
+		table.buckets[n].lastLookup = now
+	}
+	return table
+}
+
+// distance returns the XOR distance of two node IDs.
+func distance(a, b []byte) (result []byte) {
+	result = make([]byte, nodeIDSize)
+	for n := 0; n < nodeIDSize && n < len(a) && n < len(b); n++ {
+		result[n] = a[n] ^ b[n]
+	}
+	return result
+}
+
+// bucketIndex returns the bucket for the node ID, -1 for the own ID.
+func (table *RoutingTable) bucketIndex(nodeID []byte) int {
+	d := distance(table.self, nodeID)
+	for n, b := range d {
+		if b != 0 {
+			return (nodeIDSize-n)*8 - 1 - bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// Add inserts or refreshes the contact. If the bucket is full the least recently seen contact is replaced, unless it is
+// connected, in which case the new contact is discarded.
+func (table *RoutingTable) Add(contact *Contact) {
+	index := table.bucketIndex(contact.NodeID)
+	if index < 0 {
+		return
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	b := &table.buckets[index]
+
+	for n, existing := range b.contacts {
+		if bytes.Equal(existing.NodeID, contact.NodeID) {
+			// move to the tail as most recently seen, keep known addresses if the new contact has none
+			if len(contact.Addresses) == 0 {
+				contact.Addresses = existing.Addresses
+			}
+			b.contacts = append(append(b.contacts[:n:n], b.contacts[n+1:]...), contact)
+			return
+		}
+	}
+
+	if len(b.contacts) < bucketSize {
+		b.contacts = append(b.contacts, contact)
+		return
+	}
+
+	if table.isConnected != nil && table.isConnected(b.contacts[0].NodeID) {
+		return
+	}
+	b.contacts = append(b.contacts[1:], contact)
+}
+
+// Remove deletes the contact, for example if it is not reachable.
+func (table *RoutingTable) Remove(nodeID []byte) {
+	index := table.bucketIndex(nodeID)
+	if index < 0 {
+		return
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	b := &table.buckets[index]
+
+	for n, existing := range b.contacts {
+		if bytes.Equal(existing.NodeID, nodeID) {
+			b.contacts = append(b.contacts[:n:n], b.contacts[n+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to count contacts sorted by distance to the target.
+func (table *RoutingTable) Closest(target []byte, count int) (contacts []*Contact) {
+	table.mutex.RLock()
+	for n := range table.buckets {
+		contacts = append(contacts, table.buckets[n].contacts...)
+	}
+	table.mutex.RUnlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
+
+// Count returns the count of all contacts.
+func (table *RoutingTable) Count() (count int) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	for n := range table.buckets {
+		count += len(table.buckets[n].contacts)
+	}
+	return count
+}
+
+// markLookup records a lookup for the target, which postpones the refresh of its bucket.
+func (table *RoutingTable) markLookup(target []byte) {
+	index := table.bucketIndex(target)
+	if index < 0 {
+		return
+	}
+	table.mutex.Lock()
+	table.buckets[index].lastLookup = time.Now()
+	table.mutex.Unlock()
+}
+
+// staleBuckets returns a random node ID for every non-empty bucket that was not looked up recently.
+func (table *RoutingTable) staleBuckets() (targets [][]byte) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	for n := range table.buckets {
+		if len(table.buckets[n].contacts) > 0 && time.Since(table.buckets[n].lastLookup) > bucketRefreshTime {
+			targets = append(targets, table.randomIDInBucket(n))
+		}
+	}
+	return targets
+}
+
+// randomIDInBucket returns a random node ID whose distance falls into the bucket.
+func (table *RoutingTable) randomIDInBucket(index int) (nodeID []byte) {
+	d := make([]byte, nodeIDSize)
+	rand.Read(d)
+
+	// the bit at position index is set, all higher bits are cleared
+	byteIndex := nodeIDSize - 1 - index/8
+	for n := 0; n < byteIndex; n++ {
+		d[n] = 0
+	}
+	bit := byte(1) << (index % 8)
+	d[byteIndex] = d[byteIndex]&(bit-1) | bit
+
+	return distance(table.self, d)
+}
+
+// sortByDistance sorts the contacts by XOR distance to the target, closest first.
+func sortByDistance(contacts []*Contact, target []byte) {
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return bytes.Compare(distance(contacts[i].NodeID, target), distance(contacts[j].NodeID, target)) < 0
+	})
+}
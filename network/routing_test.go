@@ -0,0 +1,121 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testNodeID returns a node ID with the first byte and the last byte set, the other bytes are 0.
+func testNodeID(first, last byte) []byte {
+	nodeID := make([]byte, nodeIDSize)
+	nodeID[0], nodeID[nodeIDSize-1] = first, last
+	return nodeID
+}
+
+func TestRoutingBucketIndex(t *testing.T) {
+	table := NewRoutingTable(make([]byte, nodeIDSize), nil)
+	for _, test := range []struct {
+		nodeID []byte
+		index  int
+	}{
+		{testNodeID(0, 0), -1},
+		{testNodeID(0, 1), 0},
+		{testNodeID(0, 2), 1},
+		{testNodeID(0, 0xFF), 7},
+		{testNodeID(1, 0), bucketCount - 8},
+		{testNodeID(0x80, 0), bucketCount - 1},
+		{testNodeID(0xFF, 0xFF), bucketCount - 1},
+	} {
+		if index := table.bucketIndex(test.nodeID); index != test.index {
+			t.Errorf("node ID %X: bucket %d, expected %d", test.nodeID, index, test.index)
+		}
+	}
+
+	// random IDs of a bucket fall into it
+	table = NewRoutingTable(testNodeID(0x5A, 0xA5), nil)
+	for _, index := range []int{0, 7, 8, 100, bucketCount - 1} {
+		if nodeID := table.randomIDInBucket(index); table.bucketIndex(nodeID) != index {
+			t.Errorf("random node ID %X not in bucket %d", nodeID, index)
+		}
+	}
+}
+
+func TestRoutingBucketEvict(t *testing.T) {
+	connected := make(map[string]bool)
+	table := NewRoutingTable(make([]byte, nodeIDSize), func(nodeID []byte) bool { return connected[string(nodeID)] })
+	index := bucketCount - 1
+	for n := 0; n < bucketSize; n++ {
+		table.Add(&Contact{NodeID: testNodeID(0x80, byte(n)), Addresses: []string{"127.0.0.1:1"}})
+	}
+	expectBucket := func(expected ...byte) {
+		t.Helper()
+		contacts := table.buckets[index].contacts
+		if len(contacts) != len(expected) {
+			t.Fatalf("%d contacts, expected %d", len(contacts), len(expected))
+		}
+		for n := range contacts {
+			if !bytes.Equal(contacts[n].NodeID, testNodeID(0x80, expected[n])) {
+				t.Fatalf("contact %d: node ID %X", n, contacts[n].NodeID)
+			}
+		}
+	}
+	ordered := func(first, last byte, tail ...byte) (list []byte) {
+		for n := first; n <= last; n++ {
+			list = append(list, n)
+		}
+		return append(list, tail...)
+	}
+
+	// a known contact moves to the tail and keeps its addresses
+	table.Add(&Contact{NodeID: testNodeID(0x80, 0)})
+	expectBucket(ordered(1, bucketSize-1, 0)...)
+	if contacts := table.buckets[index].contacts; len(contacts[bucketSize-1].Addresses) != 1 {
+		t.Fatal("addresses lost")
+	}
+
+	// a new contact replaces the least recently seen one, unless that one is connected
+	table.Add(&Contact{NodeID: testNodeID(0x80, 100)})
+	expectBucket(ordered(2, bucketSize-1, 0, 100)...)
+	connected[string(testNodeID(0x80, 2))] = true
+	table.Add(&Contact{NodeID: testNodeID(0x80, 101)})
+	expectBucket(ordered(2, bucketSize-1, 0, 100)...)
+
+	// other buckets are not affected, the own node ID is never added
+	table.Add(&Contact{NodeID: testNodeID(0, 1)})
+	table.Add(&Contact{NodeID: make([]byte, nodeIDSize)})
+	if table.Count() != bucketSize+1 || len(table.buckets[0].contacts) != 1 {
+		t.Fatalf("count %d", table.Count())
+	}
+
+	table.Remove(testNodeID(0x80, 2))
+	table.Add(&Contact{NodeID: testNodeID(0x80, 101)})
+	expectBucket(ordered(3, bucketSize-1, 0, 100, 101)...)
+}
+
+func TestRoutingClosest(t *testing.T) {
+	table := NewRoutingTable(make([]byte, nodeIDSize), nil)
+	for _, nodeID := range [][]byte{testNodeID(0x80, 0), testNodeID(0, 3), testNodeID(0x40, 0), testNodeID(0, 1)} {
+		table.Add(&Contact{NodeID: nodeID})
+	}
+	contacts := table.Closest(testNodeID(0, 2), 3)
+	if len(contacts) != 3 || !bytes.Equal(contacts[0].NodeID, testNodeID(0, 3)) || !bytes.Equal(contacts[1].NodeID, testNodeID(0, 1)) ||
+		!bytes.Equal(contacts[2].NodeID, testNodeID(0x40, 0)) {
+		t.Fatalf("%d contacts", len(contacts))
+	}
+
+	// buckets that were not looked up recently are refreshed
+	for n := range table.buckets {
+		table.buckets[n].lastLookup = time.Now().Add(-bucketRefreshTime - time.Second)
+	}
+	table.markLookup(testNodeID(0x80, 1))
+	targets := table.staleBuckets()
+	if len(targets) != 3 {
+		t.Fatalf("%d stale buckets", len(targets))
+	}
+	for _, target := range targets {
+		if index := table.bucketIndex(target); index > 1 && index != bucketCount-2 {
+			t.Fatalf("stale bucket %d", index)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/panjf2000/gnet/v2"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,10 +18,22 @@ type TcpServer struct {
 	port      uint16
 	multicore bool
 
+	allowLegacy  bool           // accept packets in the legacy format
+	replayFilter *ReplayFilter  // drops replayed packets
+	keepAlive    *KeepAlive     // pings peers and disconnects silent ones
+	sequence     uint32         // sequence of the last outgoing packet
+	dialer       *Dialer        // outbound connections to seeds
+	producer     *BlockProducer // produces blocks, nil if the node is not a validator
+
 	Node        *chain.Node
+	Blockchain  *chain.Blockchain
+	Sync        *SyncManager
+	Gossip      *TransactionGossip
 	PrivateKey  *btcec.PrivateKey
 	PublicKey   *btcec.PublicKey
 	LookupTable *LookupTable
+	AddressBook *AddressBook
+	DHT         *DHT
 }
 
 func (server *TcpServer) OnBoot(engine gnet.Engine) gnet.Action {
@@ -29,17 +42,34 @@ func (server *TcpServer) OnBoot(engine gnet.Engine) gnet.Action {
 	server.Node.PublicKey = server.PublicKey
 	server.Node.ID = hash.PublicKey2NodeID(server.Node.PublicKey)
 	server.Node.Port = server.port
+	server.Node.IsValidator = server.producer != nil
+	server.Node.BlockchainHeight = server.Blockchain.Height()
+	server.Node.BlockchainVersion = server.Blockchain.Version()
+	server.Node.ChainID = server.Blockchain.ChainID()
+	server.Blockchain.BlockchainUpdate = func(blockchain *chain.Blockchain, oldHeight, oldVersion, newHeight, newVersion uint64) {
+		atomic.StoreUint64(&server.Node.BlockchainHeight, newHeight)
+		atomic.StoreUint64(&server.Node.BlockchainVersion, newVersion)
+		// the blockchain is locked while the callback runs
+		if newHeight > oldHeight || newVersion > oldVersion {
+			go server.broadcastHeight(newVersion, newHeight)
+		}
+	}
+	server.Blockchain.Mempool.TransactionAdded = server.Gossip.announce
 	log.Printf("Server Node public key: %X", server.Node.PublicKey.SerializeCompressed())
 	log.Printf("Server Node ID: %X", server.Node.ID)
+	server.DHT.start(server.Node.ID)
 	log.Printf("TCP server with multi-core=%t is listening on %s\n", server.multicore, fmt.Sprintf("tcp://:%d", server.port))
+
+	if err := server.dialer.Start(); err != nil {
+		log.Printf("OnBoot: starting dialer failed %v", err)
+	}
 	return gnet.None
 }
 
 func (server *TcpServer) OnOpen(connection gnet.Conn) (out []byte, action gnet.Action) {
-	connection.SetContext(new(Codec))
-
 	log.Printf("OnOpen: connected peers %d", server.engine.CountConnections())
-	peer := &Peer{Conn: connection, ConnectionTime: time.Now()}
+	peer := &Peer{Conn: connection, Codec: &Codec{AllowLegacy: server.allowLegacy}, ConnectionTime: time.Now()}
+	connection.SetContext(peer)
 	server.LookupTable.add(peer)
 	return
 }
@@ -49,9 +79,12 @@ func (server *TcpServer) OnClose(connection gnet.Conn, err error) (action gnet.A
 	if err != nil {
 		log.Printf("[%s]: OnClose -> error occurred on connection, %v\n", connection.RemoteAddr().String(), err)
 	}
-	peer := server.LookupTable.peers[connection.RemoteAddr().String()]
+	peer, _ := connection.Context().(*Peer)
 	if peer != nil {
 		server.LookupTable.remove(peer)
+		if peer.Outbound {
+			server.dialer.closed(peer)
+		}
 	}
 	log.Printf("OnClose: connected peers %d", server.engine.CountConnections())
 
@@ -61,31 +94,68 @@ func (server *TcpServer) OnClose(connection gnet.Conn, err error) (action gnet.A
 func (server *TcpServer) OnTraffic(connection gnet.Conn) gnet.Action {
 	log.Printf("[%s]: OnTraffic -> buffered %d bytes", connection.RemoteAddr().String(), connection.InboundBuffered())
 
-	codec := connection.Context().(*Codec)
-	peer := server.LookupTable.peers[connection.RemoteAddr().String()]
+	peer, _ := connection.Context().(*Peer)
 	if peer == nil {
 		log.Printf("[%s]: OnTraffic -> peer not found closing connection", connection.RemoteAddr().String())
 		return gnet.Close
 	}
-	packet, err := codec.Decode(peer, server.Node.PublicKey)
-	if err == ErrorIncompletePacket {
-		return gnet.None
-	}
-	if err != nil {
-		log.Printf("[%s]: OnTraffic -> invalid packet %v", connection.RemoteAddr().String(), err)
-		return gnet.Close
-	}
-	log.Printf("[%s]: OnTraffic ->  %x", connection.RemoteAddr().String(), packet.Body.String())
-	if packet.Body.Command == CommandAnnouncement {
-		log.Printf("[%s]: OnTraffic -> is Authenticated", connection.RemoteAddr().String())
-		peer.Authenticated = true
+	// the buffer may contain partial or multiple packets, decode until all complete packets are consumed
+	for connection.InboundBuffered() > 0 {
+		packet, err := peer.Codec.Decode(peer, server.PrivateKey)
+		if err == ErrorIncompletePacket {
+			return gnet.None
+		}
+		if err != nil {
+			log.Printf("[%s]: OnTraffic -> invalid packet %v", connection.RemoteAddr().String(), err)
+			return gnet.Close
+		}
+		if err = server.replayFilter.Accept(packet); err != nil {
+			log.Printf("[%s]: OnTraffic -> packet rejected %v", connection.RemoteAddr().String(), err)
+			// others may replay the packets of the node, the peer is only penalized for many of them
+			if peer.reject(packet.ReceivedAt) {
+				log.Printf("[%s]: OnTraffic -> penalizing peer by %d points for %d rejected packets", connection.RemoteAddr().String(), replayRejectPenalty, replayRejectMax)
+				if peer.penalize(replayRejectPenalty) {
+					log.Printf("[%s]: OnTraffic -> disconnecting peer, penalty %d", connection.RemoteAddr().String(), peer.PenaltyPoints())
+					return gnet.Close
+				}
+			}
+			continue
+		}
+		// a connection is bound to a single node, for outbound connections it is the dialed one
+		if peer.PublicKey != nil && !peer.PublicKey.IsEqual(packet.PublicKey) {
+			log.Printf("[%s]: OnTraffic -> sender %X does not match peer %X", connection.RemoteAddr().String(), packet.PublicKey.SerializeCompressed(), peer.PublicKey.SerializeCompressed())
+			return gnet.Close
+		}
+		peer.seen(packet.ReceivedAt)
+		log.Printf("[%s]: OnTraffic ->  %x", connection.RemoteAddr().String(), packet.Body.String())
+		if packet.Body.Command == CommandAnnouncement && !peer.Authenticated {
+			// nodes of other networks are refused, the failure delays dialing them again
+			if announcement, err := DecodeAnnouncement(packet.Body.Payload); err != nil || announcement.ChainID != server.Node.ChainID {
+				log.Printf("[%s]: OnTraffic -> Announcement of another network or malformed, closing connection", connection.RemoteAddr().String())
+				server.AddressBook.failed(packet.NodeID)
+				return gnet.Close
+			}
+			log.Printf("[%s]: OnTraffic -> is Authenticated", connection.RemoteAddr().String())
+			peer.PublicKey = packet.PublicKey
+			peer.NodeID = packet.NodeID
+			peer.Authenticated = true
+			if peer.Outbound {
+				peer.addAddresses(connection.RemoteAddr().String())
+				server.dialer.authenticated(peer)
+			}
+			if drop := server.LookupTable.authenticate(peer, server.Node.ID); drop == peer {
+				return gnet.Close
+			} else if drop != nil {
+				drop.Close()
+			}
+		}
+		go ProcessPacket(packet)
 	}
-	go ProcessPacket(packet)
 	return gnet.None
 }
 
 func (server *TcpServer) OnTick() (delay time.Duration, action gnet.Action) {
-	for _, peer := range server.LookupTable.peers {
+	for _, peer := range server.LookupTable.connectionList() {
 		maintain := peer.ShouldMaintain()
 		if !maintain {
 			n, err := peer.Write([]byte("Timeout"))
@@ -99,5 +169,34 @@ func (server *TcpServer) OnTick() (delay time.Duration, action gnet.Action) {
 			}
 		}
 	}
+	server.replayFilter.Prune()
+	server.keepAlive.maintain(server)
+	server.exchangePeers()
+	server.AddressBook.maintain()
+	server.Blockchain.Mempool.Expire()
+	server.Gossip.flush()
+	if server.producer != nil {
+		server.producer.maintain()
+	}
+	server.dialer.Maintain()
+	server.DHT.maintain()
 	return time.Second, gnet.None
 }
+
+// nextSequence returns the sequence number for the next outgoing packet.
+func (server *TcpServer) nextSequence() uint32 {
+	return atomic.AddUint32(&server.sequence, 1)
+}
+
+// SendPacket encrypts the packet to the peer and writes it asynchronously. The sequence is set automatically.
+func (server *TcpServer) SendPacket(peer *Peer, packetBody *PacketBody) error {
+	if peer.PublicKey == nil {
+		return ErrorNotConnected
+	}
+	packetBody.Sequence = server.nextSequence()
+	data, err := peer.Codec.Encode(server.PrivateKey, peer.PublicKey, packetBody)
+	if err != nil {
+		return err
+	}
+	return peer.AsyncWrite(data, nil)
+}
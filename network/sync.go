@@ -0,0 +1,293 @@
+package network
+
+import (
+	"blockchain/chain"
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syncBatchSize   = 32               // Blocks requested at once
+	syncBlocksMax   = 64               // Maximum count of blocks answered per request
+	syncPartTimeout = 30 * time.Second // Timeout for receiving the next block of a request
+
+	// syncPartsMax is the maximum count of parts of a single block.
+	syncPartsMax = (chain.BlockSizeMax + blockPartSize - 1) / blockPartSize
+)
+
+var ErrorBlockNotAvailable = errors.New("BLOCK NOT AVAILABLE")
+var ErrorSyncTimeout = errors.New("SYNC TIMEOUT")
+
+// syncResult is a received block, or the error why it cannot be received.
+type syncResult struct {
+	height uint64
+	block  *chain.Block
+	err    error
+}
+
+// blockParts collects the parts of a block.
+type blockParts struct {
+	parts    [][]byte
+	received int
+}
+
+// SyncManager downloads missing blocks from a peer that announced a preferred blockchain. Only one peer is synced from
+// at a time.
+type SyncManager struct {
+	server     *TcpServer
+	blockchain *chain.Blockchain
+	active     int32 // 1 while syncing
+
+	mutex     sync.Mutex
+	peer      *Peer  // peer synced from
+	from, to  uint64 // heights of the current request, other blocks are ignored
+	incoming  map[uint64]*blockParts
+	delivered map[uint64]struct{} // heights of the current request passed to the sync goroutine
+	results   chan syncResult
+	done      chan struct{} // closed when the sync goroutine stopped
+}
+
+func newSyncManager(server *TcpServer, blockchain *chain.Blockchain) *SyncManager {
+	return &SyncManager{server: server, blockchain: blockchain}
+}
+
+// announced starts syncing from the peer if its blockchain is preferred over ours: a higher height, or the same height
+// with a higher version.
+func (manager *SyncManager) announced(peer *Peer, version, height uint64) {
+	if !manager.blockchain.PreferChain(height, version) || !atomic.CompareAndSwapInt32(&manager.active, 0, 1) {
+		return
+	}
+
+	manager.mutex.Lock()
+	manager.peer = peer
+	manager.incoming = make(map[uint64]*blockParts)
+	manager.results = make(chan syncResult, syncBatchSize)
+	manager.done = make(chan struct{})
+	done := manager.done
+	manager.mutex.Unlock()
+
+	go func() {
+		defer atomic.StoreInt32(&manager.active, 0)
+		defer close(done)
+		if err := manager.sync(peer, height); err != nil {
+			log.Printf("[%X]: Sync -> stopped at height %d: %v", peer.NodeID, manager.blockchain.Height(), err)
+			manager.server.penalizeBlock(peer, err)
+			return
+		}
+		log.Printf("[%X]: Sync -> completed at height %d", peer.NodeID, manager.blockchain.Height())
+	}()
+}
+
+// sync requests the blocks of the peer in batches and adds them in order. If the peer's chain forked off, the requests
+// step back until the common ancestor is found; the blockchain reorganizes if the peer's chain wins the fork choice. At
+// the same height the peer's top block is requested, which is ignored if it is ours.
+func (manager *SyncManager) sync(peer *Peer, target uint64) error {
+	height := manager.blockchain.Height()
+	start := height
+	if start >= target && target > 1 {
+		start = target - 1
+	}
+	for start < target {
+		count := target - start
+		if count > syncBatchSize {
+			count = syncBatchSize
+		}
+
+		manager.mutex.Lock()
+		manager.from, manager.to = start, start+count
+		manager.delivered = make(map[uint64]struct{})
+		manager.mutex.Unlock()
+
+		if err := manager.server.SendPacket(peer, EncodeGetBlock(start, uint16(count))); err != nil {
+			return err
+		}
+
+		received := make(map[uint64]*chain.Block)
+		unknownParent := false
+		for next := start; next < start+count; {
+			select {
+			case result := <-manager.results:
+				if result.err != nil {
+					return result.err
+				}
+				received[result.height] = result.block
+			case <-time.After(syncPartTimeout):
+				return ErrorSyncTimeout
+			}
+
+			// blocks may complete out of order
+			for block := received[next]; block != nil; block = received[next] {
+				if err := validateSyncBlock(block, next, manager.blockchain.ChainID()); err != nil {
+					return err
+				}
+				// the remaining blocks of the batch are received, but have an unknown parent too
+				if err := manager.blockchain.AddBlock(block); err == chain.ErrorBlockUnknownParent {
+					unknownParent = true
+				} else if err != nil {
+					return err
+				}
+				delete(received, next)
+				next++
+			}
+		}
+
+		if !unknownParent {
+			start += count
+			continue
+		}
+		// the genesis block is common to all nodes of the network
+		if start <= 1 || height-start >= chain.ReorgDepthMax {
+			return chain.ErrorReorgDepth
+		}
+		if start <= syncBatchSize {
+			start = 1
+		} else {
+			start -= syncBatchSize
+		}
+	}
+	return nil
+}
+
+// validateSyncBlock checks that a received block is the requested one and runs the checks that do not depend on the
+// blockchain. The remaining checks are done by AddBlock.
+func validateSyncBlock(block *chain.Block, height uint64, chainID uint32) error {
+	if block.Height != height {
+		return &chain.BlockError{Status: chain.StatusBlockHeight, Height: block.Height, Err: chain.ErrorBlockHeight}
+	}
+	return block.Validate(chainID)
+}
+
+// blockPenalty returns the penalty points for an invalid block, 0 if the error is not caused by invalid data.
+func blockPenalty(err error) uint32 {
+	var blockError *chain.BlockError
+	if !errors.As(err, &blockError) {
+		return 0
+	}
+	switch blockError.Status {
+	case chain.StatusBlockTimestamp:
+		return 10 // the clocks may differ
+	case chain.StatusBlockHeight, chain.StatusBlockLinkage, chain.StatusBlockProducer:
+		return 50
+	case chain.StatusBlockTransaction:
+		// an invalid signature is invalid everywhere, a state change may fail on a state that differs from the peer's
+		if errors.Is(err, chain.ErrorTransactionSignature) || errors.Is(err, chain.ErrorTransactionMalformed) {
+			return peerPenaltyMax
+		}
+		return 25
+	}
+	return peerPenaltyMax
+}
+
+// penalizeBlock penalizes the peer for an invalid block. At peerPenaltyMax the peer is disconnected and the failure is
+// recorded in the address book, which delays dialing it again.
+func (server *TcpServer) penalizeBlock(peer *Peer, err error) {
+	points := blockPenalty(err)
+	if points == 0 {
+		return
+	}
+	log.Printf("[%X]: Sync -> penalizing peer by %d points for %v", peer.NodeID, points, err)
+	if peer.penalize(points) {
+		log.Printf("[%X]: Sync -> disconnecting peer, penalty %d", peer.NodeID, peer.PenaltyPoints())
+		server.AddressBook.failed(peer.NodeID)
+		peer.Close()
+	}
+}
+
+// handleBlockPart collects the parts of blocks from the peer synced from.
+func (manager *SyncManager) handleBlockPart(packet *IncomingPacket) {
+	part, err := DecodeBlockPart(packet.Body.Payload)
+	if err != nil {
+		log.Printf("[%X]: Sync -> invalid block part %v", packet.NodeID, err)
+		return
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if atomic.LoadInt32(&manager.active) == 0 || manager.peer == nil || !bytes.Equal(manager.peer.NodeID, packet.NodeID) {
+		return
+	}
+	if part.Height < manager.from || part.Height >= manager.to {
+		return
+	}
+	// duplicate parts of a received block are ignored
+	if _, delivered := manager.delivered[part.Height]; delivered {
+		return
+	}
+	if part.Parts == 0 {
+		manager.deliver(syncResult{height: part.Height, err: ErrorBlockNotAvailable})
+		return
+	}
+	if part.Parts > syncPartsMax {
+		manager.deliver(syncResult{height: part.Height, err: &chain.BlockError{Status: chain.StatusBlockSize, Height: part.Height, Err: chain.ErrorBlockSize}})
+		return
+	}
+
+	parts := manager.incoming[part.Height]
+	if parts == nil {
+		parts = &blockParts{parts: make([][]byte, part.Parts)}
+		manager.incoming[part.Height] = parts
+	}
+	if int(part.Parts) != len(parts.parts) || parts.parts[part.Part] != nil {
+		return
+	}
+	parts.parts[part.Part] = append([]byte{}, part.Data...)
+	parts.received++
+	if parts.received < len(parts.parts) {
+		return
+	}
+
+	delete(manager.incoming, part.Height)
+	block, err := chain.DecodeBlock(bytes.Join(parts.parts, nil))
+	if err != nil {
+		manager.deliver(syncResult{height: part.Height, err: &chain.BlockError{Status: chain.StatusCorruptBlock, Height: part.Height, Err: err}})
+		return
+	}
+	manager.deliver(syncResult{height: part.Height, block: block})
+}
+
+// deliver passes the result to the sync goroutine, once per height of a request, so the channel has room for all of
+// them. It blocks until the result is received or the sync stopped. The mutex must be locked, the sync goroutine does
+// not lock it while it receives.
+func (manager *SyncManager) deliver(result syncResult) {
+	manager.delivered[result.height] = struct{}{}
+	select {
+	case manager.results <- result:
+	case <-manager.done:
+		log.Printf("[%X]: Sync -> stopped, dropping block %d", manager.peer.NodeID, result.height)
+	}
+}
+
+// handleGetBlock answers the requested blocks, each split into parts. The answer stops at the first missing block.
+func (manager *SyncManager) handleGetBlock(packet *IncomingPacket) {
+	request, err := DecodeGetBlock(packet.Body.Payload)
+	if err != nil {
+		log.Printf("[%X]: Sync -> invalid block request %v", packet.NodeID, err)
+		return
+	}
+	count := uint64(request.Count)
+	if count > syncBlocksMax {
+		count = syncBlocksMax
+	}
+
+	for height := request.Height; height < request.Height+count; height++ {
+		var data []byte
+		block, status := manager.blockchain.GetBlock(height)
+		if status == chain.StatusOK {
+			data = block.Encode()
+		}
+		for _, packetBody := range EncodeBlockParts(height, data) {
+			if err = manager.server.SendPacket(packet.Peer, packetBody); err != nil {
+				log.Printf("[%X]: Sync -> sending block %d failed %v", packet.NodeID, height, err)
+				return
+			}
+		}
+		if data == nil {
+			return
+		}
+	}
+}
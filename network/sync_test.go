@@ -0,0 +1,163 @@
+package network
+
+import (
+	"blockchain/chain"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// newTestSyncManager returns a sync manager that syncs from the peer and expects the blocks from..to-1.
+func newTestSyncManager(t *testing.T, from, to uint64) (manager *SyncManager, peer *Peer) {
+	t.Helper()
+	peer, _ = newTestPeer(t, newTestServer(t))
+	manager = &SyncManager{active: 1, peer: peer, from: from, to: to, incoming: make(map[uint64]*blockParts),
+		delivered: make(map[uint64]struct{}), results: make(chan syncResult, syncBatchSize), done: make(chan struct{})}
+	return manager, peer
+}
+
+// newTestSyncBlock returns an encoded block at the height that needs several parts.
+func newTestSyncBlock(t *testing.T, height uint64) (block *chain.Block, data []byte) {
+	t.Helper()
+	var transactions []chain.Transaction
+	for _, transaction := range newTestTransactions(t, 20) {
+		transactions = append(transactions, *transaction)
+	}
+	producer := newTestKey(t)
+	block = chain.NewBlock(make([]byte, 32), height, producer.PubKey(), transactions)
+	if err := block.Sign(producer); err != nil {
+		t.Fatal(err)
+	}
+	return block, block.Encode()
+}
+
+// expectSyncResults fails unless the results passed to the sync goroutine have the heights.
+func expectSyncResults(t *testing.T, manager *SyncManager, heights ...uint64) (results []syncResult) {
+	t.Helper()
+	for len(manager.results) > 0 {
+		results = append(results, <-manager.results)
+	}
+	if len(results) != len(heights) {
+		t.Fatalf("%d results, expected %d", len(results), len(heights))
+	}
+	for n := range results {
+		if results[n].height != heights[n] {
+			t.Fatalf("result %d height %d, expected %d", n, results[n].height, heights[n])
+		}
+	}
+	return results
+}
+
+func TestSyncPartsMax(t *testing.T) {
+	if parts := EncodeBlockParts(1, make([]byte, chain.BlockSizeMax)); len(parts) != syncPartsMax {
+		t.Fatalf("%d parts, maximum %d", len(parts), syncPartsMax)
+	}
+}
+
+func TestSyncBlockParts(t *testing.T) {
+	manager, peer := newTestSyncManager(t, 5, 7)
+	block, data := newTestSyncBlock(t, 5)
+	parts := EncodeBlockParts(5, data)
+	if len(parts) < 3 {
+		t.Fatalf("%d parts", len(parts))
+	}
+	handle := func(peer *Peer, packetBody *PacketBody) {
+		manager.handleBlockPart(&IncomingPacket{Peer: peer, NodeID: peer.NodeID, Body: *packetBody})
+	}
+
+	// parts of other peers and of heights outside the request are ignored
+	other, _ := newTestPeer(t, newTestServer(t))
+	handle(other, parts[0])
+	for _, height := range []uint64{4, 7} {
+		handle(peer, EncodeBlockParts(height, nil)[0])
+	}
+
+	// the parts arrive in reverse order, with a duplicate and a part with another count of parts
+	mismatch := &PacketBody{Payload: append([]byte{}, parts[1].Payload...)}
+	binary.BigEndian.PutUint16(mismatch.Payload[10:12], uint16(len(parts)+1))
+	handle(peer, parts[len(parts)-1])
+	handle(peer, parts[len(parts)-1])
+	handle(peer, mismatch)
+	for n := len(parts) - 2; n >= 0; n-- {
+		handle(peer, parts[n])
+	}
+	results := expectSyncResults(t, manager, 5)
+	if results[0].err != nil || !bytes.Equal(results[0].block.Hash(), block.Hash()) {
+		t.Fatalf("error %v", results[0].err)
+	}
+
+	// the parts of a received block are ignored, the block is not delivered twice
+	for _, part := range parts {
+		handle(peer, part)
+	}
+	expectSyncResults(t, manager)
+
+	// corrupt and unavailable blocks are delivered as errors
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-1] ^= 1
+	corrupt = corrupt[:len(corrupt)-1]
+	for _, part := range EncodeBlockParts(6, corrupt) {
+		handle(peer, part)
+	}
+	handle(peer, EncodeBlockParts(6, nil)[0])
+	results = expectSyncResults(t, manager, 6)
+	var blockError *chain.BlockError
+	if !errors.As(results[0].err, &blockError) || blockError.Status != chain.StatusCorruptBlock {
+		t.Fatalf("error %v", results[0].err)
+	}
+
+	manager.delivered = make(map[uint64]struct{})
+	handle(peer, EncodeBlockParts(6, nil)[0])
+	if results = expectSyncResults(t, manager, 6); results[0].err != ErrorBlockNotAvailable {
+		t.Fatalf("error %v", results[0].err)
+	}
+
+	// a block with more parts than the maximum size needs is rejected at the first part
+	oversized := &PacketBody{Payload: append([]byte{}, EncodeBlockParts(6, []byte{1})[0].Payload...)}
+	binary.BigEndian.PutUint16(oversized.Payload[10:12], syncPartsMax+1)
+	manager.delivered = make(map[uint64]struct{})
+	handle(peer, oversized)
+	if results = expectSyncResults(t, manager, 6); !errors.As(results[0].err, &blockError) || blockError.Status != chain.StatusBlockSize {
+		t.Fatalf("error %v", results[0].err)
+	}
+}
+
+func TestSyncDeliverStopped(t *testing.T) {
+	manager, peer := newTestSyncManager(t, 5, 6)
+	manager.results = make(chan syncResult)
+
+	// nobody receives, the result is dropped once the sync stopped
+	close(manager.done)
+	manager.handleBlockPart(&IncomingPacket{Peer: peer, NodeID: peer.NodeID, Body: *EncodeBlockParts(5, nil)[0]})
+	if _, delivered := manager.delivered[5]; !delivered {
+		t.Fatal("not delivered")
+	}
+}
+
+func TestBlockPenalty(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected uint32
+	}{
+		{ErrorSyncTimeout, 0},
+		{ErrorBlockNotAvailable, 0},
+		{chain.ErrorReorgDepth, 0},
+		{&chain.BlockError{Status: chain.StatusBlockTimestamp, Err: chain.ErrorBlockTimestamp}, 10},
+		{&chain.BlockError{Status: chain.StatusBlockHeight, Err: chain.ErrorBlockHeight}, 50},
+		{&chain.BlockError{Status: chain.StatusBlockLinkage, Err: chain.ErrorBlockPrevious}, 50},
+		{&chain.BlockError{Status: chain.StatusBlockProducer, Err: chain.ErrorBlockProducer}, 50},
+		{&chain.BlockError{Status: chain.StatusBlockTransaction, Err: chain.ErrorInsufficientBalance}, 25},
+		{&chain.BlockError{Status: chain.StatusBlockTransaction, Err: chain.ErrorTransactionNonce}, 25},
+		{&chain.BlockError{Status: chain.StatusBlockTransaction, Err: chain.ErrorTransactionSignature}, peerPenaltyMax},
+		{&chain.BlockError{Status: chain.StatusBlockTransaction, Err: chain.ErrorTransactionMalformed}, peerPenaltyMax},
+		{&chain.BlockError{Status: chain.StatusBlockSignature, Err: chain.ErrorBlockSignature}, peerPenaltyMax},
+		{&chain.BlockError{Status: chain.StatusBlockMerkleRoot, Err: chain.ErrorBlockMerkleRoot}, peerPenaltyMax},
+		{&chain.BlockError{Status: chain.StatusBlockSize, Err: chain.ErrorBlockSize}, peerPenaltyMax},
+		{&chain.BlockError{Status: chain.StatusCorruptBlock, Err: chain.ErrorBlockMalformed}, peerPenaltyMax},
+	} {
+		if points := blockPenalty(test.err); points != test.expected {
+			t.Errorf("%v: %d points, expected %d", test.err, points, test.expected)
+		}
+	}
+}
@@ -2,20 +2,20 @@ package network
 
 import (
 	"blockchain/chain"
-	"encoding/binary"
 	"log"
+	"net"
+	"strconv"
 )
 
 func ProcessPacket(packet *IncomingPacket) {
-	codec := packet.Peer.Context().(*Codec)
+	codec := packet.Peer.Codec
 	packetBody := packet.Body
 	switch packet.Body.Command {
 	case CommandAnnouncement:
-		announcement := AnnouncementPayload{
-			Features:          packetBody.Payload[0],
-			Port:              binary.BigEndian.Uint16(packetBody.Payload[1:3]),
-			BlockchainVersion: binary.BigEndian.Uint64(packetBody.Payload[3 : 3+8]),
-			BlockchainHeight:  binary.BigEndian.Uint64(packetBody.Payload[11 : 11+8]),
+		// the size and the chain ID are checked before the peer is authenticated
+		announcement, err := DecodeAnnouncement(packetBody.Payload)
+		if err != nil {
+			return
 		}
 		log.Printf("[%X]: ProcessPacket -> Announcement", packet.NodeID)
 		node := chain.Node{
@@ -23,17 +23,75 @@ func ProcessPacket(packet *IncomingPacket) {
 			PublicKey:         packet.PublicKey,
 			BlockchainHeight:  announcement.BlockchainHeight,
 			BlockchainVersion: announcement.BlockchainVersion,
+			ChainID:           announcement.ChainID,
 			Port:              announcement.Port,
 			IsValidator:       announcement.Features&(1<<chain.FeatureValidator) > 0,
 			IsIndexer:         announcement.Features&(1<<chain.FeatureIndexer) > 0,
 		}
 		log.Printf("[%X]: ProcessPacket -> Announcement from %s", packet.NodeID, node.String())
-		announcementResponse := EncodeAnnouncement(server.Node, 2)
+		packet.Peer.SetNodeInfo(&node)
+		// the listening address of an inbound peer is its IP with the announced port
+		if remote, ok := packet.Peer.RemoteAddr().(*net.TCPAddr); ok && !packet.Peer.Outbound && node.Port != 0 {
+			packet.Peer.addAddresses(net.JoinHostPort(remote.IP.String(), strconv.Itoa(int(node.Port))))
+		}
+		server.DHT.addPeer(packet.Peer)
+		server.AddressBook.Add(packet.PublicKey, node.FeaturesSupport(), packet.Peer.Addresses())
+		if packet.Peer.Outbound {
+			server.AddressBook.succeeded(packet.NodeID)
+		}
+		server.Sync.announced(packet.Peer, node.BlockchainVersion, node.BlockchainHeight)
+		// the dialing side announces first, only the receiving side answers
+		if packet.Peer.Outbound {
+			return
+		}
+		announcementResponse := EncodeAnnouncement(server.Node, server.nextSequence())
 		response, err := codec.Encode(server.PrivateKey, packet.PublicKey, announcementResponse)
 		if err != nil {
 			log.Printf("[%X]: ProcessPacket -> Error to answer %s", packet.NodeID, node.String())
 			return
 		}
-		packet.Peer.Write(response)
+		packet.Peer.AsyncWrite(response, nil)
+
+	case CommandPing:
+		if !packet.Peer.Authenticated {
+			return
+		}
+		if err := server.SendPacket(packet.Peer, EncodePong(packetBody.Sequence)); err != nil {
+			log.Printf("[%X]: ProcessPacket -> Error to answer ping %v", packet.NodeID, err)
+		}
+
+	case CommandPong:
+		pingSequence, err := DecodePong(packetBody.Payload)
+		if err != nil {
+			log.Printf("[%X]: ProcessPacket -> invalid pong %v", packet.NodeID, err)
+			return
+		}
+		if rtt, ok := packet.Peer.ponged(pingSequence, packet.ReceivedAt); ok {
+			log.Printf("[%X]: ProcessPacket -> Pong, round trip time %s", packet.NodeID, rtt.String())
+		}
+
+	case CommandFindNode, CommandFindValue, CommandStore, CommandNodes, CommandValue:
+		server.DHT.handlePacket(packet)
+
+	case CommandGetBlock:
+		if packet.Peer.Authenticated {
+			server.Sync.handleGetBlock(packet)
+		}
+
+	case CommandBlock:
+		server.Sync.handleBlockPart(packet)
+
+	case CommandNewBlock:
+		newBlock, err := DecodeNewBlock(packetBody.Payload)
+		if err != nil || !packet.Peer.Authenticated {
+			return
+		}
+		server.Sync.announced(packet.Peer, newBlock.BlockchainVersion, newBlock.BlockchainHeight)
+
+	case CommandGetPeers, CommandPeers:
+		server.handlePeerExchange(packet)
+
+	case CommandInventory, CommandGetData, CommandTransaction:
+		server.Gossip.handlePacket(packet)
 	}
 }
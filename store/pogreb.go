@@ -1,7 +1,7 @@
 package store
 
 import (
-	"errors"
+	"encoding/binary"
 	"io"
 	"log"
 	"sync"
@@ -15,6 +15,7 @@ type PogrebStore struct {
 	mutex    *sync.Mutex
 	filename string
 	db       *pogreb.DB
+	expires  *pogreb.DB // Expiration time per key, as unix nanoseconds. Stored separately so Count and Iterate only see records.
 }
 
 // NewPogrebStore create a properly initialized Pogreb store.
@@ -26,41 +27,88 @@ func NewPogrebStore(filename string) (store *PogrebStore, err error) {
 	if err != nil {
 		return nil, err
 	}
+	expires, err := pogreb.Open(filename+".expire", nil)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	return &PogrebStore{
 		mutex:    &sync.Mutex{},
 		filename: filename,
 		db:       db,
+		expires:  expires,
 	}, nil
 }
 
+// ExpireKeys deletes all key-value pairs whose expiration time has passed.
 func (store *PogrebStore) ExpireKeys() {
-	// TODO: implement
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	var expired [][]byte
+
+	iterator := store.expires.Items()
+	for {
+		key, value, err := iterator.Next()
+		if err != nil {
+			break
+		}
+		if len(value) != 8 || int64(binary.BigEndian.Uint64(value)) <= now {
+			expired = append(expired, key)
+		}
+	}
+
+	for _, key := range expired {
+		store.db.Delete(key)
+		store.expires.Delete(key)
+	}
 }
 
-// Set stores the key-value pair.
+// Set stores the key-value pair. A previous expiration time of the key is removed.
 func (store *PogrebStore) Set(key []byte, data []byte) error {
-	return store.db.Put(key, data)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.db.Put(key, data); err != nil {
+		return err
+	}
+	return store.expires.Delete(key)
 }
 
 // StoreExpire stores the key-value pair and deletes it after the expiration time.
 func (store *PogrebStore) StoreExpire(key []byte, data []byte, expiration time.Time) error {
-	// TODO: implement
-	return errors.New("StoreExpire not yet implemented")
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var expirationB [8]byte
+	binary.BigEndian.PutUint64(expirationB[:], uint64(expiration.UnixNano()))
+	if err := store.expires.Put(key, expirationB[:]); err != nil {
+		return err
+	}
+	return store.db.Put(key, data)
 }
 
-// Get returns the value for the key if present.
+// Get returns the value for the key if present. Expired values are not returned even if not yet deleted.
 func (store *PogrebStore) Get(key []byte) (data []byte, found bool) {
 	value, err := store.db.Get(key)
 	if err != nil || value == nil {
 		return nil, false
 	}
+	if expiration, err := store.expires.Get(key); err == nil && len(expiration) == 8 && int64(binary.BigEndian.Uint64(expiration)) <= time.Now().UnixNano() {
+		return nil, false
+	}
 	return value, true
 }
 
 // Delete deletes a key-value pair.
 func (store *PogrebStore) Delete(key []byte) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
 	store.db.Delete(key)
+	store.expires.Delete(key)
 }
 
 // Count returns the count of records stored.